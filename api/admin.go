@@ -0,0 +1,104 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// RequireAdminCert makes the admin routes only accept requests made
+// with a verified TLS client certificate. The server must be set up to
+// ask for and verify client certificates; see server.TLSConfig.
+var RequireAdminCert bool
+
+// AdminToken, when set, lets requests sending it as a bearer token in
+// their Authorization header use the admin routes too.
+var AdminToken string
+
+// AdminSubjects limits which client certificates are admins. Each entry
+// is matched against the certificate subject's common name and its full
+// distinguished name. When empty, every verified certificate is an admin.
+var AdminSubjects []string
+
+// The type of context keys set by this package.
+type contextKey int
+
+const adminKey contextKey = iota
+
+// AdminFromContext returns the identity of the admin making a request,
+// as set by requireAdmin. It is the common name of the admin's client
+// certificate, or "token" for requests made with AdminToken.
+func AdminFromContext(ctx context.Context) (string, bool) {
+	admin, ok := ctx.Value(adminKey).(string)
+	return admin, ok
+}
+
+// Wraps the handler of an admin only route. Requests must either send
+// AdminToken as a bearer token or, when RequireAdminCert is set, present
+// a verified client certificate. Requests with neither get 401
+// Unauthorized and certificates that aren't in AdminSubjects get 403
+// Forbidden. When neither is set up the admin routes are turned off,
+// and every request gets 403 Forbidden.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(response http.ResponseWriter, request *http.Request) {
+		if !RequireAdminCert && AdminToken == "" {
+			http.Error(response, "", http.StatusForbidden)
+			return
+		}
+		admin, code := authenticateAdmin(request)
+		if code == http.StatusUnauthorized && AdminToken != "" {
+			response.Header().Set("WWW-Authenticate", "Bearer")
+		}
+		if code != http.StatusOK {
+			http.Error(response, "", code)
+			return
+		}
+
+		ctx := context.WithValue(request.Context(), adminKey, admin)
+		next(response, request.WithContext(ctx))
+	}
+}
+
+// Returns the identity of the admin making request, or the status code
+// to refuse it with. A wrong token is refused even if the request also
+// has a certificate.
+func authenticateAdmin(request *http.Request) (string, int) {
+	if token, ok := bearerToken(request); ok && AdminToken != "" {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(AdminToken)) != 1 {
+			return "", http.StatusUnauthorized
+		}
+		return "token", http.StatusOK
+	}
+
+	if !RequireAdminCert || request.TLS == nil || len(request.TLS.VerifiedChains) == 0 {
+		return "", http.StatusUnauthorized
+	}
+	subject := request.TLS.VerifiedChains[0][0].Subject
+	if !isAdminSubject(subject.CommonName, subject.String()) {
+		return "", http.StatusForbidden
+	}
+	return subject.CommonName, http.StatusOK
+}
+
+// Returns the token of an "Authorization: Bearer <token>" header.
+func bearerToken(request *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(request.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// Reports whether a certificate subject belongs to an admin.
+func isAdminSubject(commonName, distinguishedName string) bool {
+	if len(AdminSubjects) == 0 {
+		return true
+	}
+	for _, allowed := range AdminSubjects {
+		if allowed == commonName || allowed == distinguishedName {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,138 @@
+package api
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// Returns TLS connection state as if the client had presented a
+// verified certificate with the given common name.
+func clientCert(commonName string) *tls.ConnectionState {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: commonName, Organization: []string{"Bears"}}}
+	return &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}, VerifiedChains: [][]*x509.Certificate{{cert}}}
+}
+
+// The AdminToken set by asAdmin.
+const testAdminToken = "correct-horse-battery-staple"
+
+// Sets AdminToken for the rest of the test and returns handler with the
+// token added to every request to an admin route, which are
+// /api/deleteUser and those under /api/v1/.
+func asAdmin(t *testing.T, handler http.Handler) http.Handler {
+	old := AdminToken
+	AdminToken = testAdminToken
+	t.Cleanup(func() { AdminToken = old })
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		admin := strings.HasPrefix(r.URL.Path, "/api/v1/") || r.URL.Path == "/api/deleteUser"
+		if admin && r.Header.Get("Authorization") == "" {
+			r.Header.Set("Authorization", "Bearer "+testAdminToken)
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// Tests that admin routes require a client certificate when asked to
+// and that public routes never do.
+func TestRequireAdmin(t *testing.T) {
+	RequireAdminCert = true
+	AdminSubjects = []string{"oski", "CN=dirks,O=Bears"}
+	defer func() { RequireAdminCert, AdminSubjects = false, nil }()
+	clearGlobalSlice()
+
+	router := mux.NewRouter()
+	RegisterRoutes(router)
+
+	tests := []struct {
+		Name         string
+		Method       string
+		Endpoint     string
+		TLS          *tls.ConnectionState
+		ExpectedCode int
+	}{
+		{"Plain HTTP", http.MethodGet, "/api/v1/users", nil, http.StatusUnauthorized},
+		{"No Client Cert", http.MethodGet, "/api/v1/users", &tls.ConnectionState{}, http.StatusUnauthorized},
+		{"Unknown Subject", http.MethodGet, "/api/v1/users", clientCert("stanfurd"), http.StatusForbidden},
+		{"Common Name", http.MethodGet, "/api/v1/users", clientCert("oski"), http.StatusOK},
+		{"Distinguished Name", http.MethodGet, "/api/v1/users:export", clientCert("dirks"), http.StatusOK},
+		{"Batch", http.MethodPost, "/api/v1/batch", clientCert("stanfurd"), http.StatusForbidden},
+		{"Delete Without Client Cert", http.MethodDelete, "/api/deleteUser", &tls.ConnectionState{}, http.StatusUnauthorized},
+		{"Delete Unknown Subject", http.MethodDelete, "/api/deleteUser", clientCert("stanfurd"), http.StatusForbidden},
+		{"Public Route", http.MethodGet, "/api/getQuery?userID=40", nil, http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			req := httptest.NewRequest(test.Method, test.Endpoint, nil)
+			req.TLS = test.TLS
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != test.ExpectedCode {
+				t.Fatalf("Incorrect status code returned! Expected: %d Actual: %d", test.ExpectedCode, rr.Code)
+			}
+		})
+	}
+
+	// Handlers can find out which admin is calling them.
+	var admin string
+	handler := requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		admin, _ = AdminFromContext(r.Context())
+	})
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.TLS = clientCert("oski")
+	handler(httptest.NewRecorder(), req)
+	if admin != "oski" {
+		t.Fatalf("Expected admin oski in the context. Got %q", admin)
+	}
+}
+
+// Tests that admin routes are turned off until an admin token or client
+// CA is set up, and that the token lets admins in.
+func TestAdminToken(t *testing.T) {
+	defer func() { AdminToken = "" }()
+	clearGlobalSlice()
+
+	router := mux.NewRouter()
+	RegisterRoutes(router)
+
+	tests := []struct {
+		Name          string
+		Token         string
+		Authorization string
+		ExpectedCode  int
+	}{
+		{"Nothing Set Up", "", "", http.StatusForbidden},
+		{"Nothing Set Up With Token", "", "Bearer " + testAdminToken, http.StatusForbidden},
+		{"No Token", testAdminToken, "", http.StatusUnauthorized},
+		{"Wrong Token", testAdminToken, "Bearer " + testAdminToken + "x", http.StatusUnauthorized},
+		{"Basic Auth", testAdminToken, "Basic b3NraTpiZWFy", http.StatusUnauthorized},
+		{"Token", testAdminToken, "Bearer " + testAdminToken, http.StatusOK},
+		{"Lowercase Scheme", testAdminToken, "bearer " + testAdminToken, http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			AdminToken = test.Token
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/users", nil)
+			if test.Authorization != "" {
+				req.Header.Set("Authorization", test.Authorization)
+			}
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != test.ExpectedCode {
+				t.Fatalf("Incorrect status code returned! Expected: %d Actual: %d", test.ExpectedCode, rr.Code)
+			}
+			if challenge := rr.Header().Get("WWW-Authenticate"); (rr.Code == http.StatusUnauthorized) != (challenge == "Bearer") {
+				t.Fatalf("Unexpected WWW-Authenticate %q with status %d", challenge, rr.Code)
+			}
+		})
+	}
+}
@@ -7,9 +7,10 @@ package api
 import (
 	"encoding/json"
 	"errors"
-	"fmt"
 	"net/http"
+	"strconv"
 
+	"github.com/BearCloud/sp21-assignment-4/logging"
 	"github.com/gorilla/mux"
 )
 
@@ -22,14 +23,41 @@ var UserSlice []Credentials
 func RegisterRoutes(router *mux.Router) {
 	// We have done the first 3 routes for you. Register the remaining ones
 	// based on the API given in API.md after reading over all the functions below.
-	router.HandleFunc("/api/getCookie", getCookie).Methods(http.MethodGet)
+	router.Use(secureHeaders, compress, logRequests, traceRequests, recordMetrics, cors, csrf, limitBody, decompressBody, rateLimit)
+	// Requests that match no route are still logged and counted.
+	router.NotFoundHandler = secureHeaders(logRequests(recordMetrics(http.NotFoundHandler())))
+	router.MethodNotAllowedHandler = secureHeaders(logRequests(recordMetrics(http.HandlerFunc(methodNotAllowed))))
+	router.HandleFunc("/api/getCookie", noStore(getCookie)).Methods(http.MethodGet)
 	router.HandleFunc("/api/getQuery", getQuery).Methods(http.MethodGet)
-	router.HandleFunc("/api/getJSON", getJSON).Methods(http.MethodGet)
-	router.HandleFunc("/api/signup", signup).Methods(http.MethodPost)
+	router.HandleFunc("/api/getJSON", noStore(getJSON)).Methods(http.MethodGet)
+	router.HandleFunc("/api/signup", idempotent(signup)).Methods(http.MethodPost)
 	router.HandleFunc("/api/getIndex", getIndex).Methods(http.MethodGet)
-	router.HandleFunc("/api/getPW", getPassword).Methods(http.MethodGet)
+	router.HandleFunc("/api/getPW", noStore(getPassword)).Methods(http.MethodGet)
 	router.HandleFunc("/api/updatePW", updatePassword).Methods(http.MethodPut)
-	router.HandleFunc("/api/deleteUser", deleteUser).Methods(http.MethodDelete)
+	router.HandleFunc("/api/deleteUser", requireAdmin(deleteUser)).Methods(http.MethodDelete)
+	router.HandleFunc("/api/verify", verifyPassword).Methods(http.MethodPost)
+
+	// Probes for orchestrators. See api/health.go.
+	router.HandleFunc("/healthz", healthz).Methods(http.MethodGet)
+	router.HandleFunc("/readyz", readyz).Methods(http.MethodGet)
+	router.HandleFunc("/version", version).Methods(http.MethodGet)
+	router.HandleFunc("/metrics", serveMetrics).Methods(http.MethodGet)
+
+	// Admin only routes used by tooling such as cmd/credctl.
+	// See api/admin.go.
+	router.HandleFunc("/api/v1/users", requireAdmin(listUsers)).Methods(http.MethodGet)
+	router.HandleFunc("/api/v1/users:import", requireAdmin(importUsers)).Methods(http.MethodPost)
+	router.HandleFunc("/api/v1/users:export", requireAdmin(noStore(exportUsers))).Methods(http.MethodGet)
+	router.HandleFunc("/api/v1/batch", requireAdmin(idempotent(batch))).Methods(http.MethodPost)
+	router.HandleFunc("/api/v1/users/{username}/lockout", requireAdmin(getLockout)).Methods(http.MethodGet)
+	router.HandleFunc("/api/v1/users/{username}/lockout", requireAdmin(unlockUser)).Methods(http.MethodDelete)
+	router.HandleFunc("/api/v1/audit", requireAdmin(getAuditEvents)).Methods(http.MethodGet)
+	router.HandleFunc("/api/v1/events", requireAdmin(streamEvents)).Methods(http.MethodGet)
+	router.HandleFunc("/api/v1/webhooks/dead-letters", requireAdmin(getDeadLetters)).Methods(http.MethodGet)
+	router.HandleFunc("/api/v1/webhooks/dead-letters", requireAdmin(clearDeadLetters)).Methods(http.MethodDelete)
+
+	// Answers CORS preflights for every route above. See api/cors.go.
+	registerPreflights(router)
 }
 
 // Obtain the "access_token" cookie's value and write it to the response.
@@ -37,26 +65,26 @@ func RegisterRoutes(router *mux.Router) {
 func getCookie(response http.ResponseWriter, request *http.Request) {
 	cookie, err := request.Cookie("access_token")
 	if err != nil {
-		fmt.Fprint(response, "")
-	} else {
-		fmt.Fprint(response, cookie.Value)
+		cookie = &http.Cookie{}
 	}
+	writeResponse(response, request, cookie.Value, cookieResponse{cookie.Value})
 }
 
 // Obtain the "userID" query parameter and write it to the response.
 // If there is no such query parameter, write an empty string to the response.
 func getQuery(response http.ResponseWriter, request *http.Request) {
 	userIDQuery := request.URL.Query().Get("userID")
-	fmt.Fprint(response, userIDQuery)
+	writeResponse(response, request, userIDQuery, queryResponse{userIDQuery})
 }
 
 //Reads an HTTP Request as a credentials pointer,
 // passing back an error in the case of problems.
+// See decodeBody for the errors returned for the body itself.
 func readJSON(request *http.Request) (*Credentials, error) {
 	var creds Credentials
-	err := json.NewDecoder(request.Body).Decode(&creds)
+	err := decodeBody(request, &creds)
 	if err != nil {
-		return &creds, errors.New("Bad JSON")
+		return &creds, err
 	} else if creds.Password == "" {
 		return &creds, errors.New("No Password")
 	} else if creds.Username == "" {
@@ -80,20 +108,21 @@ func readJSON(request *http.Request) (*Credentials, error) {
 func getJSON(response http.ResponseWriter, request *http.Request) {
 	creds, err := readJSON(request)
 	if err != nil {
-		http.Error(response, "", http.StatusBadRequest)
+		rejectBody(response, err)
 	} else {
-		fmt.Fprint(response, creds.Username+"\n"+creds.Password)
+		writeResponse(response, request, creds.Username+"\n"+creds.Password, creds)
 	}
 }
 
-//Returns the index of a user with a given username
+//Returns the index of a user with a given username.
+//Callers must hold userLock.
 func findUser(username string) (int, error) {
 	for i, creds := range UserSlice {
 		if creds.Username == username {
 			return i, nil
 		}
 	}
-	return -1, errors.New("User Not Found")
+	return -1, errUserNotFound
 }
 
 // Our JSON file will look like this:
@@ -113,14 +142,20 @@ func findUser(username string) (int, error) {
 func signup(response http.ResponseWriter, request *http.Request) {
 	creds, err := readJSON(request)
 	if err != nil {
-		http.Error(response, "", http.StatusBadRequest)
+		rejectBody(response, err)
 	} else {
-		_, userErr := findUser(creds.Username)
-		if userErr != nil {
-			UserSlice = append(UserSlice, *creds)
+		log := logging.FromContext(request.Context())
+		userErr := AddUser(request.Context(), *creds)
+		if hidesUser(request.Context(), userErr) {
 			response.WriteHeader(201)
-		} else {
+		} else if userErr == errUserExists {
 			http.Error(response, "", http.StatusConflict)
+		} else if userErr != nil {
+			log.Error("adding user", "credentials", *creds, "error", userErr)
+			http.Error(response, "", http.StatusInternalServerError)
+		} else {
+			log.Info("user signed up", "username", creds.Username)
+			response.WriteHeader(201)
 		}
 	}
 }
@@ -133,21 +168,18 @@ func signup(response http.ResponseWriter, request *http.Request) {
 //
 // Decode this JSON file into an instance of Credentials. (What happens when we don't have all the fields? Does it matter in this case?)
 // Return the array index of the Credentials object in the global Credentials slice.
+// In hardened mode the JSON needs the user's "password" too. See api/hardened.go.
 //
 // The index will be of type integer, but we can only write strings to the response. What library and function was used to get around this?
 //
 // Make sure to error check! What kind of errors can we expect here?
 func getIndex(response http.ResponseWriter, request *http.Request) {
 	creds, err := readJSON(request)
-	if err != nil && err.Error() != "No Password" {
-		http.Error(response, "", http.StatusBadRequest)
+	index, _, _, found := lookupRequested(request, creds, err)
+	if !found {
+		rejectBody(response, err)
 	} else {
-		index, userErr := findUser(creds.Username)
-		if userErr != nil {
-			http.Error(response, "", http.StatusBadRequest)
-		} else {
-			fmt.Fprintf(response, "%d", index)
-		}
+		writeResponse(response, request, strconv.Itoa(index), indexResponse{index})
 	}
 }
 
@@ -159,19 +191,16 @@ func getIndex(response http.ResponseWriter, request *http.Request) {
 //
 // Decode this JSON file into an instance of Credentials. (What happens when we don't have all the fields? Does it matter in this case?)
 // Write the password of the specific user to the response.
+// In hardened mode the JSON needs the user's "password" too. See api/hardened.go.
 //
 // Make sure to error check! What kind of errors can we expect here?
 func getPassword(response http.ResponseWriter, request *http.Request) {
 	creds, err := readJSON(request)
-	if err != nil && err.Error() != "No Password" {
-		http.Error(response, "", http.StatusBadRequest)
-	} else {
-		index, userErr := findUser(creds.Username)
-		if userErr != nil {
-			http.Error(response, "", http.StatusBadRequest)
-		} else {
-			fmt.Fprint(response, UserSlice[index].Password)
-		}
+	_, password, version, found := lookupRequested(request, creds, err)
+	if !found {
+		rejectBody(response, err)
+	} else if !writeETag(response, request, version) {
+		writeResponse(response, request, password, passwordResponse{password})
 	}
 }
 
@@ -190,13 +219,25 @@ func getPassword(response http.ResponseWriter, request *http.Request) {
 func updatePassword(response http.ResponseWriter, request *http.Request) {
 	creds, err := readJSON(request)
 	if err != nil {
-		http.Error(response, "", http.StatusBadRequest)
+		rejectBody(response, err)
 	} else {
-		index, userErr := findUser(creds.Username)
-		if userErr != nil {
+		log := logging.FromContext(request.Context())
+		userErr := ifMatch(request, func() error {
+			return SetPassword(request.Context(), creds.Username, creds.Password)
+		}, func(version uint64) error {
+			return CompareAndSetPassword(request.Context(), creds.Username, creds.Password, version)
+		})
+		if hidesUser(request.Context(), userErr) {
+			// Respond as though the change was made.
+		} else if userErr == errVersionMismatch {
+			http.Error(response, "", http.StatusPreconditionFailed)
+		} else if userErr == errUserNotFound {
 			http.Error(response, "", http.StatusBadRequest)
+		} else if userErr != nil {
+			log.Error("changing password", "username", creds.Username, "error", userErr)
+			http.Error(response, "", http.StatusInternalServerError)
 		} else {
-			UserSlice[index].Password = creds.Password
+			log.Info("password changed", "username", creds.Username)
 		}
 	}
 }
@@ -223,14 +264,64 @@ func remove(slice []Credentials, index int) []Credentials {
 // Make sure to error check! What kind of errors can we expect here?
 func deleteUser(response http.ResponseWriter, request *http.Request) {
 	creds, err := readJSON(request)
-	if err != nil {
-		http.Error(response, "", http.StatusBadRequest)
+	if err != nil && err.Error() != "No Password" {
+		rejectBody(response, err)
 	} else {
-		index, userErr := findUser(creds.Username)
-		if userErr != nil {
+		log := logging.FromContext(request.Context())
+		userErr := ifMatch(request, func() error {
+			return RemoveUser(request.Context(), creds.Username)
+		}, func(version uint64) error {
+			return CompareAndRemoveUser(request.Context(), creds.Username, version)
+		})
+		if hidesUser(request.Context(), userErr) {
+			// Respond as though the change was made.
+		} else if userErr == errVersionMismatch {
+			http.Error(response, "", http.StatusPreconditionFailed)
+		} else if userErr == errUserNotFound {
 			http.Error(response, "", http.StatusBadRequest)
+		} else if userErr != nil {
+			log.Error("deleting user", "username", creds.Username, "error", userErr)
+			http.Error(response, "", http.StatusInternalServerError)
 		} else {
-			UserSlice = remove(UserSlice, index)
+			log.Info("user deleted", "username", creds.Username)
 		}
 	}
 }
+
+// The bodies of responses from the routes above in formats other than
+// plain text. See writeResponse.
+type (
+	cookieResponse struct {
+		AccessToken string `json:"access_token"`
+	}
+	queryResponse struct {
+		UserID string `json:"userID"`
+	}
+	indexResponse struct {
+		Index int `json:"index"`
+	}
+	passwordResponse struct {
+		Password string `json:"password"`
+	}
+)
+
+// A single entry in the response of listUsers.
+type userSummary struct {
+	Username string `json:"username"`
+}
+
+// Writes a JSON array with the username of every user, in slice order:
+//
+// [
+// 	{"username" : <username>},
+// 	...
+// ]
+func listUsers(response http.ResponseWriter, request *http.Request) {
+	names := Usernames(request.Context())
+	users := make([]userSummary, len(names))
+	for i, name := range names {
+		users[i] = userSummary{name}
+	}
+	response.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(response).Encode(users)
+}
@@ -0,0 +1,113 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/BearCloud/sp21-assignment-4/audit"
+	"github.com/BearCloud/sp21-assignment-4/logging"
+)
+
+// AuditLog, when set, records every user created, password changed
+// and user deleted. See the audit package.
+var AuditLog *audit.Log
+
+// The most events a single query returns.
+const maxAuditEvents = 1000
+
+var auditFailuresTotal = Metrics.NewCounter("audit_failures_total",
+	"Changes to users that could not be written to the audit log.")
+
+// Appends an event to AuditLog. The change has already been made by
+// then, so failures are logged rather than undoing it.
+func auditEvent(ctx context.Context, event UserEvent) {
+	if AuditLog == nil {
+		return
+	}
+	_, err := AuditLog.Append(audit.Event{
+		Time:      event.Time,
+		Action:    event.Type,
+		Username:  event.Username,
+		Actor:     event.Actor,
+		RequestID: event.RequestID,
+	})
+	if err != nil {
+		auditFailuresTotal.Inc()
+		logging.FromContext(ctx).Error("writing audit log", "event", event.Type, "username", event.Username, "error", err)
+	}
+}
+
+// Writes a JSON array of the events in the audit log, oldest first.
+// The query parameters narrow them down:
+//
+//	username  only events for this user
+//	since     only events at or after this RFC 3339 time
+//	until     only events before this RFC 3339 time
+//	after     only events with a seq after this one
+//	before    only events with a seq before this one
+//	limit     at most this many events, up to 1000 (the default)
+//	order     "newest" for the newest events first, or "oldest"
+//
+// Bad parameters get 400 Bad Request, and 404 Not Found is returned if
+// there is no audit log.
+func getAuditEvents(response http.ResponseWriter, request *http.Request) {
+	if AuditLog == nil {
+		http.Error(response, "", http.StatusNotFound)
+		return
+	}
+	query := request.URL.Query()
+	filter := audit.Filter{Username: query.Get("username")}
+	limit := maxAuditEvents
+	var err error
+	if since := query.Get("since"); since != "" {
+		if filter.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			http.Error(response, "", http.StatusBadRequest)
+			return
+		}
+	}
+	if until := query.Get("until"); until != "" {
+		if filter.Until, err = time.Parse(time.RFC3339, until); err != nil {
+			http.Error(response, "", http.StatusBadRequest)
+			return
+		}
+	}
+	if after := query.Get("after"); after != "" {
+		if filter.After, err = strconv.ParseUint(after, 10, 64); err != nil {
+			http.Error(response, "", http.StatusBadRequest)
+			return
+		}
+	}
+	if before := query.Get("before"); before != "" {
+		if filter.Before, err = strconv.ParseUint(before, 10, 64); err != nil || filter.Before == 0 {
+			http.Error(response, "", http.StatusBadRequest)
+			return
+		}
+	}
+	if l := query.Get("limit"); l != "" {
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 || limit > maxAuditEvents {
+			http.Error(response, "", http.StatusBadRequest)
+			return
+		}
+	}
+	order := audit.OldestFirst
+	switch query.Get("order") {
+	case "", "oldest":
+	case "newest":
+		order = audit.NewestFirst
+	default:
+		http.Error(response, "", http.StatusBadRequest)
+		return
+	}
+
+	events, err := AuditLog.Query(filter, order, limit)
+	if err != nil {
+		logging.FromContext(request.Context()).Error("reading audit log", "error", err)
+		http.Error(response, "", http.StatusInternalServerError)
+		return
+	}
+	response.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(response).Encode(events)
+}
@@ -0,0 +1,104 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BearCloud/sp21-assignment-4/audit"
+	"github.com/gorilla/mux"
+)
+
+// Tests that changes to users are recorded in the audit log and can be
+// queried.
+func TestAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	log, err := audit.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	AuditLog = log
+	defer func() {
+		log.Close()
+		AuditLog = nil
+	}()
+	clearGlobalSlice()
+	routes := mux.NewRouter()
+	RegisterRoutes(routes)
+	router := asAdmin(t, routes)
+	send := func(method, endpoint, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, endpoint, strings.NewReader(body))
+		req.RemoteAddr = "192.0.2.1:1234"
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	start := time.Now().Add(-time.Second)
+	send(http.MethodPost, "/api/signup", `{"username": "oski", "password": "bear"}`)
+	send(http.MethodPost, "/api/signup", `{"username": "oski", "password": "bear"}`)
+	send(http.MethodPost, "/api/signup", `{"username": "dirks", "password": "tree"}`)
+	send(http.MethodPut, "/api/updatePW", `{"username": "oski", "password": "tree"}`)
+	send(http.MethodDelete, "/api/deleteUser", `{"username": "dirks"}`)
+	// Nothing is recorded for a batch that was rolled back.
+	send(http.MethodPost, "/api/v1/batch", `{"operations": [{"op": "deleteUser", "username": "oski"}, {"op": "deleteUser", "username": "nobody"}]}`)
+
+	if count, _, err := audit.VerifyFile(path); err != nil || count != 4 {
+		t.Fatalf("Expected 4 events to verify. Got %d and %v", count, err)
+	}
+
+	tests := []struct {
+		Name            string
+		Query           string
+		ExpectedCode    int
+		ExpectedActions []string
+	}{
+		{"Everything", "", http.StatusOK, []string{EventUserCreated, EventUserCreated, EventPasswordChanged, EventUserDeleted}},
+		{"Username", "?username=oski", http.StatusOK, []string{EventUserCreated, EventPasswordChanged}},
+		{"Limit", "?username=oski&limit=1", http.StatusOK, []string{EventUserCreated}},
+		{"Time Range", "?since=" + start.UTC().Format(time.RFC3339) + "&until=" + start.Add(time.Hour).UTC().Format(time.RFC3339), http.StatusOK,
+			[]string{EventUserCreated, EventUserCreated, EventPasswordChanged, EventUserDeleted}},
+		{"Newest First", "?order=newest&limit=2", http.StatusOK, []string{EventUserDeleted, EventPasswordChanged}},
+		{"Next Page", "?order=newest&limit=2&before=3", http.StatusOK, []string{EventUserCreated, EventUserCreated}},
+		{"After", "?after=3", http.StatusOK, []string{EventUserDeleted}},
+		{"Bad Order", "?order=random", http.StatusBadRequest, nil},
+		{"Bad Cursor", "?before=0", http.StatusBadRequest, nil},
+		{"Before Anything", "?until=" + start.Add(-time.Hour).UTC().Format(time.RFC3339), http.StatusOK, []string{}},
+		{"Bad Time", "?since=yesterday", http.StatusBadRequest, nil},
+		{"Bad Limit", "?limit=0", http.StatusBadRequest, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			rr := send(http.MethodGet, "/api/v1/audit"+test.Query, "")
+			if rr.Code != test.ExpectedCode {
+				t.Fatalf("Expected status code %d. Got %d", test.ExpectedCode, rr.Code)
+			}
+			if test.ExpectedCode != http.StatusOK {
+				return
+			}
+			var events []audit.Event
+			if err := json.Unmarshal(rr.Body.Bytes(), &events); err != nil {
+				t.Fatal(err)
+			}
+			actions := []string{}
+			for _, event := range events {
+				actions = append(actions, event.Action)
+				// Users can only be deleted by admins.
+				actor := "client:192.0.2.1"
+				if event.Action == EventUserDeleted {
+					actor = "admin:token"
+				}
+				if event.Actor != actor || event.RequestID == "" {
+					t.Errorf("Expected the client and request to be recorded. Got %+v", event)
+				}
+			}
+			if strings.Join(actions, ",") != strings.Join(test.ExpectedActions, ",") {
+				t.Errorf("Expected actions %v. Got %v", test.ExpectedActions, actions)
+			}
+		})
+	}
+}
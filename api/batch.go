@@ -0,0 +1,170 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/BearCloud/sp21-assignment-4/logging"
+)
+
+// The most operations a single batch may contain.
+const maxBatchOperations = 1000
+
+// The operations a batch can contain, named after the handlers they mirror.
+const (
+	opSignup         = "signup"
+	opUpdatePassword = "updatePassword"
+	opDeleteUser     = "deleteUser"
+)
+
+// Returned inside an atomic batch to roll it back.
+var errBatchFailed = errors.New("Batch Failed")
+
+// A single operation in a batch.
+type batchOperation struct {
+	Op       string `json:"op"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// The body of a batch request. Atomic defaults to true.
+type batchRequest struct {
+	Atomic     *bool            `json:"atomic"`
+	Operations []batchOperation `json:"operations"`
+}
+
+// The outcome of a single operation, using the status code the
+// matching single endpoint would have responded with.
+type batchResult struct {
+	Index  int    `json:"index"`
+	Op     string `json:"op"`
+	Status int    `json:"status"`
+}
+
+// The response written by batch.
+type batchResponse struct {
+	Atomic  bool          `json:"atomic"`
+	Applied bool          `json:"applied"`
+	Results []batchResult `json:"results"`
+}
+
+// Our JSON file will look like this:
+//
+// {
+// 	"atomic" : <true or false>,
+// 	"operations" : [
+// 		{"op" : "signup", "username" : <username>, "password" : <password>},
+// 		{"op" : "updatePassword", "username" : <username>, "password" : <password>},
+// 		{"op" : "deleteUser", "username" : <username>},
+// 		...
+// 	]
+// }
+//
+// Runs every operation in order. Atomic batches run inside a single
+// store update, so if any operation fails none of them are applied and
+// the response is 422 Unprocessable Entity. Operations that would have
+// succeeded are then reported with 424 Failed Dependency. Non-atomic
+// batches apply each operation on its own.
+func batch(response http.ResponseWriter, request *http.Request) {
+	var body batchRequest
+	err := decodeBody(request, &body)
+	if err != nil {
+		rejectBody(response, err)
+		return
+	}
+	if len(body.Operations) == 0 || len(body.Operations) > maxBatchOperations {
+		http.Error(response, "", http.StatusBadRequest)
+		return
+	}
+	atomic := body.Atomic == nil || *body.Atomic
+
+	result := batchResponse{Atomic: atomic, Applied: true, Results: make([]batchResult, len(body.Operations))}
+	run := func(i int) bool {
+		op := body.Operations[i]
+		status := runOperation(op)
+		result.Results[i] = batchResult{Index: i, Op: op.Op, Status: status}
+		return status < 300
+	}
+
+	if atomic {
+		err = update(request.Context(), "Batch", func() error {
+			failed := false
+			for i := range body.Operations {
+				if !run(i) {
+					failed = true
+				}
+			}
+			if failed {
+				return errBatchFailed
+			}
+			return nil
+		})
+		if err != nil && err != errBatchFailed {
+			logging.FromContext(request.Context()).Error("applying batch", "error", err)
+			http.Error(response, "", http.StatusInternalServerError)
+			return
+		}
+		if err == errBatchFailed {
+			result.Applied = false
+			for i := range result.Results {
+				if result.Results[i].Status < 300 {
+					result.Results[i].Status = http.StatusFailedDependency
+				}
+			}
+		}
+	} else {
+		for i := range body.Operations {
+			err := update(request.Context(), "Batch", func() error {
+				if !run(i) {
+					return errBatchFailed
+				}
+				return nil
+			})
+			if err != nil && err != errBatchFailed {
+				logging.FromContext(request.Context()).Error("applying batch operation", "index", i, "error", err)
+				result.Results[i].Status = http.StatusInternalServerError
+			}
+		}
+	}
+
+	for _, r := range result.Results {
+		if r.Status == http.StatusConflict {
+			conflictsTotal.Inc()
+		}
+	}
+	response.Header().Set("Content-Type", "application/json")
+	if !result.Applied {
+		response.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	json.NewEncoder(response).Encode(result)
+}
+
+// Applies a single operation to the global slice, returning the status
+// code the matching endpoint would have used. Callers must go through
+// update.
+func runOperation(op batchOperation) int {
+	needsPassword := op.Op != opDeleteUser
+	if op.Username == "" || (needsPassword && op.Password == "") {
+		return http.StatusBadRequest
+	}
+
+	switch op.Op {
+	case opSignup:
+		if addUser(Credentials{op.Username, op.Password}) != nil {
+			return http.StatusConflict
+		}
+		return http.StatusCreated
+	case opUpdatePassword:
+		if setPassword(op.Username, op.Password) != nil {
+			return http.StatusBadRequest
+		}
+		return http.StatusOK
+	case opDeleteUser:
+		if removeUser(op.Username) != nil {
+			return http.StatusBadRequest
+		}
+		return http.StatusOK
+	}
+	return http.StatusBadRequest
+}
@@ -0,0 +1,102 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Tests the correctness of the batch function.
+func TestBatch(t *testing.T) {
+	operations := `[
+		{"op":"signup","username":"student2","password":"dab"},
+		{"op":"updatePassword","username":"student1","password":"dabdab"},
+		{"op":"signup","username":"student1","password":"dab"},
+		{"op":"deleteUser","username":"student3"},
+		{"op":"deleteUser","username":"student2"},
+		{"op":"rename","username":"student1","password":"dab"}
+	]`
+
+	tests := []struct {
+		Name             string
+		JSON             string
+		ExpectedCode     int
+		ExpectedStatuses []int
+		ExpectedUsers    []Credentials
+	}{
+		{"Atomic Failure", `{"operations":` + operations + `}`, http.StatusUnprocessableEntity,
+			[]int{http.StatusFailedDependency, http.StatusFailedDependency, http.StatusConflict, http.StatusBadRequest, http.StatusFailedDependency, http.StatusBadRequest},
+			[]Credentials{{"student1", "dab"}}},
+		{"Best Effort", `{"atomic":false,"operations":` + operations + `}`, http.StatusOK,
+			[]int{http.StatusCreated, http.StatusOK, http.StatusConflict, http.StatusBadRequest, http.StatusOK, http.StatusBadRequest},
+			[]Credentials{{"student1", "dabdab"}}},
+		{"Atomic Success", `{"atomic":true,"operations":[
+			{"op":"signup","username":"student2","password":"dab"},
+			{"op":"updatePassword","username":"student2","password":"dabdab"},
+			{"op":"deleteUser","username":"student1"}]}`, http.StatusOK,
+			[]int{http.StatusCreated, http.StatusOK, http.StatusOK},
+			[]Credentials{{"student2", "dabdab"}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			clearGlobalSlice()
+			UserSlice = append(UserSlice, Credentials{"student1", "dab"})
+
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/batch", strings.NewReader(test.JSON))
+			rr := httptest.NewRecorder()
+			batch(rr, req)
+
+			if rr.Result().StatusCode != test.ExpectedCode {
+				t.Fatalf("Incorrect status code returned! Expected: %d Actual: %d", test.ExpectedCode, rr.Result().StatusCode)
+			}
+			var result batchResponse
+			if err := json.NewDecoder(rr.Body).Decode(&result); err != nil {
+				t.Fatal(err)
+			}
+			statuses := []int{}
+			for _, r := range result.Results {
+				statuses = append(statuses, r.Status)
+			}
+			if !reflect.DeepEqual(statuses, test.ExpectedStatuses) {
+				t.Fatalf("Incorrect operation statuses! Expected: %v Actual: %v", test.ExpectedStatuses, statuses)
+			}
+			if !reflect.DeepEqual(UserSlice, test.ExpectedUsers) {
+				t.Fatalf("Incorrect users after batch! Expected: %v Actual: %v", test.ExpectedUsers, UserSlice)
+			}
+		})
+	}
+
+	// Malformed batches should not touch the store.
+	for _, body := range []string{"", `{"operations":[]}`, `{"operations":{}}`} {
+		clearGlobalSlice()
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/batch", strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		batch(rr, req)
+		if err := checkStatusCodeAndBody(http.StatusBadRequest, rr.Result().StatusCode, "", rr.Body.String()); err != nil {
+			t.Errorf("Batch %q: %s", body, err)
+		}
+	}
+}
+
+// Tests that an atomic batch that can't be saved leaves no trace.
+func TestBatchPersistFailure(t *testing.T) {
+	clearGlobalSlice()
+	StorePath = filepath.Join(t.TempDir(), "missing", "users.json")
+	defer func() { StorePath = "" }()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/batch", strings.NewReader(`{"operations":[{"op":"signup","username":"a","password":"b"}]}`))
+	rr := httptest.NewRecorder()
+	batch(rr, req)
+
+	if rr.Result().StatusCode != http.StatusInternalServerError {
+		t.Fatalf("Incorrect status code returned! Expected: %d Actual: %d", http.StatusInternalServerError, rr.Result().StatusCode)
+	}
+	if len(UserSlice) != 0 {
+		t.Fatalf("User was added even though the store could not be written: %v", UserSlice)
+	}
+}
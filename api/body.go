@@ -0,0 +1,226 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// MaxBodyBytes is the largest request body a route will read unless
+// BodyLimits gives it its own limit. Larger bodies get 413 Request
+// Entity Too Large.
+var MaxBodyBytes int64 = 1 << 20
+
+// BodyLimits maps route templates, such as /api/v1/users:import, to the
+// largest request body those routes will read.
+var BodyLimits = map[string]int64{}
+
+// When StrictJSON is set, request bodies with fields a route doesn't
+// use are rejected rather than the fields being ignored. It applies to
+// every body format, not only JSON.
+var StrictJSON = false
+
+// When RequireJSONContentType is set, request bodies must be sent with
+// a Content-Type. Otherwise a missing Content-Type is taken to mean
+// JSON, as older clients don't send one. Types other than those in
+// bodyFormats always get 415 Unsupported Media Type.
+var RequireJSONContentType = false
+
+// WriteTimeout is how long the server gives a response to be written,
+// as set on its http.Server. Zero means no limit.
+var WriteTimeout time.Duration
+
+// Gives a long running response, such as an export or an event stream,
+// another WriteTimeout to write what comes next, after waiting up to
+// wait for it.
+func extendWriteDeadline(response http.ResponseWriter, wait time.Duration) {
+	if WriteTimeout > 0 {
+		http.NewResponseController(response).SetWriteDeadline(time.Now().Add(wait + WriteTimeout))
+	}
+}
+
+// The formats request bodies can be sent in.
+const (
+	formatJSON    = "application/json"
+	formatForm    = "application/x-www-form-urlencoded"
+	formatMsgpack = "application/msgpack"
+)
+
+// Maps each accepted Content-Type to its format.
+var bodyFormats = map[string]string{
+	formatJSON:              formatJSON,
+	formatForm:              formatForm,
+	formatMsgpack:           formatMsgpack,
+	"application/x-msgpack": formatMsgpack,
+}
+
+// The errors returned by decodeBody, besides errUnsupportedFormat.
+var (
+	errBadBody      = errors.New("Bad Body")
+	errBodyTooLarge = errors.New("Body Too Large")
+)
+
+// Caps the size of every request body at the route's limit. Bodies
+// declared to be larger are refused straight away.
+func limitBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		limit := bodyLimit(request)
+		if request.Body != nil && limit > 0 {
+			if request.ContentLength > limit {
+				http.Error(response, "", http.StatusRequestEntityTooLarge)
+				return
+			}
+			request.Body = &limitedBody{http.MaxBytesReader(response, request.Body, limit), limit, 0}
+		}
+		next.ServeHTTP(response, request)
+	})
+}
+
+// Returns the largest body the request's route will read.
+func bodyLimit(request *http.Request) int64 {
+	if limit, ok := BodyLimits[routeTemplate(request)]; ok {
+		return limit
+	}
+	return MaxBodyBytes
+}
+
+// Wraps a MaxBytesReader so that reading past its limit fails with
+// errBodyTooLarge, which handlers can tell apart from other errors.
+type limitedBody struct {
+	io.ReadCloser
+	limit int64
+	read  int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if err != nil && err != io.EOF && b.read >= b.limit {
+		err = errBodyTooLarge
+	}
+	return n, err
+}
+
+// Decodes the request body into v, which is a pointer to a struct with
+// json tags, according to the body's Content-Type. Bodies are JSON,
+// form fields or MessagePack. It returns errUnsupportedFormat for any
+// other Content-Type, errBodyTooLarge if the body is over its limit and
+// errBadBody if the body is malformed, has anything after its value or,
+// with StrictJSON, has fields v doesn't.
+func decodeBody(request *http.Request, v interface{}) error {
+	format, ok := bodyFormat(request)
+	if !ok {
+		return errUnsupportedFormat
+	}
+	if request.Body == nil {
+		return errBadBody
+	}
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		if errors.Is(err, errBodyTooLarge) {
+			return errBodyTooLarge
+		}
+		return errBadBody
+	}
+
+	if decodeBytes(format, body, v) != nil {
+		return errBadBody
+	}
+	return nil
+}
+
+// Decodes body, which is in format, into v.
+func decodeBytes(format string, body []byte, v interface{}) error {
+	switch format {
+	case formatForm:
+		return decodeForm(body, v)
+	case formatMsgpack:
+		reader := bytes.NewReader(body)
+		decoder := msgpack.NewDecoder(reader)
+		decoder.SetCustomStructTag("json")
+		decoder.DisallowUnknownFields(StrictJSON)
+		if err := decoder.Decode(v); err != nil {
+			return err
+		}
+		if reader.Len() > 0 {
+			return errBadBody
+		}
+		return nil
+	}
+	return decodeJSON(bytes.NewReader(body), v)
+}
+
+// Decodes the single JSON value in body into v.
+func decodeJSON(body io.Reader, v interface{}) error {
+	decoder := json.NewDecoder(body)
+	if StrictJSON {
+		decoder.DisallowUnknownFields()
+	}
+	if err := decoder.Decode(v); err != nil {
+		return err
+	}
+	// Only whitespace may follow the value.
+	if err := decoder.Decode(&json.RawMessage{}); err != io.EOF {
+		return errBadBody
+	}
+	return nil
+}
+
+// Decodes form fields into v by their json tags. Each field may only
+// be given once.
+func decodeForm(body []byte, v interface{}) error {
+	values, err := url.ParseQuery(string(body))
+	if err != nil {
+		return err
+	}
+	fields := make(map[string]string, len(values))
+	for name, given := range values {
+		if len(given) != 1 {
+			return errBadBody
+		}
+		fields[name] = given[0]
+	}
+	asJSON, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	return decodeJSON(bytes.NewReader(asJSON), v)
+}
+
+// Returns the format of the request body, and false if its
+// Content-Type isn't one of bodyFormats.
+func bodyFormat(request *http.Request) (string, bool) {
+	header := request.Header.Get("Content-Type")
+	if header == "" {
+		return formatJSON, !RequireJSONContentType
+	}
+	mediaType, _, err := mime.ParseMediaType(header)
+	if err != nil {
+		return "", false
+	}
+	format, ok := bodyFormats[mediaType]
+	return format, ok
+}
+
+// Responds to a request whose body couldn't be used, where err is what
+// reading it returned: 413 Request Entity Too Large for errBodyTooLarge,
+// 415 Unsupported Media Type for errUnsupportedFormat and 400 Bad
+// Request for anything else.
+func rejectBody(response http.ResponseWriter, err error) {
+	switch err {
+	case errBodyTooLarge:
+		http.Error(response, "", http.StatusRequestEntityTooLarge)
+	case errUnsupportedFormat:
+		http.Error(response, "", http.StatusUnsupportedMediaType)
+	default:
+		http.Error(response, "", http.StatusBadRequest)
+	}
+}
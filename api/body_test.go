@@ -0,0 +1,75 @@
+package api
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// Tests the checks made on JSON request bodies.
+func TestRequestBodies(t *testing.T) {
+	MaxBodyBytes, BodyLimits = 96, map[string]int64{"/api/v1/batch": 1024}
+	defer func() { MaxBodyBytes, BodyLimits = 1<<20, map[string]int64{} }()
+
+	routes := mux.NewRouter()
+	RegisterRoutes(routes)
+	router := asAdmin(t, routes)
+
+	big := `{"username": "oski", "password": "` + strings.Repeat("a", 100) + `"}`
+	batchBody := `{"operations": [{"op": "signup", "username": "oski", "password": "` + strings.Repeat("a", 100) + `"}]}`
+	tests := []struct {
+		Name         string
+		Strict       bool
+		RequireType  bool
+		Method       string
+		Endpoint     string
+		ContentType  string
+		Body         string
+		Chunked      bool
+		ExpectedCode int
+	}{
+		{"JSON", false, false, http.MethodPost, "/api/signup", "application/json", `{"username": "oski", "password": "bear"}`, false, http.StatusCreated},
+		{"JSON With Charset", false, false, http.MethodPost, "/api/signup", "application/json; charset=utf-8", `{"username": "oski", "password": "bear"}`, false, http.StatusCreated},
+		{"No Content Type", false, false, http.MethodPost, "/api/signup", "", `{"username": "oski", "password": "bear"}`, false, http.StatusCreated},
+		{"No Content Type Required", false, true, http.MethodPost, "/api/signup", "", `{"username": "oski", "password": "bear"}`, false, http.StatusUnsupportedMediaType},
+		{"XML", false, false, http.MethodPost, "/api/signup", "application/xml", "<username>oski</username>", false, http.StatusUnsupportedMediaType},
+		{"Trailing Data", false, false, http.MethodPost, "/api/signup", "application/json", `{"username": "oski", "password": "bear"} {"username": "dirks"}`, false, http.StatusBadRequest},
+		{"Trailing Whitespace", false, false, http.MethodPost, "/api/signup", "application/json", "{\"username\": \"oski\", \"password\": \"bear\"}\n\n", false, http.StatusCreated},
+		{"Unknown Field", false, false, http.MethodPost, "/api/signup", "application/json", `{"username": "oski", "password": "bear", "email": "oski@berkeley.edu"}`, false, http.StatusCreated},
+		{"Unknown Field When Strict", true, false, http.MethodPost, "/api/signup", "application/json", `{"username": "oski", "password": "bear", "email": "oski@berkeley.edu"}`, false, http.StatusBadRequest},
+		{"Too Large", false, false, http.MethodPost, "/api/signup", "application/json", big, false, http.StatusRequestEntityTooLarge},
+		{"Too Large Without Length", false, false, http.MethodPost, "/api/signup", "application/json", big, true, http.StatusRequestEntityTooLarge},
+		{"Too Large Lookup", false, false, http.MethodGet, "/api/getIndex", "application/json", big, true, http.StatusRequestEntityTooLarge},
+		{"Route Limit", false, false, http.MethodPost, "/api/v1/batch", "application/json", batchBody, false, http.StatusOK},
+		{"Route Limit Exceeded", false, false, http.MethodPost, "/api/v1/batch", "application/json", batchBody + strings.Repeat(" ", 1024), true, http.StatusRequestEntityTooLarge},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			StrictJSON, RequireJSONContentType = test.Strict, test.RequireType
+			defer func() { StrictJSON, RequireJSONContentType = false, false }()
+			clearGlobalSlice()
+
+			var body io.Reader = strings.NewReader(test.Body)
+			if test.Chunked {
+				// Hides the length so the body has to be read to find it.
+				body = io.MultiReader(body)
+			}
+			req := httptest.NewRequest(test.Method, test.Endpoint, body)
+			if test.Chunked {
+				req.ContentLength = -1
+			}
+			if test.ContentType != "" {
+				req.Header.Set("Content-Type", test.ContentType)
+			}
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			if rr.Code != test.ExpectedCode {
+				t.Errorf("Expected status code %d. Got %d", test.ExpectedCode, rr.Code)
+			}
+		})
+	}
+}
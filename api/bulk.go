@@ -0,0 +1,278 @@
+package api
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/BearCloud/sp21-assignment-4/logging"
+)
+
+// The statuses a row of an import can end up with.
+const (
+	rowCreated  = "created"
+	rowConflict = "conflict"
+	rowInvalid  = "invalid"
+	rowSkipped  = "skipped"
+)
+
+// The outcome of importing a single row.
+type importRow struct {
+	Row      int    `json:"row"`
+	Username string `json:"username,omitempty"`
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+}
+
+// The response written by importUsers.
+type importResult struct {
+	Mode    string      `json:"mode"`
+	Applied bool        `json:"applied"`
+	Created int         `json:"created"`
+	Rows    []importRow `json:"results"`
+}
+
+// A single line of an export.
+type exportedUser struct {
+	Username     string `json:"username"`
+	PasswordHash string `json:"password_hash"`
+}
+
+var errUnsupportedFormat = errors.New("Unsupported Format")
+
+// Creates many users at once. The body is either JSON Lines, one
+// {"username": ..., "password": ...} object per line, or CSV with a
+// header row naming the username and password columns, chosen by the
+// Content-Type header.
+//
+// The mode query parameter is either "best-effort" (the default), where
+// every valid row is created and the rest are reported, or "atomic",
+// where nothing is created unless every row can be. An atomic import
+// that fails responds with 422 Unprocessable Entity.
+func importUsers(response http.ResponseWriter, request *http.Request) {
+	mode := request.URL.Query().Get("mode")
+	if mode == "" {
+		mode = "best-effort"
+	}
+	if mode != "best-effort" && mode != "atomic" {
+		http.Error(response, "", http.StatusBadRequest)
+		return
+	}
+
+	rows, users, err := readImport(request)
+	if err == errUnsupportedFormat {
+		http.Error(response, "", http.StatusUnsupportedMediaType)
+		return
+	} else if errors.Is(err, errBodyTooLarge) {
+		http.Error(response, "", http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		http.Error(response, "", http.StatusBadRequest)
+		return
+	}
+
+	// Only the rows that parsed are handed to the store, so keep track
+	// of which row each of them came from.
+	var valid []Credentials
+	var validRows []int
+	for i, row := range rows {
+		if row.Status == "" {
+			valid = append(valid, users[i])
+			validRows = append(validRows, i)
+		}
+	}
+	atomic := mode == "atomic"
+	errs, err := ImportUsers(request.Context(), valid, atomic)
+	if err != nil {
+		logging.FromContext(request.Context()).Error("importing users", "users", len(valid), "error", err)
+		http.Error(response, "", http.StatusInternalServerError)
+		return
+	}
+
+	failed := len(valid) != len(rows)
+	for i, userErr := range errs {
+		if userErr != nil {
+			rows[validRows[i]].Status = rowConflict
+			rows[validRows[i]].Error = userErr.Error()
+			failed = true
+		}
+	}
+
+	result := importResult{Mode: mode, Applied: !(atomic && failed), Rows: rows}
+	for i := range rows {
+		if rows[i].Status == "" && result.Applied {
+			rows[i].Status = rowCreated
+			result.Created++
+		} else if rows[i].Status == "" {
+			rows[i].Status = rowSkipped
+		}
+	}
+
+	response.Header().Set("Content-Type", "application/json")
+	if !result.Applied {
+		response.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	json.NewEncoder(response).Encode(result)
+}
+
+// Parses the body of an import. Every row gets an entry in rows and
+// users; rows that could not be used already have their Status set.
+func readImport(request *http.Request) ([]importRow, []Credentials, error) {
+	mediaType := "application/x-ndjson"
+	if header := request.Header.Get("Content-Type"); header != "" {
+		var err error
+		mediaType, _, err = mime.ParseMediaType(header)
+		if err != nil {
+			return nil, nil, errUnsupportedFormat
+		}
+	}
+
+	switch mediaType {
+	case "application/x-ndjson", "application/jsonl", "application/json":
+		return readJSONLines(request.Body)
+	case "text/csv":
+		return readCSV(request.Body)
+	}
+	return nil, nil, errUnsupportedFormat
+}
+
+// Parses one JSON object per line, ignoring blank lines.
+func readJSONLines(body io.Reader) ([]importRow, []Credentials, error) {
+	var rows []importRow
+	var users []Credentials
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 4096), 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		var creds Credentials
+		if err := json.Unmarshal([]byte(text), &creds); err != nil {
+			rows = append(rows, importRow{Row: line, Status: rowInvalid, Error: "Bad JSON"})
+		} else {
+			rows = append(rows, checkRow(line, creds))
+		}
+		users = append(users, creds)
+	}
+	return rows, users, scanner.Err()
+}
+
+// Parses CSV whose first record names the username and password columns.
+func readCSV(body io.Reader) ([]importRow, []Credentials, error) {
+	reader := csv.NewReader(body)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, nil, err
+	}
+	usernameCol, passwordCol := -1, -1
+	for i, name := range header {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "username":
+			usernameCol = i
+		case "password":
+			passwordCol = i
+		}
+	}
+	if usernameCol < 0 || passwordCol < 0 {
+		return nil, nil, errors.New("Bad CSV Header")
+	}
+
+	var rows []importRow
+	var users []Credentials
+	for row := 1; ; row++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if _, ok := err.(*csv.ParseError); ok {
+			rows = append(rows, importRow{Row: row, Status: rowInvalid, Error: "Bad CSV"})
+			users = append(users, Credentials{})
+			continue
+		} else if err != nil {
+			return nil, nil, err
+		}
+
+		var creds Credentials
+		if usernameCol < len(record) {
+			creds.Username = record[usernameCol]
+		}
+		if passwordCol < len(record) {
+			creds.Password = record[passwordCol]
+		}
+		rows = append(rows, checkRow(row, creds))
+		users = append(users, creds)
+	}
+	return rows, users, nil
+}
+
+// Applies the same checks as readJSON to a single row.
+func checkRow(row int, creds Credentials) importRow {
+	result := importRow{Row: row, Username: creds.Username}
+	if creds.Password == "" {
+		result.Status, result.Error = rowInvalid, "No Password"
+	} else if creds.Username == "" {
+		result.Status, result.Error = rowInvalid, "No Username"
+	}
+	return result
+}
+
+// Streams every user with a salted hash of their password in place of
+// the password itself. The output is JSON Lines of
+// {"username": ..., "password_hash": ...} objects, or CSV with a header
+// row if the client only accepts text/csv.
+func exportUsers(response http.ResponseWriter, request *http.Request) {
+	users := Users(request.Context())
+	asCSV := strings.Contains(request.Header.Get("Accept"), "text/csv")
+
+	var writeRow func(exportedUser) error
+	if asCSV {
+		response.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		writer := csv.NewWriter(response)
+		writer.Write([]string{"username", "password_hash"})
+		writeRow = func(user exportedUser) error {
+			writer.Write([]string{user.Username, user.PasswordHash})
+			writer.Flush()
+			return writer.Error()
+		}
+	} else {
+		response.Header().Set("Content-Type", "application/x-ndjson")
+		encoder := json.NewEncoder(response)
+		writeRow = func(user exportedUser) error {
+			return encoder.Encode(user)
+		}
+	}
+	response.Header().Set("X-Total-Count", strconv.Itoa(len(users)))
+
+	// Hashing is slow on purpose, so rows are hashed a batch at a time
+	// and each batch gets WriteTimeout to be written.
+	flusher, _ := response.(http.Flusher)
+	for start := 0; start < len(users); start += exportBatchSize {
+		batch := users[start:]
+		if len(batch) > exportBatchSize {
+			batch = batch[:exportBatchSize]
+		}
+		hashes, err := hashPasswords(batch)
+		if err != nil {
+			return
+		}
+		extendWriteDeadline(response, 0)
+		for i, creds := range batch {
+			if writeRow(exportedUser{creds.Username, hashes[i]}) != nil {
+				return
+			}
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+// How many users exportUsers hashes before writing them out.
+const exportBatchSize = 100
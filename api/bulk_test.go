@@ -0,0 +1,202 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Reports whether password matches a hash made by HashPassword.
+func matchesHash(t *testing.T, hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != hashScheme {
+		t.Fatalf("Malformed hash %q", hash)
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations != hashIterations {
+		t.Fatalf("Expected %d iterations in %q", hashIterations, hash)
+	}
+	salt, err1 := base64.RawStdEncoding.DecodeString(parts[2])
+	key, err2 := base64.RawStdEncoding.DecodeString(parts[3])
+	if err1 != nil || err2 != nil || len(salt) != hashSaltLen || len(key) != hashKeyLen {
+		t.Fatalf("Malformed hash %q", hash)
+	}
+	return bytes.Equal(pbkdf2.Key([]byte(password), salt, iterations, len(key), sha256.New), key)
+}
+
+// Tests that password hashes can be checked and never contain the password.
+func TestHashPassword(t *testing.T) {
+	if hashIterations != 600000 {
+		t.Fatalf("Expected 600000 iterations by default. Got %d", hashIterations)
+	}
+	fastHashes(t)
+	hash, err := HashPassword("HoshJug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(hash, "HoshJug") || !strings.HasPrefix(hash, hashScheme+"$") {
+		t.Fatalf("Unexpected hash %q", hash)
+	}
+	if !matchesHash(t, hash, "HoshJug") {
+		t.Fatal("Correct password did not match its hash.")
+	}
+	if matchesHash(t, hash, "hoshjug") {
+		t.Fatal("Wrong password matched the hash.")
+	}
+
+	// Two hashes of the same password should use different salts.
+	other, _ := HashPassword("HoshJug")
+	if other == hash {
+		t.Fatal("Hashes of the same password are identical.")
+	}
+}
+
+// Tests the correctness of the importUsers function.
+func TestImportUsers(t *testing.T) {
+	jsonLines := `{"username":"student1","password":"dab"}
+{"username":"existing","password":"dab"}
+
+{"username":"student2"}
+not json
+{"username":"student3","password":"dab"}
+{"username":"student1","password":"again"}`
+
+	csvBody := "password,username\ndab,student1\ndab,existing\n,student2\n\"unterminated,x\n"
+
+	tests := []struct {
+		Name          string
+		Query         string
+		ContentType   string
+		Body          string
+		ExpectedCode  int
+		ExpectedRows  []string
+		ExpectedUsers []string
+	}{
+		{"JSON Lines Best Effort", "", "application/x-ndjson", jsonLines, http.StatusOK,
+			[]string{rowCreated, rowConflict, rowInvalid, rowInvalid, rowCreated, rowConflict},
+			[]string{"existing", "student1", "student3"}},
+		{"JSON Lines Atomic", "?mode=atomic", "application/x-ndjson", jsonLines, http.StatusUnprocessableEntity,
+			[]string{rowSkipped, rowConflict, rowInvalid, rowInvalid, rowSkipped, rowConflict},
+			[]string{"existing"}},
+		{"Atomic Success", "?mode=atomic", "application/jsonl", `{"username":"a","password":"b"}`, http.StatusOK,
+			[]string{rowCreated},
+			[]string{"existing", "a"}},
+		{"CSV", "", "text/csv; charset=utf-8", csvBody, http.StatusOK,
+			[]string{rowCreated, rowConflict, rowInvalid, rowInvalid},
+			[]string{"existing", "student1"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			clearGlobalSlice()
+			UserSlice = append(UserSlice, Credentials{"existing", "dab"})
+
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/users:import"+test.Query, strings.NewReader(test.Body))
+			req.Header.Set("Content-Type", test.ContentType)
+			rr := httptest.NewRecorder()
+			importUsers(rr, req)
+
+			if rr.Result().StatusCode != test.ExpectedCode {
+				t.Fatalf("Incorrect status code returned! Expected: %d Actual: %d", test.ExpectedCode, rr.Result().StatusCode)
+			}
+			var result importResult
+			if err := json.NewDecoder(rr.Body).Decode(&result); err != nil {
+				t.Fatal(err)
+			}
+			statuses := []string{}
+			for _, row := range result.Rows {
+				statuses = append(statuses, row.Status)
+			}
+			if !reflect.DeepEqual(statuses, test.ExpectedRows) {
+				t.Fatalf("Incorrect row statuses! Expected: %v Actual: %v", test.ExpectedRows, statuses)
+			}
+			if !reflect.DeepEqual(Usernames(context.Background()), test.ExpectedUsers) {
+				t.Fatalf("Incorrect users after import! Expected: %v Actual: %v", test.ExpectedUsers, Usernames(context.Background()))
+			}
+		})
+	}
+
+	// Bodies that can't be imported at all.
+	t.Run("Bad Requests", func(t *testing.T) {
+		bad := []struct {
+			Query        string
+			ContentType  string
+			Body         string
+			ExpectedCode int
+		}{
+			{"?mode=sometimes", "application/x-ndjson", "", http.StatusBadRequest},
+			{"", "application/xml", "<users/>", http.StatusUnsupportedMediaType},
+			{"", "text/csv", "user,pass\na,b\n", http.StatusBadRequest},
+		}
+		for _, test := range bad {
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/users:import"+test.Query, strings.NewReader(test.Body))
+			req.Header.Set("Content-Type", test.ContentType)
+			rr := httptest.NewRecorder()
+			importUsers(rr, req)
+			if rr.Result().StatusCode != test.ExpectedCode {
+				t.Errorf("Incorrect status code returned for %q! Expected: %d Actual: %d", test.Body, test.ExpectedCode, rr.Result().StatusCode)
+			}
+		}
+	})
+}
+
+// Lowers the PBKDF2 iteration count so tests exporting users stay fast.
+func fastHashes(t *testing.T) {
+	old := hashIterations
+	hashIterations = 1000
+	t.Cleanup(func() { hashIterations = old })
+}
+
+// Tests the correctness of the exportUsers function.
+func TestExportUsers(t *testing.T) {
+	fastHashes(t)
+	clearGlobalSlice()
+	UserSlice = append(UserSlice, Credentials{"student1", "dab"}, Credentials{"student2", "dabdab"})
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/users:export", nil)
+	rr := httptest.NewRecorder()
+	exportUsers(rr, req)
+
+	if rr.Result().StatusCode != http.StatusOK {
+		t.Fatalf("Incorrect status code returned! Expected: %d Actual: %d", http.StatusOK, rr.Result().StatusCode)
+	}
+	if strings.Contains(rr.Body.String(), "dab\"") {
+		t.Fatal("Export contains a plaintext password!")
+	}
+
+	// Every line should hold a hash of the right password.
+	scanner := bufio.NewScanner(rr.Body)
+	for i := 0; scanner.Scan(); i++ {
+		var user exportedUser
+		if err := json.Unmarshal(scanner.Bytes(), &user); err != nil {
+			t.Fatal(err)
+		}
+		if user.Username != UserSlice[i].Username {
+			t.Fatalf("Incorrect username on line %d! Expected: %s Actual: %s", i+1, UserSlice[i].Username, user.Username)
+		}
+		if !matchesHash(t, user.PasswordHash, UserSlice[i].Password) {
+			t.Fatalf("Hash on line %d does not match the password.", i+1)
+		}
+	}
+
+	// CSV is available for clients that ask for it.
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/users:export", nil)
+	req.Header.Set("Accept", "text/csv")
+	rr = httptest.NewRecorder()
+	exportUsers(rr, req)
+	lines := strings.Split(strings.TrimSpace(rr.Body.String()), "\n")
+	if len(lines) != 3 || lines[0] != "username,password_hash" || !strings.HasPrefix(lines[1], "student1,"+hashScheme) {
+		t.Fatalf("Incorrect CSV export: %q", rr.Body.String())
+	}
+}
@@ -0,0 +1,228 @@
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Compression turns on compressing responses for clients that accept
+// gzip or deflate. Responses smaller than CompressMinBytes are sent as
+// they are, as compressing them saves little.
+var (
+	Compression      = true
+	CompressMinBytes = 1024
+)
+
+// The content codings responses can be compressed with, in order of
+// preference. Over HTTP, deflate means the zlib format of RFC 1950.
+var encodings = []string{"gzip", "deflate"}
+
+// Compresses responses with the encoding the request's Accept-Encoding
+// header prefers, once the handler has written CompressMinBytes of
+// body. Streaming handlers that flush earlier are compressed from then
+// on, except for event streams, which are never compressed.
+func compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if !Compression || request.Method == http.MethodHead {
+			next.ServeHTTP(response, request)
+			return
+		}
+		response.Header().Add("Vary", "Accept-Encoding")
+		encoding := negotiateEncoding(request.Header.Get("Accept-Encoding"))
+		if encoding == "" {
+			next.ServeHTTP(response, request)
+			return
+		}
+
+		writer := &compressWriter{ResponseWriter: response, encoding: encoding}
+		next.ServeHTTP(writer, request)
+		writer.Close()
+	})
+}
+
+// Picks the encoding from encodings with the highest quality in
+// header, or "" if the response shouldn't be compressed.
+func negotiateEncoding(header string) string {
+	qualities := map[string]float64{}
+	for _, part := range strings.Split(header, ",") {
+		coding, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		quality := 1.0
+		if q, ok := params["q"]; ok {
+			if quality, err = strconv.ParseFloat(q, 64); err != nil {
+				continue
+			}
+		}
+		qualities[coding] = quality
+	}
+
+	best, bestQuality := "", 0.0
+	for _, encoding := range encodings {
+		quality, ok := qualities[encoding]
+		if !ok {
+			quality, ok = qualities["*"]
+		}
+		if ok && quality > bestQuality {
+			best, bestQuality = encoding, quality
+		}
+	}
+	return best
+}
+
+// Wraps a ResponseWriter to hold back the body until it is known to
+// be worth compressing.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	status   int
+	buffered bytes.Buffer
+	// Set once the headers have been sent. compressor is nil if the
+	// body is being sent as it is.
+	started    bool
+	compressor io.WriteCloser
+}
+
+func (w *compressWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+}
+
+func (w *compressWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.started {
+		if w.compressor != nil {
+			return w.compressor.Write(p)
+		}
+		return w.ResponseWriter.Write(p)
+	}
+	w.buffered.Write(p)
+	if w.buffered.Len() >= CompressMinBytes {
+		if err := w.start(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush lets streaming handlers such as exportUsers keep working.
+func (w *compressWriter) Flush() {
+	if !w.started {
+		if w.status == 0 {
+			w.status = http.StatusOK
+		}
+		w.start(true)
+	}
+	if flusher, ok := w.compressor.(interface{ Flush() error }); ok {
+		flusher.Flush()
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the connection.
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Sends the headers and whatever was buffered, compressing the rest of
+// the body if compressed is set and the response can be compressed.
+func (w *compressWriter) start(compressed bool) error {
+	w.started = true
+	header := w.Header()
+	if header.Get("Content-Encoding") != "" || w.status < http.StatusOK ||
+		w.status == http.StatusNoContent || w.status == http.StatusNotModified ||
+		strings.HasPrefix(header.Get("Content-Type"), "text/event-stream") {
+		compressed = false
+	}
+	if compressed {
+		header.Set("Content-Encoding", w.encoding)
+		if tag := header.Get("ETag"); tag != "" {
+			header.Set("ETag", encodedETag(tag, w.encoding))
+		}
+		header.Del("Content-Length")
+		if w.encoding == "gzip" {
+			w.compressor = gzip.NewWriter(w.ResponseWriter)
+		} else {
+			w.compressor = zlib.NewWriter(w.ResponseWriter)
+		}
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+
+	if w.buffered.Len() == 0 {
+		return nil
+	}
+	var err error
+	if w.compressor != nil {
+		_, err = w.compressor.Write(w.buffered.Bytes())
+	} else {
+		_, err = w.ResponseWriter.Write(w.buffered.Bytes())
+	}
+	w.buffered.Reset()
+	return err
+}
+
+// Sends anything still buffered, uncompressed as it is too small to be
+// worth compressing, and finishes the compressed stream.
+func (w *compressWriter) Close() error {
+	if !w.started {
+		if w.status == 0 {
+			// The handler wrote nothing, so leave the response to net/http.
+			return nil
+		}
+		w.start(false)
+	}
+	if w.compressor != nil {
+		return w.compressor.Close()
+	}
+	return nil
+}
+
+// Decompresses request bodies sent with Content-Encoding gzip or
+// deflate, such as large imports. The decompressed body is held to the
+// route's body limit as well. Other encodings get 415 Unsupported Media
+// Type.
+func decompressBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		encoding := strings.ToLower(strings.TrimSpace(request.Header.Get("Content-Encoding")))
+		if encoding == "" || encoding == "identity" || request.Body == nil {
+			next.ServeHTTP(response, request)
+			return
+		}
+
+		var body io.ReadCloser
+		var err error
+		switch encoding {
+		case "gzip", "x-gzip":
+			body, err = gzip.NewReader(request.Body)
+		case "deflate":
+			body, err = zlib.NewReader(request.Body)
+		default:
+			response.Header().Set("Accept-Encoding", strings.Join(encodings, ", "))
+			http.Error(response, "", http.StatusUnsupportedMediaType)
+			return
+		}
+		if err != nil {
+			rejectBody(response, err)
+			return
+		}
+		if limit := bodyLimit(request); limit > 0 {
+			body = &limitedBody{http.MaxBytesReader(response, body, limit), limit, 0}
+		}
+		request.Body = body
+		request.Header.Del("Content-Encoding")
+		request.ContentLength = -1
+		next.ServeHTTP(response, request)
+	})
+}
@@ -0,0 +1,159 @@
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// Tests picking an encoding from an Accept-Encoding header.
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		AcceptEncoding string
+		Expected       string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", "gzip"},
+		{"deflate", "deflate"},
+		{"gzip, deflate, br", "gzip"},
+		{"gzip;q=0.5, deflate", "deflate"},
+		{"*", "gzip"},
+		{"*, gzip;q=0", "deflate"},
+		{"br", ""},
+	}
+	for _, test := range tests {
+		if actual := negotiateEncoding(test.AcceptEncoding); actual != test.Expected {
+			t.Errorf("Expected %q for %q. Got %q", test.Expected, test.AcceptEncoding, actual)
+		}
+	}
+}
+
+// Tests that large responses are compressed and small ones aren't.
+func TestCompression(t *testing.T) {
+	fastHashes(t)
+	clearGlobalSlice()
+	for i := 0; i < 100; i++ {
+		UserSlice = append(UserSlice, Credentials{fmt.Sprintf("user%d", i), "password"})
+	}
+	routes := mux.NewRouter()
+	RegisterRoutes(routes)
+	router := asAdmin(t, routes)
+
+	tests := []struct {
+		Name             string
+		Endpoint         string
+		AcceptEncoding   string
+		ExpectedEncoding string
+	}{
+		{"Gzip", "/api/v1/users", "gzip", "gzip"},
+		{"Deflate", "/api/v1/users", "deflate", "deflate"},
+		{"Not Accepted", "/api/v1/users", "", ""},
+		{"Too Small", "/api/getQuery?userID=40", "gzip", ""},
+		{"Streamed", "/api/v1/users:export", "gzip", "gzip"},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			plain := httptest.NewRecorder()
+			router.ServeHTTP(plain, httptest.NewRequest(http.MethodGet, test.Endpoint, nil))
+
+			req := httptest.NewRequest(http.MethodGet, test.Endpoint, nil)
+			if test.AcceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", test.AcceptEncoding)
+			}
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if encoding := rr.Header().Get("Content-Encoding"); encoding != test.ExpectedEncoding {
+				t.Fatalf("Expected Content-Encoding %q. Got %q", test.ExpectedEncoding, encoding)
+			}
+			if !contains(rr.Header().Values("Vary"), "Accept-Encoding") {
+				t.Errorf("Expected Vary to include Accept-Encoding. Got %v", rr.Header().Values("Vary"))
+			}
+			if rr.Header().Get("Content-Type") != plain.Header().Get("Content-Type") {
+				t.Errorf("Expected Content-Type %q. Got %q", plain.Header().Get("Content-Type"), rr.Header().Get("Content-Type"))
+			}
+
+			var body io.Reader = rr.Body
+			var err error
+			switch test.ExpectedEncoding {
+			case "gzip":
+				body, err = gzip.NewReader(rr.Body)
+			case "deflate":
+				body, err = zlib.NewReader(rr.Body)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded, err := ioutil.ReadAll(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Exported hashes are salted differently every time.
+			if test.Endpoint != "/api/v1/users:export" && !bytes.Equal(decoded, plain.Body.Bytes()) {
+				t.Errorf("Expected the decompressed body to be %q. Got %q", plain.Body.String(), decoded)
+			}
+			if test.Endpoint == "/api/v1/users:export" && bytes.Count(decoded, []byte("\n")) != len(UserSlice) {
+				t.Errorf("Expected %d exported users. Got %q", len(UserSlice), decoded)
+			}
+		})
+	}
+}
+
+// Tests importing users from gzip compressed bodies.
+func TestDecompressRequests(t *testing.T) {
+	routes := mux.NewRouter()
+	RegisterRoutes(routes)
+	router := asAdmin(t, routes)
+
+	var rows strings.Builder
+	for i := 0; i < 50; i++ {
+		fmt.Fprintf(&rows, "{\"username\": \"user%d\", \"password\": \"password\"}\n", i)
+	}
+	var gzipped bytes.Buffer
+	writer := gzip.NewWriter(&gzipped)
+	writer.Write([]byte(rows.String()))
+	writer.Close()
+
+	tests := []struct {
+		Name         string
+		Encoding     string
+		Body         []byte
+		Limit        int64
+		ExpectedCode int
+	}{
+		{"Gzip", "gzip", gzipped.Bytes(), 0, http.StatusOK},
+		{"Corrupt", "gzip", []byte("not gzip"), 0, http.StatusBadRequest},
+		{"Unknown Encoding", "br", gzipped.Bytes(), 0, http.StatusUnsupportedMediaType},
+		{"Decompressed Too Large", "gzip", gzipped.Bytes(), int64(gzipped.Len()) + 100, http.StatusRequestEntityTooLarge},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			clearGlobalSlice()
+			if test.Limit > 0 {
+				BodyLimits["/api/v1/users:import"] = test.Limit
+				defer delete(BodyLimits, "/api/v1/users:import")
+			}
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/users:import", bytes.NewReader(test.Body))
+			req.Header.Set("Content-Type", "application/x-ndjson")
+			req.Header.Set("Content-Encoding", test.Encoding)
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			if rr.Code != test.ExpectedCode {
+				t.Fatalf("Expected status code %d. Got %d", test.ExpectedCode, rr.Code)
+			}
+			if test.ExpectedCode == http.StatusOK && len(UserSlice) != 50 {
+				t.Errorf("Expected 50 imported users. Got %d", len(UserSlice))
+			}
+		})
+	}
+}
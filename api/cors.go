@@ -0,0 +1,238 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// A CORSPolicy lets browsers on other origins call a route.
+type CORSPolicy struct {
+	// Route is a mux route template such as /api/getCookie. A policy
+	// with an empty Route applies to every route without its own.
+	Route string
+
+	// Origins are allowed origins such as https://bearchat.dev. A "*"
+	// at the start of the host allows any subdomain, as in
+	// https://*.bearchat.dev, and "*" on its own allows every origin.
+	Origins []string
+
+	// Whether browsers may send cookies, such as access_token, and read
+	// the response.
+	AllowCredentials bool
+
+	// The request headers browsers may send, besides the ones they can
+	// always send. Nil means corsDefaultHeaders.
+	AllowedHeaders []string
+
+	// The response headers browsers may read, besides the ones they
+	// always can.
+	ExposedHeaders []string
+
+	// How long browsers may cache a preflight response.
+	MaxAge time.Duration
+}
+
+// CORSPolicies lists the policies routes are served with. Routes
+// without a policy only accept requests from their own origin.
+var CORSPolicies []CORSPolicy
+
+// The request headers allowed by policies that don't list their own.
+var corsDefaultHeaders = []string{"Content-Type", "Authorization", requestIDHeader, "Traceparent", csrfHeader, "If-Match", "If-None-Match", idempotencyKeyHeader}
+
+// Returns the policy for a route template, or nil if it has none.
+func corsPolicy(route string) *CORSPolicy {
+	var fallback *CORSPolicy
+	for i := range CORSPolicies {
+		switch CORSPolicies[i].Route {
+		case route:
+			return &CORSPolicies[i]
+		case "":
+			if fallback == nil {
+				fallback = &CORSPolicies[i]
+			}
+		}
+	}
+	return fallback
+}
+
+// Reports whether the policy allows requests from origin.
+func (p *CORSPolicy) allows(origin string) bool {
+	for _, allowed := range p.Origins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+		star := strings.Index(allowed, "*")
+		if star < 0 {
+			continue
+		}
+		prefix, suffix := allowed[:star], allowed[star+1:]
+		if len(origin) <= len(prefix)+len(suffix) ||
+			!strings.HasPrefix(strings.ToLower(origin), strings.ToLower(prefix)) ||
+			!strings.HasSuffix(strings.ToLower(origin), strings.ToLower(suffix)) {
+			continue
+		}
+		// The wildcard only stands for host labels.
+		if !strings.ContainsAny(origin[len(prefix):len(origin)-len(suffix)], "/:@?#") {
+			return true
+		}
+	}
+	return false
+}
+
+// The value of Access-Control-Allow-Origin for an allowed origin.
+// Responses that carry credentials must name the origin.
+func (p *CORSPolicy) allowOrigin(origin string) string {
+	if !p.AllowCredentials {
+		for _, allowed := range p.Origins {
+			if allowed == "*" {
+				return "*"
+			}
+		}
+	}
+	return origin
+}
+
+// Reports whether the policy lets browsers send header.
+func (p *CORSPolicy) allowsHeader(header string) bool {
+	allowed := p.AllowedHeaders
+	if allowed == nil {
+		allowed = corsDefaultHeaders
+	}
+	for _, name := range append([]string{"Accept", "Accept-Language", "Content-Language"}, allowed...) {
+		if strings.EqualFold(name, header) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether request is a CORS preflight.
+func isPreflight(request *http.Request) bool {
+	return request.Method == http.MethodOptions &&
+		request.Header.Get("Origin") != "" &&
+		request.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// Adds CORS headers to responses to allowed cross-origin requests.
+// Preflights are answered by preflight instead.
+func cors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		origin := request.Header.Get("Origin")
+		policy := corsPolicy(routeTemplate(request))
+		if origin == "" || policy == nil || request.Method == http.MethodOptions {
+			next.ServeHTTP(response, request)
+			return
+		}
+
+		header := response.Header()
+		header.Add("Vary", "Origin")
+		if policy.allows(origin) {
+			header.Set("Access-Control-Allow-Origin", policy.allowOrigin(origin))
+			if policy.AllowCredentials {
+				header.Set("Access-Control-Allow-Credentials", "true")
+			}
+			if len(policy.ExposedHeaders) > 0 {
+				header.Set("Access-Control-Expose-Headers", strings.Join(policy.ExposedHeaders, ", "))
+			}
+		}
+		next.ServeHTTP(response, request)
+	})
+}
+
+// Registers an OPTIONS route for every path in router, allowing the
+// methods the path was registered with. Must be called after every
+// other route has been registered.
+func registerPreflights(router *mux.Router) {
+	var paths []string
+	methods := map[string][]string{}
+	router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		routeMethods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		if _, ok := methods[path]; !ok {
+			paths = append(paths, path)
+		}
+		methods[path] = append(methods[path], routeMethods...)
+		return nil
+	})
+	for _, path := range paths {
+		router.HandleFunc(path, preflight(methods[path])).Methods(http.MethodOptions)
+	}
+}
+
+// Answers OPTIONS requests to a route registered with methods.
+//
+// Preflights from origins the route's policy allows, asking for one of
+// methods and only allowed headers, get 204 No Content with the CORS
+// headers browsers need. Other preflights get 403 Forbidden. OPTIONS
+// requests that aren't preflights get 204 No Content with an Allow
+// header.
+func preflight(methods []string) http.HandlerFunc {
+	allow := strings.Join(append(methods[:len(methods):len(methods)], http.MethodOptions), ", ")
+	return func(response http.ResponseWriter, request *http.Request) {
+		header := response.Header()
+		if !isPreflight(request) {
+			header.Set("Allow", allow)
+			response.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		header.Add("Vary", "Origin")
+		header.Add("Vary", "Access-Control-Request-Method")
+		header.Add("Vary", "Access-Control-Request-Headers")
+		origin := request.Header.Get("Origin")
+		policy := corsPolicy(routeTemplate(request))
+		if policy == nil || !policy.allows(origin) {
+			http.Error(response, "", http.StatusForbidden)
+			return
+		}
+		if !contains(methods, request.Header.Get("Access-Control-Request-Method")) {
+			http.Error(response, "", http.StatusForbidden)
+			return
+		}
+		var requested []string
+		for _, line := range request.Header.Values("Access-Control-Request-Headers") {
+			for _, name := range strings.Split(line, ",") {
+				if name = strings.TrimSpace(name); name == "" {
+					continue
+				}
+				if !policy.allowsHeader(name) {
+					http.Error(response, "", http.StatusForbidden)
+					return
+				}
+				requested = append(requested, name)
+			}
+		}
+
+		header.Set("Access-Control-Allow-Origin", policy.allowOrigin(origin))
+		header.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+		if len(requested) > 0 {
+			header.Set("Access-Control-Allow-Headers", strings.Join(requested, ", "))
+		}
+		if policy.AllowCredentials {
+			header.Set("Access-Control-Allow-Credentials", "true")
+		}
+		if policy.MaxAge > 0 {
+			header.Set("Access-Control-Max-Age", strconv.Itoa(int(policy.MaxAge.Seconds())))
+		}
+		response.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -1,7 +1,24 @@
 package api
 
+import "strconv"
+
 // Credentials respresents the user login object
 type Credentials struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
 }
+
+// Redacted keeps passwords out of logs. See logging.Redacter.
+func (creds Credentials) Redacted() interface{} {
+	return userSummary{creds.Username}
+}
+
+// String hides the password when credentials are printed with fmt.
+func (creds Credentials) String() string {
+	return "{" + creds.Username + " [REDACTED]}"
+}
+
+// GoString hides the password when credentials are printed with %#v.
+func (creds Credentials) GoString() string {
+	return "api.Credentials{Username:" + strconv.Quote(creds.Username) + ", Password:\"[REDACTED]\"}"
+}
@@ -0,0 +1,130 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// CSRFProtection guards state changing requests made with the
+// access_token session cookie against cross-site request forgery.
+//
+// Browsers attach cookies to requests other sites make, so such
+// requests must come from this server's origin, or one its CORS policy
+// allows, and must echo the csrf_token cookie in the X-CSRF-Token
+// header, which other sites can't read. Requests with an Authorization
+// bearer token instead of the cookie aren't checked, as browsers never
+// add that header on their own.
+var CSRFProtection = true
+
+const (
+	sessionCookie = "access_token"
+	csrfCookie    = "csrf_token"
+	csrfHeader    = "X-CSRF-Token"
+)
+
+var csrfRejectedTotal = Metrics.NewCounter("http_csrf_rejected_total",
+	"Requests refused by CSRF protection, by route template and reason.",
+	"route", "reason")
+
+// Applies CSRFProtection, responding 403 Forbidden with the reason when
+// a cookie authenticated request fails a check.
+//
+// Safe requests from clients with a session but no CSRF token are
+// given one, both as the csrf_token cookie and in the X-CSRF-Token
+// response header for front ends on other origins.
+func csrf(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if !CSRFProtection || !cookieAuthenticated(request) {
+			next.ServeHTTP(response, request)
+			return
+		}
+
+		token, _ := request.Cookie(csrfCookie)
+		switch request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+			if token == nil || token.Value == "" {
+				issueCSRFToken(response, request)
+			}
+			next.ServeHTTP(response, request)
+			return
+		}
+
+		reason, message := "", ""
+		if origin, ok := requestOrigin(request); !ok {
+			reason, message = "origin", "CSRF check failed: Origin or Referer is malformed"
+		} else if origin != "" && !trustedOrigin(request, origin) {
+			reason, message = "origin", "CSRF check failed: origin "+origin+" is not allowed"
+		} else if token == nil || token.Value == "" {
+			reason, message = "missing_cookie", "CSRF check failed: no "+csrfCookie+" cookie"
+		} else if given := request.Header.Get(csrfHeader); given == "" {
+			reason, message = "missing_header", "CSRF check failed: no "+csrfHeader+" header"
+		} else if subtle.ConstantTimeCompare([]byte(given), []byte(token.Value)) != 1 {
+			reason, message = "mismatch", "CSRF check failed: "+csrfHeader+" does not match the "+csrfCookie+" cookie"
+		}
+		if reason != "" {
+			csrfRejectedTotal.Inc(routeTemplate(request), reason)
+			http.Error(response, message, http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(response, request)
+	})
+}
+
+// Reports whether request carries the access_token session cookie and
+// no bearer token.
+func cookieAuthenticated(request *http.Request) bool {
+	if strings.HasPrefix(strings.ToLower(request.Header.Get("Authorization")), "bearer ") {
+		return false
+	}
+	session, err := request.Cookie(sessionCookie)
+	return err == nil && session.Value != ""
+}
+
+// Returns the scheme and host the request was made from, taken from
+// the Origin header or else the Referer. It returns "" when neither
+// was sent and false when the one sent is malformed.
+func requestOrigin(request *http.Request) (string, bool) {
+	source := request.Header.Get("Origin")
+	if source == "" {
+		source = request.Header.Get("Referer")
+		if source == "" {
+			return "", true
+		}
+	}
+	u, err := url.Parse(source)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return "", false
+	}
+	return u.Scheme + "://" + u.Host, true
+}
+
+// Reports whether origin is this server's own, with the same scheme
+// and host, or one the route's CORS policy allows.
+func trustedOrigin(request *http.Request, origin string) bool {
+	scheme := "http"
+	if request.TLS != nil {
+		scheme = "https"
+	}
+	if strings.EqualFold(origin, scheme+"://"+request.Host) {
+		return true
+	}
+	policy := corsPolicy(routeTemplate(request))
+	return policy != nil && policy.allows(origin)
+}
+
+// Sets a new CSRF token cookie on the response. Front ends must be
+// able to read it, so it isn't HttpOnly. Over HTTPS it is sent on
+// cross-site requests too, for front ends allowed by CORS.
+func issueCSRFToken(response http.ResponseWriter, request *http.Request) {
+	token := hex.EncodeToString(randomBytes(32))
+	cookie := &http.Cookie{Name: csrfCookie, Value: token, Path: "/", SameSite: http.SameSiteLaxMode}
+	if request.TLS != nil {
+		cookie.Secure, cookie.SameSite = true, http.SameSiteNoneMode
+	}
+	http.SetCookie(response, cookie)
+	response.Header().Set(csrfHeader, token)
+	response.Header().Set("Cache-Control", "no-store")
+}
@@ -0,0 +1,147 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// Tests that state changing requests made with the session cookie need
+// a matching CSRF token from a trusted origin.
+func TestCSRF(t *testing.T) {
+	CORSPolicies = []CORSPolicy{{Origins: []string{"https://bearchat.dev"}}}
+	defer func() { CORSPolicies = nil }()
+
+	router := mux.NewRouter()
+	RegisterRoutes(router)
+
+	session := &http.Cookie{Name: sessionCookie, Value: "session"}
+	token := &http.Cookie{Name: csrfCookie, Value: "token"}
+	tests := []struct {
+		Name         string
+		Cookies      []*http.Cookie
+		Header       map[string]string
+		ExpectedCode int
+		ExpectedBody string
+	}{
+		{"No Session", nil, nil, http.StatusOK, ""},
+		{"Bearer Token", []*http.Cookie{session}, map[string]string{"Authorization": "Bearer abc"}, http.StatusOK, ""},
+		{"Matching Token", []*http.Cookie{session, token}, map[string]string{csrfHeader: "token"}, http.StatusOK, ""},
+		{"Same Origin", []*http.Cookie{session, token},
+			map[string]string{csrfHeader: "token", "Origin": "http://example.com"}, http.StatusOK, ""},
+		{"CORS Origin", []*http.Cookie{session, token},
+			map[string]string{csrfHeader: "token", "Origin": "https://bearchat.dev"}, http.StatusOK, ""},
+		{"Same Origin Referer", []*http.Cookie{session, token},
+			map[string]string{csrfHeader: "token", "Referer": "http://example.com/app/settings"}, http.StatusOK, ""},
+		{"Missing Cookie", []*http.Cookie{session}, map[string]string{csrfHeader: "token"},
+			http.StatusForbidden, "no csrf_token cookie"},
+		{"Missing Header", []*http.Cookie{session, token}, nil,
+			http.StatusForbidden, "no X-CSRF-Token header"},
+		{"Mismatched Token", []*http.Cookie{session, token}, map[string]string{csrfHeader: "guess"},
+			http.StatusForbidden, "does not match"},
+		{"Other Origin", []*http.Cookie{session, token},
+			map[string]string{csrfHeader: "token", "Origin": "https://stanfurd.edu"}, http.StatusForbidden, "origin https://stanfurd.edu is not allowed"},
+		{"Other Scheme", []*http.Cookie{session, token},
+			map[string]string{csrfHeader: "token", "Origin": "https://example.com"}, http.StatusForbidden, "origin https://example.com is not allowed"},
+		{"Other Referer", []*http.Cookie{session, token},
+			map[string]string{csrfHeader: "token", "Referer": "https://stanfurd.edu/attack"}, http.StatusForbidden, "not allowed"},
+		{"Opaque Origin", []*http.Cookie{session, token},
+			map[string]string{csrfHeader: "token", "Origin": "null"}, http.StatusForbidden, "malformed"},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			clearGlobalSlice()
+			UserSlice = []Credentials{{"oski", "bear"}}
+			req := httptest.NewRequest(http.MethodPut, "/api/updatePW", strings.NewReader(`{"username": "oski", "password": "golden"}`))
+			for _, cookie := range test.Cookies {
+				req.AddCookie(cookie)
+			}
+			for name, value := range test.Header {
+				req.Header.Set(name, value)
+			}
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			if rr.Code != test.ExpectedCode || !strings.Contains(rr.Body.String(), test.ExpectedBody) {
+				t.Errorf("Expected status code %d and a body containing %q. Got %d and %q", test.ExpectedCode, test.ExpectedBody, rr.Code, rr.Body.String())
+			}
+			changed := UserSlice[0].Password == "golden"
+			if changed != (test.ExpectedCode == http.StatusOK) {
+				t.Errorf("Expected the password to be changed only when the request is allowed. Got slice %v", UserSlice)
+			}
+		})
+	}
+
+	// Over HTTPS only HTTPS pages are the server's own.
+	for origin, expected := range map[string]int{"https://example.com": http.StatusOK, "http://example.com": http.StatusForbidden} {
+		UserSlice = []Credentials{{"oski", "bear"}}
+		req := httptest.NewRequest(http.MethodPut, "https://example.com/api/updatePW", strings.NewReader(`{"username": "oski", "password": "golden"}`))
+		req.AddCookie(session)
+		req.AddCookie(token)
+		req.Header.Set(csrfHeader, "token")
+		req.Header.Set("Origin", origin)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != expected {
+			t.Errorf("Expected status code %d for origin %s over HTTPS. Got %d", expected, origin, rr.Code)
+		}
+	}
+
+	// Turning protection off lets every request through.
+	CSRFProtection = false
+	defer func() { CSRFProtection = true }()
+	req := httptest.NewRequest(http.MethodPut, "/api/updatePW", strings.NewReader(`{"username": "oski", "password": "tree"}`))
+	req.AddCookie(session)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected status code %d with CSRF protection off. Got %d", http.StatusOK, rr.Code)
+	}
+}
+
+// Tests that sessions without a CSRF token are given one on safe
+// requests, and that the token is then accepted.
+func TestCSRFTokenIssued(t *testing.T) {
+	router := mux.NewRouter()
+	RegisterRoutes(router)
+	session := &http.Cookie{Name: sessionCookie, Value: "session"}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/getCookie", nil)
+	req.AddCookie(session)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	var token *http.Cookie
+	for _, cookie := range rr.Result().Cookies() {
+		if cookie.Name == csrfCookie {
+			token = cookie
+		}
+	}
+	if token == nil || token.Value == "" || token.HttpOnly {
+		t.Fatalf("Expected a readable %s cookie. Got %v", csrfCookie, rr.Result().Cookies())
+	}
+	if header := rr.Header().Get(csrfHeader); header != token.Value {
+		t.Errorf("Expected the %s header to match the cookie. Got %q and %q", csrfHeader, header, token.Value)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/getCookie", nil)
+	req.AddCookie(session)
+	req.AddCookie(token)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if len(rr.Result().Cookies()) != 0 {
+		t.Errorf("Expected no new cookie once a token is set. Got %v", rr.Result().Cookies())
+	}
+
+	clearGlobalSlice()
+	req = httptest.NewRequest(http.MethodPost, "/api/signup", strings.NewReader(`{"username": "oski", "password": "bear"}`))
+	req.AddCookie(session)
+	req.AddCookie(token)
+	req.Header.Set(csrfHeader, token.Value)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusCreated {
+		t.Errorf("Expected status code %d with the issued token. Got %d", http.StatusCreated, rr.Code)
+	}
+}
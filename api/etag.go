@@ -0,0 +1,233 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The version of each user, persisted with the users. Every change to
+// a user gives it a new version, taken from lastVersion, so a version
+// is never handed out twice even after the user is deleted and signs
+// up again. Guarded by userLock.
+var (
+	versions    = map[string]uint64{}
+	lastVersion uint64
+)
+
+// Returned by the compare-and-swap store functions when the user has
+// changed since the version the caller expected.
+var errVersionMismatch = errors.New("Version Mismatch")
+
+var preconditionsFailedTotal = Metrics.NewCounter("http_precondition_failed_total",
+	"Changes refused because the user had changed since the caller's If-Match.")
+
+// Gives the user a new version. Callers must hold userLock.
+func bumpVersion(username string) {
+	lastVersion++
+	versions[username] = lastVersion
+}
+
+// Returns the version of the user. Every user is given one when added
+// or loaded, so this never hands out a version that isn't persisted.
+// Callers must hold userLock.
+func versionOf(username string) uint64 {
+	return versions[username]
+}
+
+// Gives a version to every user without one, such as those in store
+// files written before versions were kept, and reports whether any
+// were given. Callers must hold userLock.
+func assignVersions() bool {
+	assigned := false
+	for _, creds := range UserSlice {
+		if _, ok := versions[creds.Username]; !ok {
+			bumpVersion(creds.Username)
+			assigned = true
+		}
+	}
+	return assigned
+}
+
+// Returns a copy of versions. Callers must hold userLock.
+func copyVersions() map[string]uint64 {
+	copied := make(map[string]uint64, len(versions))
+	for username, v := range versions {
+		copied[username] = v
+	}
+	return copied
+}
+
+// Fails with errVersionMismatch unless the existing user is at
+// version. Callers must hold userLock.
+func checkVersion(username string, version uint64) error {
+	if _, err := findUser(username); err != nil {
+		countLookup(err)
+		return err
+	}
+	if versionOf(username) != version {
+		return errVersionMismatch
+	}
+	return nil
+}
+
+// CompareAndSetPassword replaces the password of an existing user if
+// the user is still at version, failing with errVersionMismatch
+// otherwise.
+func CompareAndSetPassword(ctx context.Context, username, password string, version uint64) error {
+	return update(ctx, "CompareAndSetPassword", func() error {
+		if err := checkVersion(username, version); err != nil {
+			return err
+		}
+		return setPassword(username, password)
+	})
+}
+
+// CompareAndRemoveUser deletes an existing user if the user is still at
+// version, failing with errVersionMismatch otherwise.
+func CompareAndRemoveUser(ctx context.Context, username string, version uint64) error {
+	return update(ctx, "CompareAndRemoveUser", func() error {
+		if err := checkVersion(username, version); err != nil {
+			return err
+		}
+		return removeUser(username)
+	})
+}
+
+// The suffixes of entity tags for each response format and content
+// coding, as every form of a user at a version needs its own strong
+// tag. Plain text, uncompressed, has none, so its tag is "<version>".
+var etagSuffixes = map[string]string{
+	formatJSON:    "json",
+	formatMsgpack: "msgpack",
+	formatForm:    "form",
+	"gzip":        "gzip",
+	"deflate":     "deflate",
+}
+
+// Formats version as a strong entity tag for a response in format.
+// compress adds the content coding when it compresses the response.
+func etag(version uint64, format string) string {
+	tag := strconv.FormatUint(version, 10)
+	if suffix := etagSuffixes[format]; suffix != "" {
+		tag += "-" + suffix
+	}
+	return `"` + tag + `"`
+}
+
+// Adds the suffix of encoding to a strong entity tag made by etag.
+// Other tags are returned as they are.
+func encodedETag(tag, encoding string) string {
+	if suffix := etagSuffixes[encoding]; suffix != "" && len(tag) >= 2 && tag[0] == '"' {
+		return tag[:len(tag)-1] + "-" + suffix + `"`
+	}
+	return tag
+}
+
+// Returns the versions named by an If-Match or If-None-Match header.
+// any is set for "*". Tags name the version they were made for,
+// whatever the format and coding of the response they came with. Weak
+// tags are only read when weak is set, for the weak comparison of
+// If-None-Match. Tags this server didn't make are skipped, so they
+// never match.
+func parseETags(header string, weak bool) (tags []uint64, any bool) {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			any = true
+			continue
+		}
+		if weak {
+			tag = strings.TrimPrefix(tag, "W/")
+		}
+		if len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+			continue
+		}
+		parts := strings.Split(tag[1:len(tag)-1], "-")
+		if !knownSuffixes(parts[1:]) {
+			continue
+		}
+		if version, err := strconv.ParseUint(parts[0], 10, 64); err == nil {
+			tags = append(tags, version)
+		}
+	}
+	return tags, any
+}
+
+// Reports whether every one of suffixes is in etagSuffixes.
+func knownSuffixes(suffixes []string) bool {
+	for _, suffix := range suffixes {
+		known := false
+		for _, s := range etagSuffixes {
+			known = known || s == suffix
+		}
+		if !known {
+			return false
+		}
+	}
+	return true
+}
+
+// Sets the ETag of a GET response for a user at version. It reports
+// whether the request's If-None-Match already names that version, in
+// which case 304 Not Modified has been written and the caller should
+// write nothing else.
+func writeETag(response http.ResponseWriter, request *http.Request, version uint64) bool {
+	// writeResponse answers 406 Not Acceptable when this fails.
+	format, _ := negotiate(request.Header.Get("Accept"))
+	response.Header().Set("ETag", etag(version, format))
+	header := request.Header.Get("If-None-Match")
+	if header == "" {
+		return false
+	}
+	tags, any := parseETags(header, true)
+	for _, tag := range tags {
+		any = any || tag == version
+	}
+	if any {
+		response.WriteHeader(http.StatusNotModified)
+	}
+	return any
+}
+
+// Changes a user, honouring the request's If-Match header. Without one
+// the change is made through unconditional. With "*" it is too, but
+// only if the user exists. Otherwise it is made through conditional, a
+// compare-and-swap on the user's version, and errVersionMismatch is
+// returned unless the user is at one of the listed versions. A missing
+// user fails with errVersionMismatch too, as no version of it can
+// match, so unknown tags can't be used to tell which usernames exist.
+// In hardened mode "*" is the exception: a missing user is left to
+// hidesUser, as "*" matches every existing user.
+func ifMatch(request *http.Request, unconditional func() error, conditional func(version uint64) error) error {
+	header := request.Header.Get("If-Match")
+	if header == "" {
+		return unconditional()
+	}
+	tags, any := parseETags(header, false)
+	err := errVersionMismatch
+	if any {
+		err = unconditional()
+	} else {
+		if len(tags) == 0 {
+			// No version is ever 0, so this only checks the user exists.
+			tags = []uint64{0}
+		}
+		// At most one tag can be the user's version. Trying each in turn
+		// is safe, as a mismatch leaves the user untouched.
+		for _, version := range tags {
+			if err = conditional(version); err != errVersionMismatch {
+				break
+			}
+		}
+	}
+	if err == errUserNotFound && !(any && HardenedMode) {
+		err = errVersionMismatch
+	}
+	if err == errVersionMismatch {
+		preconditionsFailedTotal.Inc()
+	}
+	return err
+}
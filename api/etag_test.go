@@ -0,0 +1,224 @@
+package api
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// Tests reading entity tags from If-Match and If-None-Match headers.
+func TestParseETags(t *testing.T) {
+	tests := []struct {
+		Header       string
+		Weak         bool
+		ExpectedTags []uint64
+		ExpectedAny  bool
+	}{
+		{`"1"`, false, []uint64{1}, false},
+		{`"1", "22"`, false, []uint64{1, 22}, false},
+		{`*`, false, nil, true},
+		{`W/"1"`, false, nil, false},
+		{`W/"1", "2"`, true, []uint64{1, 2}, false},
+		{`"1-json", "2-msgpack-gzip"`, false, []uint64{1, 2}, false},
+		{`"1-stanfurd"`, false, nil, false},
+		{`"abc", 1, "3"`, false, []uint64{3}, false},
+		{``, false, nil, false},
+	}
+	for _, test := range tests {
+		tags, any := parseETags(test.Header, test.Weak)
+		if !reflect.DeepEqual(tags, test.ExpectedTags) || any != test.ExpectedAny {
+			t.Errorf("Expected %v %v for %q. Got %v %v", test.ExpectedTags, test.ExpectedAny, test.Header, tags, any)
+		}
+	}
+}
+
+// Tests that the compare-and-swap store functions only change users
+// at the expected version.
+func TestCompareAndSwap(t *testing.T) {
+	clearGlobalSlice()
+	ctx := context.Background()
+	if err := AddUser(ctx, Credentials{"oski", "bear"}); err != nil {
+		t.Fatal(err)
+	}
+	_, _, version, err := LookupUser(ctx, "oski")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CompareAndSetPassword(ctx, "oski", "tree", version+1); err != errVersionMismatch {
+		t.Fatalf("Expected %v for a stale version. Got %v", errVersionMismatch, err)
+	}
+	if err := CompareAndSetPassword(ctx, "oski", "tree", version); err != nil {
+		t.Fatal(err)
+	}
+	if _, password, newVersion, _ := LookupUser(ctx, "oski"); password != "tree" || newVersion <= version {
+		t.Fatalf("Expected a new password and version. Got %q and %d after %d", password, newVersion, version)
+	}
+	if err := CompareAndRemoveUser(ctx, "oski", version); err != errVersionMismatch {
+		t.Fatalf("Expected %v for a stale version. Got %v", errVersionMismatch, err)
+	}
+	if err := CompareAndRemoveUser(ctx, "dirks", version); err != errUserNotFound {
+		t.Fatalf("Expected %v for a missing user. Got %v", errUserNotFound, err)
+	}
+
+	// A user signing up again never gets an old version back.
+	_, _, version, _ = LookupUser(ctx, "oski")
+	if err := CompareAndRemoveUser(ctx, "oski", version); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddUser(ctx, Credentials{"oski", "bear"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, newVersion, _ := LookupUser(ctx, "oski"); newVersion <= version {
+		t.Fatalf("Expected a version after %d. Got %d", version, newVersion)
+	}
+}
+
+// Tests ETags on getPW and If-Match on updatePW and deleteUser.
+func TestConditionalRequests(t *testing.T) {
+	clearGlobalSlice()
+	if err := AddUser(context.Background(), Credentials{"oski", "bear"}); err != nil {
+		t.Fatal(err)
+	}
+	routes := mux.NewRouter()
+	RegisterRoutes(routes)
+	router := asAdmin(t, routes)
+	send := func(method, endpoint, body string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, endpoint, strings.NewReader(body))
+		for i := 0; i < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := send(http.MethodGet, "/api/getPW", `{"username": "oski"}`)
+	tag := rr.Header().Get("ETag")
+	if rr.Code != http.StatusOK || tag == "" {
+		t.Fatalf("Expected an ETag. Got %d %q", rr.Code, tag)
+	}
+	if rr = send(http.MethodGet, "/api/getPW", `{"username": "oski"}`, "If-None-Match", tag); rr.Code != http.StatusNotModified || rr.Body.Len() != 0 {
+		t.Fatalf("Expected 304 Not Modified. Got %d %q", rr.Code, rr.Body.String())
+	}
+
+	// Each format of the response has its own tag, naming the same version.
+	rr = send(http.MethodGet, "/api/getPW", `{"username": "oski"}`, "Accept", "application/json")
+	jsonTag := rr.Header().Get("ETag")
+	if jsonTag != strings.TrimSuffix(tag, `"`)+`-json"` {
+		t.Fatalf("Expected a JSON tag for %s. Got %q", tag, jsonTag)
+	}
+	if rr = send(http.MethodGet, "/api/getPW", `{"username": "oski"}`, "If-None-Match", "W/"+jsonTag); rr.Code != http.StatusNotModified {
+		t.Fatalf("Expected 304 Not Modified for a weak tag. Got %d", rr.Code)
+	}
+	CompressMinBytes = 1
+	rr = send(http.MethodGet, "/api/getPW", `{"username": "oski"}`, "Accept", "application/json", "Accept-Encoding", "gzip")
+	CompressMinBytes = 1024
+	if gzipTag := rr.Header().Get("ETag"); rr.Header().Get("Content-Encoding") != "gzip" || gzipTag != strings.TrimSuffix(jsonTag, `"`)+`-gzip"` {
+		t.Fatalf("Expected a gzip tag for %s. Got %q", jsonTag, gzipTag)
+	}
+
+	tests := []struct {
+		Name         string
+		Method       string
+		Endpoint     string
+		Body         string
+		IfMatch      string
+		ExpectedCode int
+	}{
+		{"Update Without If-Match", http.MethodPut, "/api/updatePW", `{"username": "oski", "password": "tree"}`, "", http.StatusOK},
+		{"Update With Stale Tag", http.MethodPut, "/api/updatePW", `{"username": "oski", "password": "bear"}`, tag, http.StatusPreconditionFailed},
+		{"Update With Unknown Tag", http.MethodPut, "/api/updatePW", `{"username": "oski", "password": "bear"}`, `"stanfurd"`, http.StatusPreconditionFailed},
+		{"Update Any Version", http.MethodPut, "/api/updatePW", `{"username": "oski", "password": "bear"}`, "*", http.StatusOK},
+		{"Update Missing User", http.MethodPut, "/api/updatePW", `{"username": "dirks", "password": "bear"}`, tag, http.StatusPreconditionFailed},
+		{"Update Missing User With Unknown Tag", http.MethodPut, "/api/updatePW", `{"username": "dirks", "password": "bear"}`, `"stanfurd"`, http.StatusPreconditionFailed},
+		{"Update Missing User Any Version", http.MethodPut, "/api/updatePW", `{"username": "dirks", "password": "bear"}`, "*", http.StatusPreconditionFailed},
+		{"Delete Missing User Any Version", http.MethodDelete, "/api/deleteUser", `{"username": "dirks"}`, "*", http.StatusPreconditionFailed},
+		{"Delete With Stale Tag", http.MethodDelete, "/api/deleteUser", `{"username": "oski"}`, tag, http.StatusPreconditionFailed},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			var header []string
+			if test.IfMatch != "" {
+				header = []string{"If-Match", test.IfMatch}
+			}
+			if rr := send(test.Method, test.Endpoint, test.Body, header...); rr.Code != test.ExpectedCode {
+				t.Errorf("Expected status code %d. Got %d", test.ExpectedCode, rr.Code)
+			}
+		})
+	}
+
+	// The current tag, among others, lets the change through.
+	current := send(http.MethodGet, "/api/getPW", `{"username": "oski"}`).Header().Get("ETag")
+	if current == tag {
+		t.Fatalf("Expected the ETag to change with the password. Got %q twice", tag)
+	}
+	if rr = send(http.MethodDelete, "/api/deleteUser", `{"username": "oski"}`, "If-Match", tag+", "+current); rr.Code != http.StatusOK {
+		t.Fatalf("Expected the user to be deleted. Got %d", rr.Code)
+	}
+	if len(UserSlice) != 0 {
+		t.Fatalf("Expected no users. Got %v", UserSlice)
+	}
+}
+
+// Tests that versions are stored with the users, and that old store
+// files are migrated.
+func TestVersionStore(t *testing.T) {
+	defer func() {
+		StorePath, diskFormat = "", storeFormat
+		versions, lastVersion = map[string]uint64{}, 0
+	}()
+	clearGlobalSlice()
+
+	// Users without a version are given one, which is written back.
+	path := filepath.Join(t.TempDir(), "unversioned.json")
+	if err := ioutil.WriteFile(path, []byte(`{"version": 3, "users": [{"username": "oski", "password": "bear"}], "lockouts": {}, "versions": {}, "last_version": 4}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := OpenStore(path); err != nil {
+		t.Fatal(err)
+	}
+	if file, _, err := readStore(path); err != nil || file.Versions["oski"] != 5 || file.LastVersion != 5 {
+		t.Fatalf("Expected version 5 to be stored. Got %+v %v", file, err)
+	}
+
+	// Version 2 stores had no versions.
+	path = filepath.Join(t.TempDir(), "users.json")
+	if err := ioutil.WriteFile(path, []byte(`{"version": 2, "users": [{"username": "oski", "password": "bear"}], "lockouts": {}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := OpenStore(path); err != nil {
+		t.Fatal(err)
+	}
+	file, version, err := readStore(path)
+	if err != nil || version != storeFormat || file.Versions == nil || len(file.Users) != 1 {
+		t.Fatalf("Expected the store to be migrated. Got %+v %d %v", file, version, err)
+	}
+
+	// Versions, and the last one handed out, survive a reload.
+	if err := SetPassword(context.Background(), "oski", "tree"); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddUser(context.Background(), Credentials{"dirks", "tree"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := RemoveUser(context.Background(), "dirks"); err != nil {
+		t.Fatal(err)
+	}
+	_, _, expected, _ := LookupUser(context.Background(), "oski")
+	last := lastVersion
+	versions, lastVersion = nil, 0
+	if err := LoadUsers(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, loaded, _ := LookupUser(context.Background(), "oski"); loaded != expected || lastVersion != last {
+		t.Fatalf("Expected version %d and last version %d. Got %d and %d", expected, last, loaded, lastVersion)
+	}
+}
@@ -0,0 +1,72 @@
+package api
+
+import (
+	"context"
+	"time"
+)
+
+// The kinds of change to a user that are published as events.
+const (
+	EventUserCreated     = "user.created"
+	EventPasswordChanged = "user.password_changed"
+	EventUserDeleted     = "user.deleted"
+)
+
+// A UserEvent is a change to a user, published once it has been
+// written to the store.
+type UserEvent struct {
+	Type     string    `json:"type"`
+	Username string    `json:"username"`
+	Time     time.Time `json:"time"`
+	// Who made the change and the ID of the request that made it. See
+	// actorFromContext.
+	Actor     string `json:"actor,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// The events of the store update in progress. Guarded by userLock.
+var pendingEvents []UserEvent
+
+// Called with every event, in the order the changes were made, while
+// userLock is held. They must not block.
+var eventHandlers = []func(ctx context.Context, event UserEvent){
+	countUserEvent,
+	auditEvent,
+	webhookEvent,
+	streamUserEvent,
+}
+
+// Records a change made by the store update in progress. It is
+// published if the update succeeds. Callers must hold userLock.
+func emit(eventType, username string) {
+	pendingEvents = append(pendingEvents, UserEvent{Type: eventType, Username: username, Time: clock()})
+}
+
+// Publishes the events of a successful store update to every handler
+// and clears them. Callers must hold userLock.
+func publish(ctx context.Context) {
+	events := pendingEvents
+	pendingEvents = nil
+	actor, requestID := actorFromContext(ctx), RequestIDFromContext(ctx)
+	for _, event := range events {
+		event.Actor, event.RequestID = actor, requestID
+		for _, handler := range eventHandlers {
+			handler(ctx, event)
+		}
+	}
+}
+
+type clientKey struct{}
+
+// Returns who is making a request: the admin's certificate name for
+// admin routes, and otherwise the client's IP address. It is empty for
+// changes not made through a request, such as those made by credctl.
+func actorFromContext(ctx context.Context) string {
+	if admin, ok := AdminFromContext(ctx); ok {
+		return "admin:" + admin
+	}
+	if client, ok := ctx.Value(clientKey{}).(string); ok {
+		return "client:" + client
+	}
+	return ""
+}
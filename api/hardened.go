@@ -0,0 +1,86 @@
+package api
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+)
+
+// HardenedMode stops callers from finding out which usernames exist.
+//
+// When it is set signup, updatePassword and deleteUser respond as if
+// they succeeded when the user already exists or doesn't exist, and
+// getIndex and getPassword need the user's password and give the same
+// 400 Bad Request for unknown users, wrong passwords and locked
+// accounts. Wrong passwords count towards LockoutThreshold. Passwords are
+// compared through HMAC-SHA256 whether or not the user exists, and the
+// store is written either way, so responses take about as long too.
+var HardenedMode = false
+
+// A key made at startup for comparing passwords in hardened mode.
+var compareKey = randomBytes(hashKeyLen)
+
+// Stands in for the password of users who don't exist.
+var dummyPassword = hex.EncodeToString(randomBytes(16))
+
+// Returns a digest of password the same length whatever its length, so
+// comparing two of them takes the same time.
+func compareMAC(password string) []byte {
+	mac := hmac.New(sha256.New, compareKey)
+	mac.Write([]byte(password))
+	return mac.Sum(nil)
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	rand.Read(b)
+	return b
+}
+
+// Reports whether given is the stored password of a user that was
+// found. In hardened mode unknown users are compared against a dummy
+// password so both cases take as long.
+func checkPassword(stored string, found bool, given string) bool {
+	if !HardenedMode {
+		return found && passwordsMatch(stored, given)
+	}
+	if !found {
+		stored = dummyPassword
+	}
+	return hmac.Equal(compareMAC(stored), compareMAC(given)) && found
+}
+
+// Reports whether err, returned by a store function, should be hidden
+// from the caller by responding as though the call succeeded. The store
+// is written anyway so the response takes as long as a real change.
+func hidesUser(ctx context.Context, err error) bool {
+	if !HardenedMode || (err != errUserExists && err != errUserNotFound) {
+		return false
+	}
+	update(ctx, "Pad", func() error { return nil })
+	return true
+}
+
+// Looks up the user named in creds for getIndex and getPassword, where
+// readErr is what readJSON returned. Normally only a username is
+// needed. In hardened mode the password must match too, and unknown
+// users and wrong passwords both report false. The password is checked
+// by VerifyPassword, so wrong ones count towards locking the account.
+// It returns the user's index, password and version.
+func lookupRequested(request *http.Request, creds *Credentials, readErr error) (int, string, uint64, bool) {
+	if readErr != nil && (HardenedMode || readErr.Error() != "No Password") {
+		return -1, "", 0, false
+	}
+	if HardenedMode {
+		verified, err := VerifyPassword(request.Context(), creds.Username, creds.Password)
+		if err != nil || !verified {
+			return -1, "", 0, false
+		}
+	}
+	index, password, version, err := LookupUser(request.Context(), creds.Username)
+	countLookup(err)
+	return index, password, version, err == nil
+}
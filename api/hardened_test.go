@@ -0,0 +1,139 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// Tests that in hardened mode requests naming a user that exists get
+// the same response as requests naming one that doesn't.
+func TestHardenedResponses(t *testing.T) {
+	HardenedMode = true
+	defer func() {
+		HardenedMode = false
+		lockouts = map[string]lockout{}
+	}()
+
+	routes := mux.NewRouter()
+	RegisterRoutes(routes)
+	router := asAdmin(t, routes)
+	send := func(method, endpoint, body, ifMatch string) *httptest.ResponseRecorder {
+		clearGlobalSlice()
+		lockouts = map[string]lockout{}
+		UserSlice = []Credentials{{"oski", "bear"}}
+		assignVersions()
+		req := httptest.NewRequest(method, endpoint, strings.NewReader(body))
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	tests := []struct {
+		Name     string
+		Method   string
+		Endpoint string
+		Existing string
+		Unknown  string
+		IfMatch  string
+	}{
+		{"Signup", http.MethodPost, "/api/signup",
+			`{"username": "oski", "password": "bear"}`, `{"username": "dirks", "password": "bear"}`, ""},
+		{"Update Password", http.MethodPut, "/api/updatePW",
+			`{"username": "oski", "password": "golden"}`, `{"username": "dirks", "password": "golden"}`, ""},
+		{"Delete User", http.MethodDelete, "/api/deleteUser",
+			`{"username": "oski"}`, `{"username": "dirks"}`, ""},
+		{"Get Index With Wrong Password", http.MethodGet, "/api/getIndex",
+			`{"username": "oski", "password": "stanfurd"}`, `{"username": "dirks", "password": "stanfurd"}`, ""},
+		{"Get Index Without Password", http.MethodGet, "/api/getIndex",
+			`{"username": "oski"}`, `{"username": "dirks"}`, ""},
+		{"Get Password With Wrong Password", http.MethodGet, "/api/getPW",
+			`{"username": "oski", "password": "stanfurd"}`, `{"username": "dirks", "password": "stanfurd"}`, ""},
+		{"Update Password With Unknown Tag", http.MethodPut, "/api/updatePW",
+			`{"username": "oski", "password": "golden"}`, `{"username": "dirks", "password": "golden"}`, `"stanfurd"`},
+		{"Update Password Any Version", http.MethodPut, "/api/updatePW",
+			`{"username": "oski", "password": "golden"}`, `{"username": "dirks", "password": "golden"}`, "*"},
+		{"Delete User With Unknown Tag", http.MethodDelete, "/api/deleteUser",
+			`{"username": "oski"}`, `{"username": "dirks"}`, `"stanfurd"`},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			existing := send(test.Method, test.Endpoint, test.Existing, test.IfMatch)
+			unknown := send(test.Method, test.Endpoint, test.Unknown, test.IfMatch)
+			if existing.Code != unknown.Code {
+				t.Errorf("Expected the same status code for both users. Got %d for an existing user and %d for an unknown one", existing.Code, unknown.Code)
+			}
+			if existing.Body.String() != unknown.Body.String() {
+				t.Errorf("Expected the same body for both users. Got %q for an existing user and %q for an unknown one", existing.Body.String(), unknown.Body.String())
+			}
+			existingHeader, unknownHeader := existing.Header().Clone(), unknown.Header().Clone()
+			existingHeader.Del(requestIDHeader)
+			unknownHeader.Del(requestIDHeader)
+			if !reflect.DeepEqual(existingHeader, unknownHeader) {
+				t.Errorf("Expected the same headers for both users. Got %v for an existing user and %v for an unknown one", existingHeader, unknownHeader)
+			}
+		})
+	}
+}
+
+// Tests that in hardened mode getIndex and getPassword still work when
+// given the user's password, that wrong passwords lock the account,
+// and that changes are still made.
+func TestHardenedLookups(t *testing.T) {
+	HardenedMode = true
+	defer func() {
+		HardenedMode = false
+		lockouts = map[string]lockout{}
+	}()
+	clearGlobalSlice()
+	lockouts = map[string]lockout{}
+	UserSlice = []Credentials{{"oski", "bear"}, {"dirks", "tree"}}
+
+	router := mux.NewRouter()
+	RegisterRoutes(router)
+	send := func(method, endpoint, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, endpoint, strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := send(http.MethodGet, "/api/getIndex", `{"username": "dirks", "password": "tree"}`)
+	if err := checkStatusCodeAndBody(http.StatusOK, rr.Code, "1", rr.Body.String()); err != nil {
+		t.Error(err)
+	}
+	rr = send(http.MethodGet, "/api/getPW", `{"username": "oski", "password": "bear"}`)
+	if err := checkStatusCodeAndBody(http.StatusOK, rr.Code, "bear", rr.Body.String()); err != nil {
+		t.Error(err)
+	}
+
+	// Wrong passwords count towards a lockout like /api/verify, so even
+	// the right password is refused afterwards.
+	for _, endpoint := range []string{"/api/getIndex", "/api/getPW"} {
+		if rr := send(http.MethodGet, endpoint, `{"username": "dirks", "password": "stanfurd"}`); rr.Code != http.StatusBadRequest {
+			t.Fatalf("Incorrect status code returned! Expected: %d Actual: %d", http.StatusBadRequest, rr.Code)
+		}
+	}
+	if lockouts["dirks"].Failures != 1 {
+		t.Fatalf("Expected one counted failure. Got %+v", lockouts["dirks"])
+	}
+	if rr := send(http.MethodGet, "/api/getPW", `{"username": "dirks", "password": "tree"}`); rr.Code != http.StatusBadRequest {
+		t.Fatalf("Incorrect status code returned! Expected: %d Actual: %d", http.StatusBadRequest, rr.Code)
+	}
+
+	rr = send(http.MethodPut, "/api/updatePW", `{"username": "oski", "password": "golden"}`)
+	if rr.Code != http.StatusOK || UserSlice[0].Password != "golden" {
+		t.Errorf("Expected the password to be changed with status %d. Got status %d and slice %v", http.StatusOK, rr.Code, UserSlice)
+	}
+	rr = send(http.MethodPost, "/api/signup", `{"username": "oski", "password": "again"}`)
+	if rr.Code != http.StatusCreated || len(UserSlice) != 2 || UserSlice[0].Password != "golden" {
+		t.Errorf("Expected an existing user to be left alone with status %d. Got status %d and slice %v", http.StatusCreated, rr.Code, UserSlice)
+	}
+}
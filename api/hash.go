@@ -0,0 +1,65 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"runtime"
+	"sync"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Parameters used by HashPassword. Hashes record their own iteration
+// count so these can be raised without breaking old hashes.
+const (
+	hashScheme  = "pbkdf2-sha256"
+	hashSaltLen = 16
+	hashKeyLen  = 32
+)
+
+// The PBKDF2 iteration count, as recommended by OWASP for
+// PBKDF2-HMAC-SHA256. Lowered by tests.
+var hashIterations = 600000
+
+// HashPassword returns a salted PBKDF2-SHA256 hash of password in the
+// form "pbkdf2-sha256$<iterations>$<salt>$<key>".
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, hashSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := pbkdf2.Key([]byte(password), salt, hashIterations, hashKeyLen, sha256.New)
+	return encodeHash(hashIterations, salt, key), nil
+}
+
+func encodeHash(iterations int, salt, key []byte) string {
+	return fmt.Sprintf("%s$%d$%s$%s", hashScheme, iterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+// Hashes the password of every user, spreading the work over every
+// CPU. The hashes are returned in the same order.
+func hashPasswords(users []Credentials) ([]string, error) {
+	hashes := make([]string, len(users))
+	errs := make([]error, len(users))
+	workers := make(chan struct{}, runtime.GOMAXPROCS(0))
+	var wg sync.WaitGroup
+	for i := range users {
+		wg.Add(1)
+		workers <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			hashes[i], errs[i] = HashPassword(users[i].Password)
+			<-workers
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return hashes, nil
+}
@@ -0,0 +1,89 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// HSTSMaxAge is how long browsers that reached the server over HTTPS
+// should refuse to use plain HTTP with it. Zero leaves out the
+// Strict-Transport-Security header.
+var HSTSMaxAge = 365 * 24 * time.Hour
+
+// The API serves no documents, so nothing may be loaded from or frame
+// its responses.
+const contentSecurityPolicy = "default-src 'none'; frame-ancestors 'none'"
+
+// Responses that don't say what they are are plain text, which is what
+// handlers writing with fmt.Fprint produce.
+const defaultContentType = "text/plain; charset=utf-8"
+
+// Sets security headers on every response, and a Content-Type on
+// responses whose handler didn't set one so browsers never sniff them.
+// Strict-Transport-Security is only sent over HTTPS.
+func secureHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		header := response.Header()
+		header.Set("X-Content-Type-Options", "nosniff")
+		header.Set("Content-Security-Policy", contentSecurityPolicy)
+		header.Set("Referrer-Policy", "no-referrer")
+		if request.TLS != nil && HSTSMaxAge > 0 {
+			header.Set("Strict-Transport-Security", "max-age="+strconv.Itoa(int(HSTSMaxAge.Seconds()))+"; includeSubDomains")
+		}
+		typer := &contentTyper{ResponseWriter: response}
+		next.ServeHTTP(typer, request)
+		// Handlers that write nothing still send headers afterwards.
+		typer.setContentType()
+	})
+}
+
+// Wraps the handler of a route whose responses hold credentials, such
+// as passwords or tokens, so they are never cached.
+func noStore(next http.HandlerFunc) http.HandlerFunc {
+	return func(response http.ResponseWriter, request *http.Request) {
+		response.Header().Set("Cache-Control", "no-store")
+		response.Header().Set("Pragma", "no-cache")
+		next(response, request)
+	}
+}
+
+// Wraps a ResponseWriter to set defaultContentType when the headers
+// are written without a Content-Type.
+type contentTyper struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *contentTyper) setContentType() {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", defaultContentType)
+	}
+}
+
+func (w *contentTyper) WriteHeader(code int) {
+	w.setContentType()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *contentTyper) Write(p []byte) (int, error) {
+	w.setContentType()
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush lets streaming handlers such as exportUsers keep working.
+func (w *contentTyper) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		w.setContentType()
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the connection.
+func (w *contentTyper) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,71 @@
+package api
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// Tests the security headers and Content-Type set on every response,
+// and that credentials are never cached.
+func TestSecureHeaders(t *testing.T) {
+	clearGlobalSlice()
+	UserSlice = []Credentials{{"oski", "bear"}}
+	routes := mux.NewRouter()
+	RegisterRoutes(routes)
+	router := asAdmin(t, routes)
+
+	tests := []struct {
+		Name        string
+		Method      string
+		Endpoint    string
+		Body        string
+		TLS         bool
+		ContentType string
+		NoStore     bool
+	}{
+		{"Plain Text", http.MethodGet, "/api/getQuery?userID=40", "", false, defaultContentType, false},
+		{"Password", http.MethodGet, "/api/getPW", `{"username": "oski"}`, false, defaultContentType, true},
+		{"Cookie", http.MethodGet, "/api/getCookie", "", true, defaultContentType, true},
+		{"Empty Response", http.MethodPut, "/api/updatePW", `{"username": "oski", "password": "bear"}`, false, defaultContentType, false},
+		{"Error", http.MethodPost, "/api/signup", `{"username": "oski"}`, true, defaultContentType, false},
+		{"JSON", http.MethodGet, "/api/v1/users", "", false, "application/json", false},
+		{"Export", http.MethodGet, "/api/v1/users:export", "", false, "application/x-ndjson", true},
+		{"Not Found", http.MethodGet, "/api/nope", "", false, defaultContentType, false},
+		{"Method Not Allowed", http.MethodPost, "/api/getPW", "", false, defaultContentType, false},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			req := httptest.NewRequest(test.Method, test.Endpoint, strings.NewReader(test.Body))
+			if test.TLS {
+				req.TLS = &tls.ConnectionState{}
+			}
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			expected := map[string]string{
+				"Content-Type":              test.ContentType,
+				"X-Content-Type-Options":    "nosniff",
+				"Content-Security-Policy":   contentSecurityPolicy,
+				"Referrer-Policy":           "no-referrer",
+				"Strict-Transport-Security": "",
+				"Cache-Control":             "",
+			}
+			if test.TLS {
+				expected["Strict-Transport-Security"] = "max-age=31536000; includeSubDomains"
+			}
+			if test.NoStore {
+				expected["Cache-Control"] = "no-store"
+			}
+			for name, value := range expected {
+				if actual := rr.Header().Get(name); actual != value {
+					t.Errorf("Expected %s to be %q. Got %q", name, value, actual)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,188 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How long a single health or readiness check may take.
+const checkTimeout = 2 * time.Second
+
+// A Check reports whether some part of the server is working,
+// returning an error describing the problem if not.
+type Check func(ctx context.Context) error
+
+// A named check, kept in the order it was added.
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+var (
+	checkLock    sync.Mutex
+	healthChecks []namedCheck
+	readyChecks  = []namedCheck{
+		{"store", checkStore},
+		{"migrations", checkMigrations},
+		{"draining", checkDraining},
+	}
+)
+
+// Set once the server starts shutting down. Accessed atomically.
+var draining int32
+
+// AddHealthCheck adds a check to /healthz. Health checks should only
+// fail when the process needs restarting.
+func AddHealthCheck(name string, check Check) {
+	checkLock.Lock()
+	defer checkLock.Unlock()
+	healthChecks = append(healthChecks, namedCheck{name, check})
+}
+
+// AddReadyCheck adds a check to /readyz. Readiness checks fail while
+// the server can't usefully take traffic.
+func AddReadyCheck(name string, check Check) {
+	checkLock.Lock()
+	defer checkLock.Unlock()
+	readyChecks = append(readyChecks, namedCheck{name, check})
+}
+
+// StartDraining marks the server as shutting down so /readyz fails,
+// and ends every event stream so they don't hold up draining. It should
+// be called while the server is still serving, such as by
+// server.PreStop, so probes can see it.
+func StartDraining() {
+	atomic.StoreInt32(&draining, 1)
+	stream.endAll()
+}
+
+// The response written by the health and readiness endpoints. Checks
+// maps the name of each check to "ok" or the error it returned.
+type checkResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// Responds 200 OK while the process is alive and every check added by
+// AddHealthCheck passes, and 503 Service Unavailable otherwise.
+func healthz(response http.ResponseWriter, request *http.Request) {
+	checkLock.Lock()
+	checks := append([]namedCheck(nil), healthChecks...)
+	checkLock.Unlock()
+	runChecks(response, request, checks)
+}
+
+// Responds 200 OK when the user store is reachable and up to date and
+// the server isn't shutting down, and 503 Service Unavailable otherwise.
+// Checks added by AddReadyCheck must also pass.
+func readyz(response http.ResponseWriter, request *http.Request) {
+	checkLock.Lock()
+	checks := append([]namedCheck(nil), readyChecks...)
+	checkLock.Unlock()
+	runChecks(response, request, checks)
+}
+
+// Runs every check and writes a checkResponse.
+func runChecks(response http.ResponseWriter, request *http.Request, checks []namedCheck) {
+	ctx, cancel := context.WithTimeout(request.Context(), checkTimeout)
+	defer cancel()
+
+	result := checkResponse{Status: "ok", Checks: map[string]string{}}
+	for _, c := range checks {
+		if err := c.check(ctx); err != nil {
+			result.Status = "unavailable"
+			result.Checks[c.name] = err.Error()
+		} else {
+			result.Checks[c.name] = "ok"
+		}
+	}
+
+	response.Header().Set("Content-Type", "application/json")
+	response.Header().Set("Cache-Control", "no-store")
+	if result.Status != "ok" {
+		response.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(response).Encode(result)
+}
+
+// Fails if the directory holding the store file has gone away.
+func checkStore(ctx context.Context) error {
+	userLock.Lock()
+	path, closed := StorePath, storeClosed
+	userLock.Unlock()
+
+	if closed {
+		return errStoreClosed
+	}
+	if path == "" {
+		return nil
+	}
+	info, err := os.Stat(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return errors.New("Store Directory Missing")
+	}
+	return nil
+}
+
+// Fails if the store file hasn't been upgraded to the current format.
+func checkMigrations(ctx context.Context) error {
+	userLock.Lock()
+	defer userLock.Unlock()
+	if diskFormat != storeFormat {
+		return errors.New("Store Not Migrated")
+	}
+	return nil
+}
+
+// Fails once the server starts shutting down.
+func checkDraining(ctx context.Context) error {
+	if atomic.LoadInt32(&draining) != 0 {
+		return errors.New("Draining")
+	}
+	return nil
+}
+
+// The response written by version.
+type versionResponse struct {
+	Module    string `json:"module"`
+	Version   string `json:"version"`
+	GoVersion string `json:"go_version"`
+	Revision  string `json:"revision,omitempty"`
+	BuildTime string `json:"build_time,omitempty"`
+	Modified  bool   `json:"modified"`
+}
+
+// Writes the module path and version the server was built from, along
+// with the VCS revision and commit time stamped in by the go command.
+func version(response http.ResponseWriter, request *http.Request) {
+	result := versionResponse{GoVersion: runtime.Version()}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		result.Module = info.Main.Path
+		result.Version = info.Main.Version
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				result.Revision = setting.Value
+			case "vcs.time":
+				result.BuildTime = setting.Value
+			case "vcs.modified":
+				result.Modified = setting.Value == "true"
+			}
+		}
+	}
+
+	response.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(response).Encode(result)
+}
@@ -0,0 +1,90 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// Calls a check endpoint and decodes its response.
+func probe(t *testing.T, handler http.HandlerFunc, endpoint string) (int, checkResponse) {
+	req := httptest.NewRequest(http.MethodGet, endpoint, nil)
+	rr := httptest.NewRecorder()
+	handler(rr, req)
+
+	var result checkResponse
+	if err := json.NewDecoder(rr.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	return rr.Code, result
+}
+
+// Tests the health endpoint and adding checks to it.
+func TestHealthz(t *testing.T) {
+	defer func() { healthChecks = nil }()
+
+	if code, result := probe(t, healthz, "/healthz"); code != http.StatusOK || result.Status != "ok" {
+		t.Fatalf("Expected a healthy server. Got %d %+v", code, result)
+	}
+
+	AddHealthCheck("always fine", func(ctx context.Context) error { return nil })
+	AddHealthCheck("deadlocked", func(ctx context.Context) error { return errors.New("worker stuck") })
+	code, result := probe(t, healthz, "/healthz")
+	if code != http.StatusServiceUnavailable || result.Checks["deadlocked"] != "worker stuck" || result.Checks["always fine"] != "ok" {
+		t.Fatalf("Expected the failing check to be reported. Got %d %+v", code, result)
+	}
+}
+
+// Tests each of the readiness checks.
+func TestReadyz(t *testing.T) {
+	defer func() { StorePath, diskFormat, draining = "", storeFormat, 0 }()
+
+	tests := []struct {
+		Name        string
+		Setup       func()
+		FailedCheck string
+	}{
+		{"Ready", func() {}, ""},
+		{"Store Unreachable", func() { StorePath = filepath.Join(t.TempDir(), "gone", "users.json") }, "store"},
+		{"Not Migrated", func() { diskFormat = storeFormat - 1 }, "migrations"},
+		{"Draining", StartDraining, "draining"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			StorePath, diskFormat, draining = "", storeFormat, 0
+			test.Setup()
+			code, result := probe(t, readyz, "/readyz")
+
+			if test.FailedCheck == "" {
+				if code != http.StatusOK || result.Status != "ok" {
+					t.Fatalf("Expected a ready server. Got %d %+v", code, result)
+				}
+				return
+			}
+			if code != http.StatusServiceUnavailable || result.Checks[test.FailedCheck] == "ok" {
+				t.Fatalf("Expected check %s to fail. Got %d %+v", test.FailedCheck, code, result)
+			}
+		})
+	}
+}
+
+// Tests that the version endpoint describes the running binary.
+func TestVersion(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/version", nil)
+	rr := httptest.NewRecorder()
+	version(rr, req)
+
+	var result versionResponse
+	if err := json.NewDecoder(rr.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if rr.Code != http.StatusOK || result.GoVersion != runtime.Version() {
+		t.Fatalf("Unexpected version response %d %+v", rr.Code, result)
+	}
+}
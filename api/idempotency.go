@@ -0,0 +1,292 @@
+package api
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// IdempotencyWindow is how long the first response to a request with
+// an Idempotency-Key header is kept for replaying to retries with the
+// same key. Zero turns Idempotency-Key support off.
+var IdempotencyWindow = 24 * time.Hour
+
+// IdempotencyMaxKeys and IdempotencyMaxBytes limit how many responses
+// are kept and how large they may be altogether. Past either, the
+// oldest are dropped and retries with their keys are handled afresh.
+var (
+	IdempotencyMaxKeys        = 10000
+	IdempotencyMaxBytes int64 = 64 << 20
+)
+
+// The headers idempotent requests send their key in, and replayed
+// responses are marked with.
+const (
+	idempotencyKeyHeader = "Idempotency-Key"
+	replayedHeader       = "Idempotent-Replayed"
+)
+
+// The longest key accepted.
+const maxIdempotencyKeyLen = 255
+
+// How often expired responses are dropped.
+const idempotencySweepInterval = time.Minute
+
+var replaysTotal = Metrics.NewCounter("http_idempotent_replays_total",
+	"Responses replayed to retries of requests with an Idempotency-Key.")
+
+// The response to a request with an Idempotency-Key. done is closed
+// once the response has been recorded, and retries arriving before
+// then wait on it.
+type idempotentResponse struct {
+	done        chan struct{}
+	fingerprint [sha256.Size]byte
+	expires     time.Time
+
+	// The response's place in idempotentOrder, nil once it has been
+	// dropped, and the bytes it counts towards idempotentBytes.
+	// Guarded by idempotencyLock.
+	element *list.Element
+	size    int64
+
+	// Set before done is closed. header only holds the headers the
+	// handler set itself. failed is set if the response wasn't kept.
+	status int
+	header http.Header
+	body   []byte
+	failed bool
+}
+
+// The responses kept for each route, scope and key, their keys from
+// oldest to newest, and their total size. Guarded by idempotencyLock.
+var (
+	idempotencyLock  sync.Mutex
+	idempotentKeys   = map[string]*idempotentResponse{}
+	idempotentOrder  = list.New()
+	idempotentBytes  int64
+	idempotencySwept time.Time
+)
+
+// Makes a handler safe to retry. The first response to a request with
+// an Idempotency-Key header is kept for IdempotencyWindow and replayed,
+// marked with Idempotent-Replayed: true, to later requests to the same
+// route with the same key. Retries sent while the first request is
+// still being handled wait for its response. On admin routes keys
+// belong to the admin that sent them, and reusing a key with a
+// different body gets 422 Unprocessable Entity. Other routes have no
+// one to tie keys to, and clients retrying over a new connection may
+// come back from another IP address, so there a key only matches
+// requests with the same method and body. Only a client that already
+// knows the whole request can replay its response.
+//
+// Server errors aren't kept, so a retry after one is handled afresh.
+// Responses are only kept in memory, so retries must reach the same
+// instance.
+func idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(response http.ResponseWriter, request *http.Request) {
+		key := request.Header.Get(idempotencyKeyHeader)
+		if IdempotencyWindow <= 0 || key == "" {
+			next(response, request)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLen {
+			http.Error(response, "", http.StatusBadRequest)
+			return
+		}
+
+		var body []byte
+		if request.Body != nil {
+			var err error
+			if body, err = ioutil.ReadAll(request.Body); err != nil {
+				rejectBody(response, err)
+				return
+			}
+			request.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		fingerprint := sha256.Sum256(append([]byte(request.Method+" "+request.Header.Get("Content-Type")+"\n"), body...))
+
+		for {
+			kept, first := claimKey(routeTemplate(request)+" "+idempotencyScope(request, fingerprint)+" "+key, fingerprint)
+			if first {
+				record(kept, response, request, next)
+				return
+			}
+			if kept.fingerprint != fingerprint {
+				http.Error(response, "", http.StatusUnprocessableEntity)
+				return
+			}
+			select {
+			case <-kept.done:
+			case <-request.Context().Done():
+				return
+			}
+			// The first request failed, so this one takes over the key.
+			if kept.failed {
+				continue
+			}
+			replay(kept, response)
+			return
+		}
+	}
+}
+
+// Returns what keys sent with request are scoped to: the admin who
+// sent it, or else the request's fingerprint.
+func idempotencyScope(request *http.Request, fingerprint [sha256.Size]byte) string {
+	if admin, ok := AdminFromContext(request.Context()); ok {
+		return "admin:" + admin
+	}
+	return "request:" + hex.EncodeToString(fingerprint[:])
+}
+
+// Returns the response kept for key, or claims key for a request with
+// fingerprint, reporting true, if nothing is kept for it.
+func claimKey(key string, fingerprint [sha256.Size]byte) (*idempotentResponse, bool) {
+	idempotencyLock.Lock()
+	defer idempotencyLock.Unlock()
+
+	now := clock()
+	if now.Sub(idempotencySwept) >= idempotencySweepInterval {
+		for k, kept := range idempotentKeys {
+			if isExpired(kept, now) {
+				forgetKey(k, kept)
+			}
+		}
+		idempotencySwept = now
+	}
+
+	kept, ok := idempotentKeys[key]
+	if ok && !isExpired(kept, now) && !isFailed(kept) {
+		return kept, false
+	} else if ok {
+		forgetKey(key, kept)
+	}
+	kept = &idempotentResponse{done: make(chan struct{}), fingerprint: fingerprint}
+	kept.element = idempotentOrder.PushBack(key)
+	kept.size = int64(len(key))
+	idempotentKeys[key] = kept
+	idempotentBytes += kept.size
+	dropOldest()
+	return kept, true
+}
+
+// Drops kept, the response kept for key. Callers must hold
+// idempotencyLock.
+func forgetKey(key string, kept *idempotentResponse) {
+	if kept.element == nil {
+		return
+	}
+	delete(idempotentKeys, key)
+	idempotentOrder.Remove(kept.element)
+	kept.element = nil
+	idempotentBytes -= kept.size
+}
+
+// Drops the oldest responses until those left are within
+// IdempotencyMaxKeys and IdempotencyMaxBytes. Requests still waiting
+// on a dropped response get it all the same. Callers must hold
+// idempotencyLock.
+func dropOldest() {
+	for len(idempotentKeys) > IdempotencyMaxKeys || idempotentBytes > IdempotencyMaxBytes {
+		oldest := idempotentOrder.Front()
+		if oldest == nil {
+			return
+		}
+		key := oldest.Value.(string)
+		forgetKey(key, idempotentKeys[key])
+	}
+}
+
+// Reports whether kept has been recorded and has passed its expiry.
+func isExpired(kept *idempotentResponse, now time.Time) bool {
+	return isDone(kept) && !now.Before(kept.expires)
+}
+
+// Reports whether kept has been recorded but wasn't kept.
+func isFailed(kept *idempotentResponse) bool {
+	return isDone(kept) && kept.failed
+}
+
+func isDone(kept *idempotentResponse) bool {
+	select {
+	case <-kept.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Handles the first request with a key, keeping its response in kept.
+func record(kept *idempotentResponse, response http.ResponseWriter, request *http.Request, next http.HandlerFunc) {
+	before := response.Header().Clone()
+	recorder := &bodyRecorder{statusRecorder: &statusRecorder{ResponseWriter: response}}
+	completed := false
+	defer func() {
+		idempotencyLock.Lock()
+		kept.status = recorder.Status()
+		kept.header = http.Header{}
+		for name, values := range response.Header() {
+			if !equalValues(before[name], values) {
+				kept.header[name] = append([]string(nil), values...)
+			}
+		}
+		kept.body = recorder.body.Bytes()
+		// Handlers that panicked are treated as server errors.
+		kept.failed = !completed || kept.status >= http.StatusInternalServerError
+		kept.expires = clock().Add(IdempotencyWindow)
+		close(kept.done)
+		if kept.element != nil {
+			size := int64(len(kept.body))
+			for name, values := range kept.header {
+				for _, value := range values {
+					size += int64(len(name) + len(value))
+				}
+			}
+			kept.size += size
+			idempotentBytes += size
+			dropOldest()
+		}
+		idempotencyLock.Unlock()
+	}()
+	next(recorder, request)
+	completed = true
+}
+
+// Writes a kept response.
+func replay(kept *idempotentResponse, response http.ResponseWriter) {
+	for name, values := range kept.header {
+		response.Header()[name] = values
+	}
+	response.Header().Set(replayedHeader, "true")
+	replaysTotal.Inc()
+	response.WriteHeader(kept.status)
+	response.Write(kept.body)
+}
+
+func equalValues(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Passes a response through while keeping a copy of its body.
+type bodyRecorder struct {
+	*statusRecorder
+	body bytes.Buffer
+}
+
+func (r *bodyRecorder) Write(p []byte) (int, error) {
+	r.body.Write(p)
+	return r.statusRecorder.Write(p)
+}
@@ -0,0 +1,249 @@
+package api
+
+import (
+	"container/list"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Tests that retried signups with an Idempotency-Key get the first
+// response again.
+func TestIdempotentSignup(t *testing.T) {
+	now := time.Now()
+	clock = func() time.Time { return now }
+	defer func() {
+		clock = time.Now
+		resetIdempotency()
+	}()
+	clearGlobalSlice()
+	router := mux.NewRouter()
+	RegisterRoutes(router)
+	signupFrom := func(addr, key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/signup", strings.NewReader(body))
+		req.RemoteAddr = addr
+		if key != "" {
+			req.Header.Set(idempotencyKeyHeader, key)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	signupWith := func(key, body string) *httptest.ResponseRecorder {
+		return signupFrom("10.0.0.1:1000", key, body)
+	}
+
+	tests := []struct {
+		Name             string
+		Key              string
+		Body             string
+		ExpectedCode     int
+		ExpectedReplayed bool
+	}{
+		{"First Attempt", "key-1", `{"username": "oski", "password": "bear"}`, http.StatusCreated, false},
+		{"Retry", "key-1", `{"username": "oski", "password": "bear"}`, http.StatusCreated, true},
+		{"Different Body", "key-1", `{"username": "oski", "password": "tree"}`, http.StatusConflict, false},
+		{"Without A Key", "", `{"username": "oski", "password": "bear"}`, http.StatusConflict, false},
+		{"Another Key", "key-2", `{"username": "oski", "password": "bear"}`, http.StatusConflict, false},
+		{"Retry Of A Conflict", "key-2", `{"username": "oski", "password": "bear"}`, http.StatusConflict, true},
+		{"Key Too Long", strings.Repeat("k", maxIdempotencyKeyLen+1), `{"username": "dirks", "password": "tree"}`, http.StatusBadRequest, false},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			rr := signupWith(test.Key, test.Body)
+			if rr.Code != test.ExpectedCode {
+				t.Errorf("Expected status code %d. Got %d", test.ExpectedCode, rr.Code)
+			}
+			if replayed := rr.Header().Get(replayedHeader) == "true"; replayed != test.ExpectedReplayed {
+				t.Errorf("Expected replayed to be %v. Got %v", test.ExpectedReplayed, replayed)
+			}
+		})
+	}
+	if len(UserSlice) != 1 {
+		t.Fatalf("Expected a single user. Got %v", UserSlice)
+	}
+
+	// Retries from another address are replayed, as clients often
+	// reconnect from elsewhere, but the same key with another body is
+	// handled afresh.
+	if rr := signupFrom("10.0.0.2:1000", "key-1", `{"username": "oski", "password": "bear"}`); rr.Code != http.StatusCreated || rr.Header().Get(replayedHeader) != "true" {
+		t.Fatalf("Expected a retry from another address to be replayed. Got %d %v", rr.Code, rr.Header())
+	}
+	if rr := signupFrom("10.0.0.2:1000", "key-1", `{"username": "dirks", "password": "tree"}`); rr.Code != http.StatusCreated || rr.Header().Get(replayedHeader) != "" {
+		t.Fatalf("Expected another request's key to be handled afresh. Got %d %v", rr.Code, rr.Header())
+	}
+
+	// Once the window has passed the key is handled afresh.
+	now = now.Add(IdempotencyWindow)
+	if rr := signupWith("key-1", `{"username": "oski", "password": "bear"}`); rr.Code != http.StatusConflict {
+		t.Fatalf("Expected status code %d after the window. Got %d", http.StatusConflict, rr.Code)
+	}
+}
+
+// Tests that admins' keys are their own, and can't be reused with
+// another body.
+func TestIdempotentAdminKeys(t *testing.T) {
+	defer resetIdempotency()
+	handler := idempotent(func(response http.ResponseWriter, request *http.Request) {
+		body, _ := ioutil.ReadAll(request.Body)
+		response.Write(body)
+	})
+	send := func(admin, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/batch", strings.NewReader(body))
+		req = req.WithContext(context.WithValue(req.Context(), adminKey, admin))
+		req.Header.Set(idempotencyKeyHeader, "key")
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		return rr
+	}
+
+	tests := []struct {
+		Name             string
+		Admin            string
+		Body             string
+		ExpectedCode     int
+		ExpectedReplayed bool
+	}{
+		{"First Attempt", "token", "a", http.StatusOK, false},
+		{"Retry", "token", "a", http.StatusOK, true},
+		{"Different Body", "token", "b", http.StatusUnprocessableEntity, false},
+		{"Another Admin", "CN=oski", "b", http.StatusOK, false},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			rr := send(test.Admin, test.Body)
+			if rr.Code != test.ExpectedCode {
+				t.Errorf("Expected status code %d. Got %d", test.ExpectedCode, rr.Code)
+			}
+			if replayed := rr.Header().Get(replayedHeader) == "true"; replayed != test.ExpectedReplayed {
+				t.Errorf("Expected replayed to be %v. Got %v", test.ExpectedReplayed, replayed)
+			}
+		})
+	}
+}
+
+// Tests retries sent while the first request is still being handled,
+// and retries after a server error.
+func TestIdempotentRetries(t *testing.T) {
+	defer resetIdempotency()
+
+	var calls int
+	var callsLock sync.Mutex
+	release := make(chan struct{})
+	handler := idempotent(func(response http.ResponseWriter, request *http.Request) {
+		callsLock.Lock()
+		calls++
+		call := calls
+		callsLock.Unlock()
+		if call == 1 {
+			http.Error(response, "", http.StatusInternalServerError)
+			return
+		}
+		<-release
+		response.Header().Set("Content-Type", "application/json")
+		response.WriteHeader(http.StatusCreated)
+		response.Write([]byte(`{"call":2}`))
+	})
+	send := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/signup", strings.NewReader("body"))
+		req.Header.Set(idempotencyKeyHeader, "key")
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		return rr
+	}
+
+	// Server errors aren't kept.
+	if rr := send(); rr.Code != http.StatusInternalServerError {
+		t.Fatalf("Expected status code %d. Got %d", http.StatusInternalServerError, rr.Code)
+	}
+
+	responses := make([]*httptest.ResponseRecorder, 3)
+	var wg sync.WaitGroup
+	for i := range responses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			responses[i] = send()
+		}(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 2 {
+		t.Fatalf("Expected the handler to be called twice. Got %d", calls)
+	}
+	replays := 0
+	for _, rr := range responses {
+		if rr.Code != http.StatusCreated || rr.Body.String() != `{"call":2}` || rr.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("Expected the second call's response. Got %d %q %v", rr.Code, rr.Body.String(), rr.Header())
+		}
+		if rr.Header().Get(replayedHeader) == "true" {
+			replays++
+		}
+	}
+	if replays != 2 {
+		t.Errorf("Expected 2 replayed responses. Got %d", replays)
+	}
+}
+
+// Tests that the oldest responses are dropped once too many, or too
+// many bytes of them, are kept.
+func TestIdempotentLimits(t *testing.T) {
+	defer func() {
+		IdempotencyMaxKeys, IdempotencyMaxBytes = 10000, 64<<20
+		resetIdempotency()
+	}()
+	IdempotencyMaxKeys, IdempotencyMaxBytes = 2, 1000
+
+	calls := 0
+	handler := idempotent(func(response http.ResponseWriter, request *http.Request) {
+		calls++
+		body, _ := ioutil.ReadAll(request.Body)
+		response.Write(body)
+	})
+	send := func(key, body string) bool {
+		req := httptest.NewRequest(http.MethodPost, "/api/signup", strings.NewReader(body))
+		req.Header.Set(idempotencyKeyHeader, key)
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		return rr.Header().Get(replayedHeader) == "true"
+	}
+
+	tests := []struct {
+		Name             string
+		Key              string
+		Body             string
+		ExpectedReplayed bool
+	}{
+		{"First Key", "key-1", "a", false},
+		{"Second Key", "key-2", "b", false},
+		{"Third Key Drops The First", "key-3", "c", false},
+		{"Second Key Kept", "key-2", "b", true},
+		{"First Key Dropped", "key-1", "a", false},
+		{"Large Response", "key-4", strings.Repeat("d", 870), false},
+		{"Dropped For Space", "key-1", "a", false},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			if replayed := send(test.Key, test.Body); replayed != test.ExpectedReplayed {
+				t.Errorf("Expected replayed to be %v. Got %v", test.ExpectedReplayed, replayed)
+			}
+		})
+	}
+	if len(idempotentKeys) > IdempotencyMaxKeys || idempotentBytes > IdempotencyMaxBytes || idempotentOrder.Len() != len(idempotentKeys) {
+		t.Fatalf("Expected at most %d keys and %d bytes. Got %d keys, %d in order and %d bytes",
+			IdempotencyMaxKeys, IdempotencyMaxBytes, len(idempotentKeys), idempotentOrder.Len(), idempotentBytes)
+	}
+}
+
+func resetIdempotency() {
+	idempotentKeys, idempotentOrder, idempotentBytes = map[string]*idempotentResponse{}, list.New(), 0
+}
@@ -0,0 +1,227 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/BearCloud/sp21-assignment-4/logging"
+	"github.com/gorilla/mux"
+)
+
+// LockoutThreshold is how many failed password checks in a row lock
+// an account. Zero turns lockouts off.
+var LockoutThreshold = 5
+
+// LockoutDuration is how long an account stays locked.
+var LockoutDuration = 15 * time.Minute
+
+// LockoutBackoff is how long after a failed password check the next
+// check is refused. It doubles with every failure in a row, up to
+// LockoutDuration.
+var LockoutBackoff = time.Second
+
+// The failed password checks of each user, persisted with the users.
+// Guarded by userLock.
+var lockouts = map[string]lockout{}
+
+// Replaced by tests.
+var clock = time.Now
+
+var lockoutsTotal = Metrics.NewCounter("users_lockouts_total",
+	"Accounts locked after too many failed password checks.")
+
+// The failed password checks of a single user.
+type lockout struct {
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"last_failure"`
+	LockedUntil time.Time `json:"locked_until"`
+}
+
+// Returns when the next password check will be accepted.
+func (l lockout) retryAt() time.Time {
+	if l.Failures == 0 {
+		return time.Time{}
+	}
+	backoff := LockoutBackoff
+	for i := 1; i < l.Failures && backoff < LockoutDuration; i++ {
+		backoff *= 2
+	}
+	if backoff > LockoutDuration {
+		backoff = LockoutDuration
+	}
+	retry := l.LastFailure.Add(backoff)
+	if l.LockedUntil.After(retry) {
+		return l.LockedUntil
+	}
+	return retry
+}
+
+// Returns a copy of lockouts. Callers must hold userLock.
+func copyLockouts() map[string]lockout {
+	copied := make(map[string]lockout, len(lockouts))
+	for username, l := range lockouts {
+		copied[username] = l
+	}
+	return copied
+}
+
+// VerifyPassword reports whether password is the password of the user.
+//
+// Every failure in a row makes the user wait longer before the next
+// check, and LockoutThreshold failures lock the account for
+// LockoutDuration. Checks made while waiting or locked fail without
+// counting as another failure, whether the password is right or not,
+// so callers can't tell a locked account from a wrong password.
+//
+// The store is only saved when the failed checks of the user change,
+// or always in HardenedMode.
+func VerifyPassword(ctx context.Context, username, password string) (bool, error) {
+	verified := false
+	err := update(ctx, "VerifyPassword", func() error {
+		err := checkFailures(ctx, username, password, &verified)
+		if err == errUnchanged && HardenedMode {
+			// Save anyway so the response takes as long either way.
+			return nil
+		}
+		return err
+	})
+	return verified && err == nil, err
+}
+
+// Checks the password for VerifyPassword and records the outcome,
+// returning errUnchanged if the failures of the user stay the same.
+// Callers must hold userLock.
+func checkFailures(ctx context.Context, username, password string, verified *bool) error {
+	index, err := findUser(username)
+	if err != nil {
+		countLookup(err)
+		// Take as long as for a user that exists.
+		checkPassword(dummyPassword, true, password)
+		return errUnchanged
+	}
+	if LockoutThreshold <= 0 {
+		*verified = checkPassword(UserSlice[index].Password, true, password)
+		return errUnchanged
+	}
+
+	now := clock()
+	l, failed := lockouts[username]
+	if now.Before(l.retryAt()) {
+		return errUnchanged
+	}
+	if checkPassword(UserSlice[index].Password, true, password) {
+		*verified = true
+		if !failed {
+			return errUnchanged
+		}
+		delete(lockouts, username)
+		return nil
+	}
+	l.Failures++
+	l.LastFailure = now
+	if l.Failures >= LockoutThreshold {
+		l.LockedUntil = now.Add(LockoutDuration)
+		lockoutsTotal.Inc()
+		logging.FromContext(ctx).Warn("account locked", "username", username, "until", l.LockedUntil)
+	}
+	lockouts[username] = l
+	return nil
+}
+
+// Compares passwords in constant time.
+func passwordsMatch(stored, given string) bool {
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(given)) == 1
+}
+
+// Unlock clears the failed password checks of the user.
+func Unlock(ctx context.Context, username string) error {
+	return update(ctx, "Unlock", func() error {
+		if _, err := findUser(username); err != nil {
+			return err
+		}
+		delete(lockouts, username)
+		return nil
+	})
+}
+
+// Our JSON file will look like this:
+//
+//	{
+//		"username" : <username>,
+//		"password" : <password>
+//	}
+//
+// Responds with an empty 200 OK if password is the user's password, and
+// an empty 401 Unauthorized if it isn't, the user doesn't exist or the
+// account is locked.
+func verifyPassword(response http.ResponseWriter, request *http.Request) {
+	creds, err := readJSON(request)
+	if err != nil {
+		rejectBody(response, err)
+		return
+	}
+	verified, err := VerifyPassword(request.Context(), creds.Username, creds.Password)
+	if err != nil {
+		logging.FromContext(request.Context()).Error("verifying password", "username", creds.Username, "error", err)
+		http.Error(response, "", http.StatusInternalServerError)
+	} else if !verified {
+		http.Error(response, "", http.StatusUnauthorized)
+	}
+}
+
+// The response written by getLockout.
+type lockoutStatus struct {
+	Username string `json:"username"`
+	Failures int    `json:"failures"`
+	Locked   bool   `json:"locked"`
+	// When the account unlocks, if it is locked.
+	LockedUntil *time.Time `json:"locked_until,omitempty"`
+	// When the next password check will be accepted, if it is in the future.
+	RetryAt *time.Time `json:"retry_at,omitempty"`
+}
+
+// Writes the failed password checks of the user named in the path.
+// Unknown users get 404 Not Found.
+func getLockout(response http.ResponseWriter, request *http.Request) {
+	username := mux.Vars(request)["username"]
+
+	userLock.Lock()
+	_, err := findUser(username)
+	l := lockouts[username]
+	userLock.Unlock()
+	if err != nil {
+		http.Error(response, "", http.StatusNotFound)
+		return
+	}
+
+	now := clock()
+	status := lockoutStatus{Username: username, Failures: l.Failures}
+	if l.LockedUntil.After(now) {
+		status.Locked = true
+		status.LockedUntil = &l.LockedUntil
+	}
+	if retry := l.retryAt(); retry.After(now) {
+		status.RetryAt = &retry
+	}
+	response.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(response).Encode(status)
+}
+
+// Unlocks the user named in the path, responding 204 No Content.
+// Unknown users get 404 Not Found.
+func unlockUser(response http.ResponseWriter, request *http.Request) {
+	username := mux.Vars(request)["username"]
+	err := Unlock(request.Context(), username)
+	if err == errUserNotFound {
+		http.Error(response, "", http.StatusNotFound)
+	} else if err != nil {
+		logging.FromContext(request.Context()).Error("unlocking user", "username", username, "error", err)
+		http.Error(response, "", http.StatusInternalServerError)
+	} else {
+		logging.FromContext(request.Context()).Info("user unlocked", "username", username)
+		response.WriteHeader(http.StatusNoContent)
+	}
+}
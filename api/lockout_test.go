@@ -0,0 +1,188 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Tests backing off and locking accounts after failed password checks,
+// and unlocking them again.
+func TestLockout(t *testing.T) {
+	now := time.Date(2021, 4, 1, 12, 0, 0, 0, time.UTC)
+	clock = func() time.Time { return now }
+	LockoutThreshold, LockoutDuration, LockoutBackoff = 3, time.Minute, time.Second
+	defer func() {
+		clock = time.Now
+		LockoutThreshold, LockoutDuration, LockoutBackoff = 5, 15*time.Minute, time.Second
+		lockouts = map[string]lockout{}
+	}()
+	clearGlobalSlice()
+	lockouts = map[string]lockout{}
+	UserSlice = []Credentials{{"oski", "bear"}}
+
+	routes := mux.NewRouter()
+	RegisterRoutes(routes)
+	router := asAdmin(t, routes)
+	send := func(method, endpoint, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, endpoint, strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	right := `{"username": "oski", "password": "bear"}`
+	wrong := `{"username": "oski", "password": "stanfurd"}`
+	tests := []struct {
+		Name         string
+		Wait         time.Duration
+		Body         string
+		ExpectedCode int
+	}{
+		{"Right Password", 0, right, http.StatusOK},
+		{"Unknown User", 0, `{"username": "dirks", "password": "bear"}`, http.StatusUnauthorized},
+		{"Missing Password", 0, `{"username": "oski"}`, http.StatusBadRequest},
+		{"First Failure", 0, wrong, http.StatusUnauthorized},
+		{"Right Password Too Soon", 500 * time.Millisecond, right, http.StatusUnauthorized},
+		{"Second Failure", 500 * time.Millisecond, wrong, http.StatusUnauthorized},
+		{"Backoff Doubled", time.Second, right, http.StatusUnauthorized},
+		{"Third Failure Locks", time.Second, wrong, http.StatusUnauthorized},
+		{"Right Password While Locked", 30 * time.Second, right, http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			now = now.Add(test.Wait)
+			rr := send(http.MethodPost, "/api/verify", test.Body)
+			if rr.Code != test.ExpectedCode {
+				t.Fatalf("Incorrect status code returned! Expected: %d Actual: %d", test.ExpectedCode, rr.Code)
+			}
+		})
+	}
+
+	// Locked accounts look exactly like wrong passwords.
+	locked, refused := send(http.MethodPost, "/api/verify", right), send(http.MethodPost, "/api/verify", `{"username": "oski", "password": "nope"}`)
+	if locked.Code != refused.Code || locked.Body.String() != refused.Body.String() {
+		t.Fatalf("Expected identical responses. Got %d %q and %d %q", locked.Code, locked.Body.String(), refused.Code, refused.Body.String())
+	}
+
+	// Callers without the admin token can't see or clear it.
+	for _, method := range []string{http.MethodGet, http.MethodDelete} {
+		rr := httptest.NewRecorder()
+		routes.ServeHTTP(rr, httptest.NewRequest(method, "/api/v1/users/oski/lockout", nil))
+		if rr.Code != http.StatusUnauthorized {
+			t.Fatalf("Incorrect status code returned! Expected: %d Actual: %d", http.StatusUnauthorized, rr.Code)
+		}
+	}
+
+	// Admins can see the lockout.
+	rr := send(http.MethodGet, "/api/v1/users/oski/lockout", "")
+	var status lockoutStatus
+	if err := json.NewDecoder(rr.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if !status.Locked || status.Failures != 3 || status.LockedUntil == nil || !status.LockedUntil.Equal(now.Add(30*time.Second)) {
+		t.Fatalf("Unexpected lockout status %+v", status)
+	}
+	if rr := send(http.MethodGet, "/api/v1/users/dirks/lockout", ""); rr.Code != http.StatusNotFound {
+		t.Fatalf("Incorrect status code returned! Expected: %d Actual: %d", http.StatusNotFound, rr.Code)
+	}
+
+	// Locks expire, and the next failure locks the account again.
+	now = now.Add(31 * time.Second)
+	if rr := send(http.MethodPost, "/api/verify", wrong); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("Incorrect status code returned! Expected: %d Actual: %d", http.StatusUnauthorized, rr.Code)
+	}
+	if !lockouts["oski"].LockedUntil.After(now) {
+		t.Fatal("Expected the account to be locked again.")
+	}
+
+	// Admins can unlock accounts.
+	if rr := send(http.MethodDelete, "/api/v1/users/oski/lockout", ""); rr.Code != http.StatusNoContent {
+		t.Fatalf("Incorrect status code returned! Expected: %d Actual: %d", http.StatusNoContent, rr.Code)
+	}
+	if rr := send(http.MethodDelete, "/api/v1/users/dirks/lockout", ""); rr.Code != http.StatusNotFound {
+		t.Fatalf("Incorrect status code returned! Expected: %d Actual: %d", http.StatusNotFound, rr.Code)
+	}
+	if rr := send(http.MethodPost, "/api/verify", right); rr.Code != http.StatusOK {
+		t.Fatalf("Incorrect status code returned! Expected: %d Actual: %d", http.StatusOK, rr.Code)
+	}
+	rr = send(http.MethodGet, "/api/v1/users/oski/lockout", "")
+	if strings.TrimSpace(rr.Body.String()) != `{"username":"oski","failures":0,"locked":false}` {
+		t.Fatalf("Expected a clean lockout status. Got %s", rr.Body.String())
+	}
+}
+
+// Tests that failed password checks are stored with the users, and
+// that old store files are migrated.
+func TestLockoutStore(t *testing.T) {
+	defer func() {
+		StorePath, diskFormat = "", storeFormat
+		lockouts = map[string]lockout{}
+	}()
+	clearGlobalSlice()
+
+	// Version 1 stores had no lockouts.
+	path := filepath.Join(t.TempDir(), "users.json")
+	if err := ioutil.WriteFile(path, []byte(`{"version": 1, "users": [{"username": "oski", "password": "bear"}]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := OpenStore(path); err != nil {
+		t.Fatal(err)
+	}
+	file, version, err := readStore(path)
+	if err != nil || version != storeFormat || file.Lockouts == nil || len(file.Users) != 1 {
+		t.Fatalf("Expected the store to be migrated. Got %+v %d %v", file, version, err)
+	}
+
+	// Failures are persisted, and forgotten with the user.
+	if ok, err := VerifyPassword(context.Background(), "oski", "stanfurd"); ok || err != nil {
+		t.Fatalf("Expected the check to fail. Got %v %v", ok, err)
+	}
+	file, _, _ = readStore(path)
+	if file.Lockouts["oski"].Failures != 1 {
+		t.Fatalf("Expected a stored failure. Got %+v", file.Lockouts)
+	}
+	lockouts = nil
+	if err := LoadUsers(path); err != nil || lockouts["oski"].Failures != 1 {
+		t.Fatalf("Expected the failure to be loaded. Got %+v %v", lockouts, err)
+	}
+	if err := RemoveUser(context.Background(), "oski"); err != nil {
+		t.Fatal(err)
+	}
+	file, _, _ = readStore(path)
+	if len(file.Lockouts) != 0 {
+		t.Fatalf("Expected the failure to be removed with the user. Got %+v", file.Lockouts)
+	}
+
+	// Checks that don't change the failures leave the file alone.
+	if err := AddUser(context.Background(), Credentials{"dirks", "hoshjug"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := VerifyPassword(context.Background(), "dirks", "hoshjug"); !ok || err != nil {
+		t.Fatalf("Expected the check to pass. Got %v %v", ok, err)
+	}
+	if ok, err := VerifyPassword(context.Background(), "oski", "bear"); ok || err != nil {
+		t.Fatalf("Expected the check to fail. Got %v %v", ok, err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("Expected the store not to be saved. Got %v", err)
+	}
+	if ok, err := VerifyPassword(context.Background(), "dirks", "stanfurd"); ok || err != nil {
+		t.Fatalf("Expected the check to fail. Got %v %v", ok, err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("Expected the failure to be saved. Got %v", err)
+	}
+}
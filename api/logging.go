@@ -0,0 +1,99 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/BearCloud/sp21-assignment-4/logging"
+	"github.com/gorilla/mux"
+)
+
+// The header carrying the ID of each request.
+const requestIDHeader = "X-Request-ID"
+
+// Incoming request IDs longer than this are replaced.
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+// RequestIDFromContext returns the ID given to the request being served.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// Gives every request an ID and a logger, then writes an access log
+// line once it has been served.
+//
+// The ID is taken from the X-Request-ID header when the client sent a
+// sensible one and generated otherwise. Either way it is echoed back in
+// the response and added to every line logged through the request's
+// context. Handlers log with logging.FromContext(request.Context()).
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		id := request.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		response.Header().Set(requestIDHeader, id)
+
+		logger := logging.Default().With("request_id", id)
+		ctx := context.WithValue(request.Context(), requestIDKey{}, id)
+		ctx = context.WithValue(ctx, clientKey{}, clientIP(request))
+		request = request.WithContext(logging.NewContext(ctx, logger))
+
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: response}
+		next.ServeHTTP(recorder, request)
+
+		logger.Info("request",
+			"method", request.Method,
+			"route", routeTemplate(request),
+			"status", recorder.Status(),
+			"bytes", recorder.written,
+			"duration_ms", float64(time.Since(start).Microseconds())/1000,
+			"remote_addr", request.RemoteAddr,
+		)
+	})
+}
+
+// Returns the template of the route serving request, such as
+// /api/v1/users/{username}, or "unknown" if no route matched.
+func routeTemplate(request *http.Request) string {
+	if current := mux.CurrentRoute(request); current != nil {
+		if template, err := current.GetPathTemplate(); err == nil {
+			return template
+		}
+	}
+	return "unknown"
+}
+
+// Accepts IDs made of printable ASCII without spaces or quotes so they
+// can't forge log lines or headers.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' || c == '"' || c == '\\' {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns 16 random bytes in hex.
+func newRequestID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// Responds 405 Method Not Allowed. Used for requests whose path
+// matches a route but whose method doesn't.
+func methodNotAllowed(response http.ResponseWriter, request *http.Request) {
+	http.Error(response, "", http.StatusMethodNotAllowed)
+}
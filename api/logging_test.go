@@ -0,0 +1,107 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/BearCloud/sp21-assignment-4/logging"
+	"github.com/gorilla/mux"
+)
+
+// Tests request IDs and the access log.
+func TestLogRequests(t *testing.T) {
+	var logs bytes.Buffer
+	old := logging.Default()
+	logging.SetDefault(logging.New(&logs, logging.LevelDebug))
+	defer logging.SetDefault(old)
+	clearGlobalSlice()
+
+	router := mux.NewRouter()
+	RegisterRoutes(router)
+
+	tests := []struct {
+		Name         string
+		Method       string
+		Endpoint     string
+		Body         string
+		RequestID    string
+		ExpectedCode int
+		ExpectedID   string
+		Route        string
+	}{
+		{"Generated ID", http.MethodPost, "/api/signup", `{"username": "oski", "password": "hunter2"}`, "", http.StatusCreated, "", "/api/signup"},
+		{"Propagated ID", http.MethodPut, "/api/updatePW", `{"username": "oski", "password": "hunter3"}`, "abc-123", http.StatusOK, "abc-123", "/api/updatePW"},
+		{"Forged ID", http.MethodGet, "/api/getQuery", "", "bad\"id", http.StatusOK, "", "/api/getQuery"},
+		{"Not Found", http.MethodGet, "/nowhere", "", "lost", http.StatusNotFound, "lost", "unknown"},
+		{"Wrong Method", http.MethodGet, "/api/signup", "", "", http.StatusMethodNotAllowed, "", "unknown"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			logs.Reset()
+			req := httptest.NewRequest(test.Method, test.Endpoint, strings.NewReader(test.Body))
+			if test.RequestID != "" {
+				req.Header.Set(requestIDHeader, test.RequestID)
+			}
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != test.ExpectedCode {
+				t.Fatalf("Incorrect status code returned! Expected: %d Actual: %d", test.ExpectedCode, rr.Code)
+			}
+			id := rr.Header().Get(requestIDHeader)
+			if test.ExpectedID != "" && id != test.ExpectedID {
+				t.Fatalf("Expected request ID %q. Got %q", test.ExpectedID, id)
+			}
+			if test.ExpectedID == "" && len(id) != 32 {
+				t.Fatalf("Expected a generated request ID. Got %q", id)
+			}
+
+			// Passwords never reach the logs.
+			if strings.Contains(logs.String(), "hunter") {
+				t.Fatalf("Password logged: %s", logs.String())
+			}
+
+			// Every line carries the request ID and the last is the access log.
+			lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+			var access map[string]interface{}
+			for _, line := range lines {
+				access = nil
+				if err := json.Unmarshal([]byte(line), &access); err != nil {
+					t.Fatal(err)
+				}
+				if access["request_id"] != id {
+					t.Fatalf("Expected request ID %q on %s", id, line)
+				}
+			}
+			if access["msg"] != "request" || access["method"] != test.Method || access["route"] != test.Route ||
+				access["status"] != float64(test.ExpectedCode) || access["remote_addr"] != req.RemoteAddr {
+				t.Fatalf("Unexpected access log %v", access)
+			}
+			if _, ok := access["duration_ms"]; !ok {
+				t.Fatalf("Expected a duration in %v", access)
+			}
+			if access["bytes"] != float64(rr.Body.Len()) {
+				t.Fatalf("Expected %d bytes in %v", rr.Body.Len(), access)
+			}
+		})
+	}
+}
+
+// Tests that credentials never print their password.
+func TestCredentialsRedacted(t *testing.T) {
+	creds := Credentials{"oski", "hunter2"}
+	for _, format := range []string{"%v", "%+v", "%#v", "%s"} {
+		if out := fmt.Sprintf(format, creds); strings.Contains(out, "hunter2") || !strings.Contains(out, "oski") {
+			t.Fatalf("Sprintf(%q) = %q", format, out)
+		}
+	}
+	if out := fmt.Sprint(&creds, []Credentials{creds}); strings.Contains(out, "hunter2") {
+		t.Fatalf("Sprint = %q", out)
+	}
+}
@@ -0,0 +1,127 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/BearCloud/sp21-assignment-4/metrics"
+)
+
+// Metrics holds everything served on /metrics. Other packages may add
+// their own metrics to it.
+var Metrics = metrics.NewRegistry()
+
+var (
+	requestsTotal = Metrics.NewCounter("http_requests_total",
+		"HTTP requests served, by method, route template and status code class.",
+		"method", "route", "code")
+	requestDuration = Metrics.NewHistogram("http_request_duration_seconds",
+		"Time taken to serve HTTP requests, by method and route template.",
+		metrics.DefBuckets, "method", "route")
+
+	signupsTotal = Metrics.NewCounter("users_signups_total",
+		"Users added by signup, import or batch.")
+	conflictsTotal = Metrics.NewCounter("users_signup_conflicts_total",
+		"Attempts to add a user whose username was already taken.")
+	lookupFailuresTotal = Metrics.NewCounter("users_lookup_failures_total",
+		"Requests naming a user that does not exist.")
+)
+
+func init() {
+	Metrics.NewGaugeFunc("users", "Users currently in the store.", func() float64 {
+		userLock.Lock()
+		defer userLock.Unlock()
+		return float64(len(UserSlice))
+	})
+}
+
+// Records the count and latency of every request that matches a route.
+// Requests are labelled with the route's template rather than the raw
+// path so that path variables don't create a series each.
+func recordMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		route := routeTemplate(request)
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: response}
+		next.ServeHTTP(recorder, request)
+
+		requestsTotal.Inc(request.Method, route, statusClass(recorder.Status()))
+		requestDuration.Observe(time.Since(start).Seconds(), request.Method, route)
+	})
+}
+
+// Returns "2xx" for 200 and so on.
+func statusClass(code int) string {
+	return strconv.Itoa(code/100) + "xx"
+}
+
+// Counts signups once they have been written to the store, so changes
+// that are rolled back aren't counted. Conflicts are counted by callers
+// once they report them.
+func countUserEvent(ctx context.Context, event UserEvent) {
+	if event.Type == EventUserCreated {
+		signupsTotal.Inc()
+	}
+}
+
+// Counts a lookup of a user that doesn't exist.
+func countLookup(err error) {
+	if err == errUserNotFound {
+		lookupFailuresTotal.Inc()
+	}
+}
+
+// Serves the Prometheus text format.
+func serveMetrics(response http.ResponseWriter, request *http.Request) {
+	Metrics.Handler().ServeHTTP(response, request)
+}
+
+// Wraps a ResponseWriter to remember the status code and how many
+// bytes of body were written to it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(p)
+	r.written += int64(n)
+	return n, err
+}
+
+// Flush lets streaming handlers such as exportUsers keep working.
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		if r.status == 0 {
+			r.status = http.StatusOK
+		}
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the connection.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// Status returns the status code written, or 200 if the handler
+// never wrote one.
+func (r *statusRecorder) Status() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
@@ -0,0 +1,89 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// Tests that requests are counted by route template and that store
+// metrics follow signups, conflicts and failed lookups.
+func TestMetrics(t *testing.T) {
+	clearGlobalSlice()
+	router := mux.NewRouter()
+	RegisterRoutes(router)
+	router.HandleFunc("/api/v1/users/{username}", func(w http.ResponseWriter, r *http.Request) {}).Methods(http.MethodGet)
+
+	send := func(method, endpoint, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, endpoint, bytes.NewBufferString(body))
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	signups := signupsTotal.Value()
+	conflicts := conflictsTotal.Value()
+	lookups := lookupFailuresTotal.Value()
+	created := requestsTotal.Value(http.MethodPost, "/api/signup", "2xx")
+	rejected := requestsTotal.Value(http.MethodPost, "/api/signup", "4xx")
+	templated := requestDuration.Count(http.MethodGet, "/api/v1/users/{username}")
+
+	// Sign up once, conflict once and look up a missing user.
+	send(http.MethodPost, "/api/signup", `{"username": "oski", "password": "bear"}`)
+	send(http.MethodPost, "/api/signup", `{"username": "oski", "password": "bear"}`)
+	send(http.MethodGet, "/api/getPW", `{"username": "stanfurd"}`)
+	send(http.MethodGet, "/api/v1/users/oski", "")
+	send(http.MethodGet, "/api/v1/users/dirks", "")
+
+	if signupsTotal.Value()-signups != 1 || conflictsTotal.Value()-conflicts != 1 || lookupFailuresTotal.Value()-lookups != 1 {
+		t.Fatalf("Incorrect store counters! signups %v conflicts %v lookups %v",
+			signupsTotal.Value()-signups, conflictsTotal.Value()-conflicts, lookupFailuresTotal.Value()-lookups)
+	}
+	if requestsTotal.Value(http.MethodPost, "/api/signup", "2xx")-created != 1 || requestsTotal.Value(http.MethodPost, "/api/signup", "4xx")-rejected != 1 {
+		t.Fatal("Incorrect request counts for /api/signup.")
+	}
+	// Both users share the route template.
+	if requestDuration.Count(http.MethodGet, "/api/v1/users/{username}")-templated != 2 {
+		t.Fatal("Expected requests to be labelled with the route template.")
+	}
+
+	// The scrape includes the user count.
+	rr := send(http.MethodGet, "/metrics", "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Incorrect status code returned! Expected: %d Actual: %d", http.StatusOK, rr.Code)
+	}
+	for _, line := range []string{"\nusers 1\n", `http_requests_total{method="POST",route="/api/signup",code="2xx"}`, "# TYPE http_request_duration_seconds histogram"} {
+		if !strings.Contains(rr.Body.String(), line) {
+			t.Fatalf("Expected %q in the metrics. Got:\n%s", line, rr.Body.String())
+		}
+	}
+}
+
+// Tests that signups are only counted once they have been written to
+// the store.
+func TestSignupMetricsRollback(t *testing.T) {
+	clearGlobalSlice()
+	UserSlice = append(UserSlice, Credentials{"oski", "bear"})
+	signups, conflicts := signupsTotal.Value(), conflictsTotal.Value()
+
+	// The atomic batch is rolled back because oski is taken.
+	body := `{"operations": [{"op": "signup", "username": "dirks", "password": "tree"}, {"op": "signup", "username": "oski", "password": "bear"}]}`
+	batch(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/api/v1/batch", strings.NewReader(body)))
+
+	// The store can't be written.
+	StorePath = filepath.Join(t.TempDir(), "missing", "users.json")
+	defer func() { StorePath = "" }()
+	if err := AddUser(context.Background(), Credentials{"stanfurd", "tree"}); err == nil {
+		t.Fatal("Expected writing the store to fail.")
+	}
+
+	if signupsTotal.Value() != signups || conflictsTotal.Value()-conflicts != 1 {
+		t.Fatalf("Expected no signups and 1 conflict. Got %v and %v", signupsTotal.Value()-signups, conflictsTotal.Value()-conflicts)
+	}
+}
@@ -0,0 +1,129 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// The formats responses can be written in, in order of preference when
+// a client accepts several equally. Plain text comes first so clients
+// that send no Accept header, or accept anything, get what they always
+// have.
+var responseFormats = []string{"text/plain", formatJSON, formatMsgpack, formatForm}
+
+// The errors returned by negotiate.
+var errNotAcceptable = errors.New("Not Acceptable")
+
+// Writes a successful response in the format the request's Accept
+// header prefers. text is the plain text body, and value, a struct with
+// json tags, is encoded for every other format. Clients accepting none
+// of responseFormats get 406 Not Acceptable.
+func writeResponse(response http.ResponseWriter, request *http.Request, text string, value interface{}) {
+	response.Header().Add("Vary", "Accept")
+	format, err := negotiate(request.Header.Get("Accept"))
+	if err != nil {
+		http.Error(response, "", http.StatusNotAcceptable)
+		return
+	}
+
+	var body []byte
+	switch format {
+	case formatJSON:
+		body, err = json.Marshal(value)
+	case formatMsgpack:
+		var buf bytes.Buffer
+		encoder := msgpack.NewEncoder(&buf)
+		encoder.SetCustomStructTag("json")
+		err = encoder.Encode(value)
+		body = buf.Bytes()
+	case formatForm:
+		body, err = encodeForm(value)
+	default:
+		format, body = defaultContentType, []byte(text)
+	}
+	if err != nil {
+		http.Error(response, "", http.StatusInternalServerError)
+		return
+	}
+	response.Header().Set("Content-Type", format)
+	response.Write(body)
+}
+
+// Picks the format from responseFormats with the highest quality in
+// accept. More specific media ranges in accept take precedence over
+// wildcards, as described in RFC 9110.
+func negotiate(accept string) (string, error) {
+	if strings.TrimSpace(accept) == "" {
+		return responseFormats[0], nil
+	}
+
+	type mediaRange struct {
+		mediaType string
+		quality   float64
+	}
+	var ranges []mediaRange
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		quality := 1.0
+		if q, ok := params["q"]; ok {
+			if quality, err = strconv.ParseFloat(q, 64); err != nil {
+				continue
+			}
+		}
+		ranges = append(ranges, mediaRange{mediaType, quality})
+	}
+	// Exact types first, then type/*, then */*.
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return strings.Count(ranges[i].mediaType, "*") < strings.Count(ranges[j].mediaType, "*")
+	})
+
+	best, bestQuality := "", 0.0
+	for _, format := range responseFormats {
+		for _, r := range ranges {
+			major := strings.SplitN(format, "/", 2)[0] + "/*"
+			if r.mediaType == format || r.mediaType == major || r.mediaType == "*/*" ||
+				(format == formatMsgpack && r.mediaType == "application/x-msgpack") {
+				if r.quality > bestQuality {
+					best, bestQuality = format, r.quality
+				}
+				break
+			}
+		}
+	}
+	if best == "" {
+		return "", errNotAcceptable
+	}
+	return best, nil
+}
+
+// Encodes the fields of value as form fields named by their json tags.
+func encodeForm(value interface{}) ([]byte, error) {
+	asJSON, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(asJSON))
+	decoder.UseNumber()
+	if err := decoder.Decode(&fields); err != nil {
+		return nil, err
+	}
+	form := url.Values{}
+	for name, field := range fields {
+		form.Set(name, fmt.Sprint(field))
+	}
+	return []byte(form.Encode()), nil
+}
@@ -0,0 +1,104 @@
+package api
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Tests picking a response format from an Accept header.
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		Accept   string
+		Expected string
+	}{
+		{"", "text/plain"},
+		{"*/*", "text/plain"},
+		{"text/html,application/xhtml+xml,*/*;q=0.8", "text/plain"},
+		{"application/json", formatJSON},
+		{"application/json;q=0.5, application/msgpack", formatMsgpack},
+		{"application/x-msgpack", formatMsgpack},
+		{"application/*", formatJSON},
+		{"application/*;q=0.9, application/json;q=0.1", formatMsgpack},
+		{"*/*;q=0.1, text/plain;q=0", formatJSON},
+		{"application/x-www-form-urlencoded, text/plain;q=0.5", formatForm},
+		{"image/png", ""},
+	}
+	for _, test := range tests {
+		actual, err := negotiate(test.Accept)
+		if test.Expected == "" && err != errNotAcceptable {
+			t.Errorf("Expected %q to be not acceptable. Got %q", test.Accept, actual)
+		} else if actual != test.Expected {
+			t.Errorf("Expected %q for %q. Got %q", test.Expected, test.Accept, actual)
+		}
+	}
+}
+
+// Tests sending requests and getting responses in every format.
+func TestContentNegotiation(t *testing.T) {
+	clearGlobalSlice()
+	UserSlice = []Credentials{{"oski", "bear"}, {"dirks", "tree"}}
+	router := mux.NewRouter()
+	RegisterRoutes(router)
+
+	packed, err := msgpack.Marshal(map[string]string{"username": "dirks"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedPacked, err := msgpack.Marshal(map[string]string{"password": "tree"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		Name         string
+		Endpoint     string
+		ContentType  string
+		Accept       string
+		Body         string
+		ExpectedCode int
+		ExpectedType string
+		ExpectedBody string
+	}{
+		{"Legacy", "/api/getIndex", "", "", `{"username": "dirks"}`, http.StatusOK, defaultContentType, "1"},
+		{"JSON", "/api/getIndex", formatJSON, formatJSON, `{"username": "dirks"}`, http.StatusOK, formatJSON, `{"index":1}`},
+		{"Form", "/api/getIndex", formatForm, formatForm, "username=dirks", http.StatusOK, formatForm, "index=1"},
+		{"Form To JSON", "/api/getJSON", formatForm, formatJSON, "username=oski&password=bear", http.StatusOK, formatJSON, `{"username":"oski","password":"bear"}`},
+		{"Repeated Form Field", "/api/getIndex", formatForm, "", "username=dirks&username=oski", http.StatusBadRequest, defaultContentType, ""},
+		{"MessagePack", "/api/getPW", formatMsgpack, formatMsgpack, string(packed), http.StatusOK, formatMsgpack, string(expectedPacked)},
+		{"MessagePack With Trailing Data", "/api/getPW", formatMsgpack, "", string(packed) + "x", http.StatusBadRequest, defaultContentType, ""},
+		{"Query As JSON", "/api/getQuery?userID=40", "", formatJSON, "", http.StatusOK, formatJSON, `{"userID":"40"}`},
+		{"Not Acceptable", "/api/getIndex", "", "image/png", `{"username": "dirks"}`, http.StatusNotAcceptable, defaultContentType, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, test.Endpoint, strings.NewReader(test.Body))
+			if test.ContentType != "" {
+				req.Header.Set("Content-Type", test.ContentType)
+			}
+			if test.Accept != "" {
+				req.Header.Set("Accept", test.Accept)
+			}
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			if err := checkStatusCodeAndBody(test.ExpectedCode, rr.Code, test.ExpectedBody, rr.Body.String()); err != nil {
+				t.Error(err)
+			}
+			if contentType := rr.Header().Get("Content-Type"); contentType != test.ExpectedType {
+				t.Errorf("Expected Content-Type %q. Got %q", test.ExpectedType, contentType)
+			}
+		})
+	}
+
+	// Usernames in other formats are still rate limited.
+	req := httptest.NewRequest(http.MethodGet, "/api/getPW", bytes.NewReader(packed))
+	req.Header.Set("Content-Type", "application/x-msgpack")
+	if username, err := peekUsername(req); err != nil || username != "dirks" {
+		t.Errorf("Expected to find the username dirks. Got %q and %v", username, err)
+	}
+}
@@ -0,0 +1,138 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/BearCloud/sp21-assignment-4/logging"
+	"github.com/BearCloud/sp21-assignment-4/ratelimit"
+)
+
+// RateLimits lists the limits applied to each route. Routes without a
+// rule aren't limited.
+var RateLimits []ratelimit.Rule
+
+// RateLimitStore keeps the buckets used by RateLimits. Replace it with
+// a ratelimit.RemoteStore to share limits between servers.
+var RateLimitStore ratelimit.Store = ratelimit.NewMemoryStore()
+
+var rateLimitedTotal = Metrics.NewCounter("http_rate_limited_total",
+	"Requests refused by a rate limit, by route template and key.",
+	"route", "key")
+
+// Applies RateLimits, responding 429 Too Many Requests with a
+// Retry-After header once a client or username has used up its limit
+// for a route.
+//
+// Usernames are read from the JSON body, which is put back for the
+// handler. Username rules are checked before IP rules, so a request
+// refused for its username doesn't use up its client's limit. If the
+// store can't be reached requests are let through rather than taking
+// the whole server down with it. CORS preflights aren't limited, as
+// browsers send them before the requests that are.
+func rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if isPreflight(request) {
+			next.ServeHTTP(response, request)
+			return
+		}
+		route := routeTemplate(request)
+		var rules, ipRules []ratelimit.Rule
+		for _, rule := range RateLimits {
+			if rule.Route == route && rule.Key == "ip" {
+				ipRules = append(ipRules, rule)
+			} else if rule.Route == route {
+				rules = append(rules, rule)
+			}
+		}
+		rules = append(rules, ipRules...)
+		if len(rules) == 0 {
+			next.ServeHTTP(response, request)
+			return
+		}
+
+		var username string
+		var usernameRead bool
+		for _, rule := range rules {
+			var key string
+			switch rule.Key {
+			case "ip":
+				key = clientIP(request)
+			case "username":
+				if !usernameRead {
+					var err error
+					if username, err = peekUsername(request); err != nil {
+						rejectBody(response, err)
+						return
+					}
+					usernameRead = true
+				}
+				key = username
+			}
+			if key == "" {
+				continue
+			}
+
+			result, err := RateLimitStore.Take(request.Context(), rule.Key+":"+route+":"+key, rule.Limit)
+			if err != nil {
+				logging.FromContext(request.Context()).Warn("checking rate limit", "rule", rule.String(), "error", err)
+				continue
+			}
+			if !result.Allowed {
+				rateLimitedTotal.Inc(route, rule.Key)
+				seconds := int(math.Ceil(result.RetryAfter.Seconds()))
+				if seconds < 1 {
+					seconds = 1
+				}
+				response.Header().Set("Retry-After", strconv.Itoa(seconds))
+				http.Error(response, "", http.StatusTooManyRequests)
+				return
+			}
+		}
+		next.ServeHTTP(response, request)
+	})
+}
+
+// Returns the IP address the request came from.
+func clientIP(request *http.Request) string {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return request.RemoteAddr
+	}
+	return host
+}
+
+// Returns the username in the request body, or "" if there isn't one,
+// leaving the body to be read again by the handler. Bodies over their
+// limit give errBodyTooLarge, as they do for decodeBody.
+func peekUsername(request *http.Request) (string, error) {
+	if request.Body == nil {
+		return "", nil
+	}
+	body, err := ioutil.ReadAll(request.Body)
+	request.Body.Close()
+	if errors.Is(err, errBodyTooLarge) {
+		return "", errBodyTooLarge
+	} else if err != nil {
+		return "", errBadBody
+	}
+	// Keep the limitedBody wrapper, so the handler reads the body the
+	// same way it would have.
+	replay := ioutil.NopCloser(bytes.NewReader(body))
+	if limited, ok := request.Body.(*limitedBody); ok {
+		limited.ReadCloser, limited.read = replay, 0
+	} else {
+		request.Body = replay
+	}
+
+	var creds Credentials
+	if format, ok := bodyFormat(request); ok {
+		decodeBytes(format, body, &creds)
+	}
+	return creds.Username, nil
+}
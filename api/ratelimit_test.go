@@ -0,0 +1,104 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/BearCloud/sp21-assignment-4/ratelimit"
+	"github.com/gorilla/mux"
+)
+
+// A rate limit store that can't be reached.
+type brokenStore struct{}
+
+func (brokenStore) Take(ctx context.Context, key string, limit ratelimit.Limit) (ratelimit.Result, error) {
+	return ratelimit.Result{}, errors.New("unreachable")
+}
+
+// Tests limiting routes by client IP and by username.
+func TestRateLimit(t *testing.T) {
+	defer func() { RateLimits, RateLimitStore = nil, ratelimit.NewMemoryStore() }()
+	RateLimits = nil
+	for _, spec := range []string{"ip:/api/signup=2/m", "ip:/api/getPW=2/m", "username:/api/getPW=2/m"} {
+		rule, err := ratelimit.ParseRule(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		RateLimits = append(RateLimits, rule)
+	}
+	RateLimitStore = ratelimit.NewMemoryStore()
+	clearGlobalSlice()
+	UserSlice = []Credentials{{"oski", "bear"}, {"dirks", "hoshjug"}}
+
+	router := mux.NewRouter()
+	RegisterRoutes(router)
+
+	tests := []struct {
+		Name         string
+		Method       string
+		Endpoint     string
+		Body         string
+		RemoteAddr   string
+		ExpectedCode int
+		ExpectedBody string
+	}{
+		{"First Signup", http.MethodPost, "/api/signup", `{"username": "a", "password": "a"}`, "10.0.0.1:1000", http.StatusCreated, ""},
+		{"Second Signup", http.MethodPost, "/api/signup", `{"username": "b", "password": "b"}`, "10.0.0.1:1001", http.StatusCreated, ""},
+		{"Third Signup", http.MethodPost, "/api/signup", `{"username": "c", "password": "c"}`, "10.0.0.1:1002", http.StatusTooManyRequests, "\n"},
+		{"Another Client", http.MethodPost, "/api/signup", `{"username": "c", "password": "c"}`, "10.0.0.2:1000", http.StatusCreated, ""},
+		{"First Guess", http.MethodGet, "/api/getPW", `{"username": "oski"}`, "10.0.0.3:1000", http.StatusOK, "bear"},
+		{"Second Guess", http.MethodGet, "/api/getPW", `{"username": "oski"}`, "10.0.0.4:1000", http.StatusOK, "bear"},
+		{"Third Guess From Elsewhere", http.MethodGet, "/api/getPW", `{"username": "oski"}`, "10.0.0.5:1000", http.StatusTooManyRequests, "\n"},
+		{"Another Username", http.MethodGet, "/api/getPW", `{"username": "dirks"}`, "10.0.0.5:1000", http.StatusOK, "hoshjug"},
+		// The refused guess didn't use up the client's limit.
+		{"Same Client Again", http.MethodGet, "/api/getPW", `{"username": "dirks"}`, "10.0.0.5:1001", http.StatusOK, "hoshjug"},
+		{"Unlimited Route", http.MethodGet, "/api/getQuery?userID=1", "", "10.0.0.1:1003", http.StatusOK, "1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			req := httptest.NewRequest(test.Method, test.Endpoint, strings.NewReader(test.Body))
+			req.RemoteAddr = test.RemoteAddr
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != test.ExpectedCode {
+				t.Fatalf("Incorrect status code returned! Expected: %d Actual: %d", test.ExpectedCode, rr.Code)
+			}
+			if rr.Body.String() != test.ExpectedBody {
+				t.Fatalf("Incorrect body returned! Expected: %q Actual: %q", test.ExpectedBody, rr.Body.String())
+			}
+			// Limits of 2 a minute refill a token every 30 seconds.
+			if rr.Code == http.StatusTooManyRequests && rr.Header().Get("Retry-After") != "30" {
+				t.Fatalf("Expected Retry-After 30. Got %q", rr.Header().Get("Retry-After"))
+			}
+		})
+	}
+
+	// Bodies too large to read a username from are refused the same way
+	// handlers refuse them, even without a Content-Length.
+	BodyLimits["/api/getPW"] = 16
+	defer delete(BodyLimits, "/api/getPW")
+	req := httptest.NewRequest(http.MethodGet, "/api/getPW", ioutil.NopCloser(strings.NewReader(`{"username": "oski", "padding": "..."}`)))
+	req.RemoteAddr = "10.0.0.6:1000"
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("Incorrect status code returned! Expected: %d Actual: %d", http.StatusRequestEntityTooLarge, rr.Code)
+	}
+
+	// Requests are let through when the store is down.
+	RateLimitStore = brokenStore{}
+	req = httptest.NewRequest(http.MethodPost, "/api/signup", strings.NewReader(`{"username": "d", "password": "d"}`))
+	req.RemoteAddr = "10.0.0.1:1004"
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Incorrect status code returned! Expected: %d Actual: %d", http.StatusCreated, rr.Code)
+	}
+}
@@ -0,0 +1,454 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/BearCloud/sp21-assignment-4/tracing"
+)
+
+// storeFormat is the version written to store files by SaveUsers.
+const storeFormat = 3
+
+// Upgrades store files written by older versions of the server.
+// migrations[v] turns a store file in format v into format v+1.
+var migrations = map[int]func(file map[string]json.RawMessage) error{
+	// Version 2 added failed password checks. See api/lockout.go.
+	1: func(file map[string]json.RawMessage) error {
+		file["lockouts"] = json.RawMessage("{}")
+		return nil
+	},
+	// Version 3 added user versions. See api/etag.go.
+	2: func(file map[string]json.RawMessage) error {
+		file["versions"] = json.RawMessage("{}")
+		file["last_version"] = json.RawMessage("0")
+		return nil
+	},
+}
+
+// The format of the store file at StorePath. It is behind storeFormat
+// from when an old store is opened until it has been written back.
+var diskFormat = storeFormat
+
+// The errors returned by the user store functions below.
+var (
+	errUserExists   = errors.New("User Already Exists")
+	errUserNotFound = errors.New("User Not Found")
+	errStoreClosed  = errors.New("Store Closed")
+)
+
+// Guards UserSlice so the handlers can be called from several
+// goroutines at once, as net/http does.
+var userLock sync.Mutex
+
+// Set by CloseStore. Once closed, every change to the users fails.
+var storeClosed bool
+
+// StorePath is the file users are persisted to after every change.
+// When it is empty users only live in memory.
+var StorePath string
+
+// The layout of a store file on disk.
+type storeFile struct {
+	Version     int                `json:"version"`
+	Users       []Credentials      `json:"users"`
+	Lockouts    map[string]lockout `json:"lockouts"`
+	Versions    map[string]uint64  `json:"versions"`
+	LastVersion uint64             `json:"last_version"`
+}
+
+// AddUser appends a new user to the global slice, failing if a user
+// with the same username already exists.
+func AddUser(ctx context.Context, creds Credentials) error {
+	err := update(ctx, "AddUser", func() error { return addUser(creds) })
+	if err == errUserExists {
+		conflictsTotal.Inc()
+	}
+	return err
+}
+
+// SetPassword replaces the password of an existing user.
+func SetPassword(ctx context.Context, username, password string) error {
+	return update(ctx, "SetPassword", func() error { return setPassword(username, password) })
+}
+
+// RemoveUser deletes an existing user from the global slice.
+func RemoveUser(ctx context.Context, username string) error {
+	return update(ctx, "RemoveUser", func() error { return removeUser(username) })
+}
+
+// LookupUser returns the index, password and version of an existing
+// user.
+func LookupUser(ctx context.Context, username string) (int, string, uint64, error) {
+	_, span := tracing.Start(ctx, "store.LookupUser", tracing.KindInternal)
+	defer span.End()
+
+	userLock.Lock()
+	defer userLock.Unlock()
+	index, err := findUser(username)
+	if err != nil {
+		span.SetError(err)
+		return index, "", 0, err
+	}
+	return index, UserSlice[index].Password, versionOf(username), nil
+}
+
+// Returned by a change passed to update that left the store as it was,
+// so there's nothing to persist. update returns nil for it.
+var errUnchanged = errors.New("unchanged")
+
+// Runs change with userLock held, restoring the global slice, lockouts
+// and versions if change or the write to the store fails. The whole
+// update is traced as a span called store.<name>.
+func update(ctx context.Context, name string, change func() error) (err error) {
+	ctx, span := tracing.Start(ctx, "store."+name, tracing.KindInternal)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+
+	userLock.Lock()
+	defer userLock.Unlock()
+
+	if storeClosed {
+		return errStoreClosed
+	}
+	old := append([]Credentials(nil), UserSlice...)
+	oldLockouts, oldVersions := copyLockouts(), copyVersions()
+	pendingEvents = nil
+	if err := change(); err == errUnchanged {
+		pendingEvents = nil
+		return nil
+	} else if err != nil {
+		UserSlice, lockouts, versions, pendingEvents = old, oldLockouts, oldVersions, nil
+		return err
+	}
+	if err := tracedPersist(ctx); err != nil {
+		UserSlice, lockouts, versions, pendingEvents = old, oldLockouts, oldVersions, nil
+		return err
+	}
+	publish(ctx)
+	return nil
+}
+
+// The helpers below change the global slice without locking or
+// persisting it. Callers must go through update.
+
+func addUser(creds Credentials) error {
+	if _, err := findUser(creds.Username); err == nil {
+		return errUserExists
+	}
+	UserSlice = append(UserSlice, creds)
+	bumpVersion(creds.Username)
+	emit(EventUserCreated, creds.Username)
+	return nil
+}
+
+func setPassword(username, password string) error {
+	index, err := findUser(username)
+	if err != nil {
+		countLookup(err)
+		return err
+	}
+	UserSlice[index].Password = password
+	bumpVersion(username)
+	emit(EventPasswordChanged, username)
+	return nil
+}
+
+func removeUser(username string) error {
+	index, err := findUser(username)
+	if err != nil {
+		countLookup(err)
+		return err
+	}
+	UserSlice = remove(UserSlice, index)
+	delete(lockouts, username)
+	delete(versions, username)
+	emit(EventUserDeleted, username)
+	return nil
+}
+
+// ImportUsers adds several users with a single write to the store,
+// returning errUserExists or nil for each one in order. When atomic is
+// set no user is added unless every one of them can be.
+func ImportUsers(ctx context.Context, users []Credentials, atomic bool) (results []error, err error) {
+	ctx, span := tracing.Start(ctx, "store.ImportUsers", tracing.KindInternal,
+		tracing.Attr("users", len(users)), tracing.Attr("atomic", atomic))
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+
+	userLock.Lock()
+	defer userLock.Unlock()
+
+	if storeClosed {
+		return nil, errStoreClosed
+	}
+	taken := make(map[string]bool, len(UserSlice)+len(users))
+	for _, creds := range UserSlice {
+		taken[creds.Username] = true
+	}
+
+	results = make([]error, len(users))
+	old, oldVersions := UserSlice, copyVersions()
+	added := append([]Credentials(nil), UserSlice...)
+	conflicts := 0
+	for i, creds := range users {
+		if taken[creds.Username] {
+			results[i] = errUserExists
+			conflicts++
+			continue
+		}
+		taken[creds.Username] = true
+		added = append(added, creds)
+	}
+
+	if atomic && conflicts > 0 {
+		conflictsTotal.Add(float64(conflicts))
+		return results, nil
+	}
+	UserSlice = added
+	pendingEvents = nil
+	for _, creds := range added[len(old):] {
+		bumpVersion(creds.Username)
+		emit(EventUserCreated, creds.Username)
+	}
+	if err := tracedPersist(ctx); err != nil {
+		UserSlice, versions, pendingEvents = old, oldVersions, nil
+		return nil, err
+	}
+	publish(ctx)
+	conflictsTotal.Add(float64(conflicts))
+	return results, nil
+}
+
+// Usernames returns the usernames of every user in slice order.
+func Usernames(ctx context.Context) []string {
+	_, span := tracing.Start(ctx, "store.Usernames", tracing.KindInternal)
+	defer span.End()
+
+	userLock.Lock()
+	defer userLock.Unlock()
+
+	names := make([]string, len(UserSlice))
+	for i, creds := range UserSlice {
+		names[i] = creds.Username
+	}
+	return names
+}
+
+// Users returns a copy of the global slice.
+func Users(ctx context.Context) []Credentials {
+	_, span := tracing.Start(ctx, "store.Users", tracing.KindInternal)
+	defer span.End()
+
+	userLock.Lock()
+	defer userLock.Unlock()
+
+	return append([]Credentials(nil), UserSlice...)
+}
+
+// LoadUsers replaces the global slice with the users saved in the
+// store file at path. A missing file is treated as an empty store.
+func LoadUsers(path string) error {
+	file, _, err := readStore(path)
+	if err != nil {
+		return err
+	}
+
+	userLock.Lock()
+	defer userLock.Unlock()
+	load(file)
+	return nil
+}
+
+// OpenStore loads the users saved in the store file at path and
+// persists every change to it from then on. Stores in an older format
+// are upgraded and written back straight away, as are stores with
+// users that had no version.
+func OpenStore(path string) error {
+	file, version, err := readStore(path)
+	if err != nil {
+		return err
+	}
+
+	userLock.Lock()
+	defer userLock.Unlock()
+	assigned := load(file)
+	StorePath = path
+	diskFormat = version
+	if version != storeFormat || assigned {
+		return persist()
+	}
+	return nil
+}
+
+// Replaces the global slice, lockouts and versions with those in file,
+// giving versions to users without one. It reports whether any were
+// given, in which case the store needs writing back. Callers must hold
+// userLock.
+func load(file *storeFile) bool {
+	UserSlice, lockouts, versions = file.Users, file.Lockouts, file.Versions
+	lastVersion = file.LastVersion
+	for _, v := range versions {
+		if v > lastVersion {
+			lastVersion = v
+		}
+	}
+	return assignVersions()
+}
+
+// SaveUsers writes the global slice to the store file at path.
+func SaveUsers(path string) error {
+	userLock.Lock()
+	defer userLock.Unlock()
+
+	return writeStore(path, current())
+}
+
+// CloseStore writes the users to StorePath one last time and stops any
+// further changes, which fail from then on. It is called once the
+// server has finished handling requests.
+func CloseStore() error {
+	userLock.Lock()
+	defer userLock.Unlock()
+
+	storeClosed = true
+	return persist()
+}
+
+// ReadStoreFile reads the users saved in the store file at path.
+// A missing file is treated as an empty store. Files in older formats
+// are upgraded as they are read.
+func ReadStoreFile(path string) ([]Credentials, error) {
+	file, _, err := readStore(path)
+	if err != nil {
+		return nil, err
+	}
+	return file.Users, nil
+}
+
+// Reads the store file at path, upgrading it to storeFormat. Also
+// returns the format the file was written in.
+func readStore(path string) (*storeFile, int, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &storeFile{Version: storeFormat, Users: []Credentials{}, Lockouts: map[string]lockout{}, Versions: map[string]uint64{}}, storeFormat, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+
+	// Migrations work on the raw JSON so they can reshape any part of it.
+	var raw map[string]json.RawMessage
+	var version int
+	if json.Unmarshal(data, &raw) != nil || json.Unmarshal(raw["version"], &version) != nil {
+		return nil, 0, errors.New("Bad Store File")
+	}
+	if version < 1 || version > storeFormat {
+		return nil, 0, errors.New("Unknown Store Version")
+	}
+	for v := version; v < storeFormat; v++ {
+		if err := migrations[v](raw); err != nil {
+			return nil, 0, fmt.Errorf("migrating store from version %d: %s", v, err)
+		}
+	}
+
+	data, _ = json.Marshal(raw)
+	var file storeFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, 0, errors.New("Bad Store File")
+	}
+	file.Version = storeFormat
+	if file.Users == nil {
+		file.Users = []Credentials{}
+	}
+	if file.Lockouts == nil {
+		file.Lockouts = map[string]lockout{}
+	}
+	if file.Versions == nil {
+		file.Versions = map[string]uint64{}
+	}
+	return &file, version, nil
+}
+
+// WriteStoreFile saves users to the store file at path. The file is
+// written to a temporary file first and renamed over the old one so
+// a crash never leaves a half written store behind.
+func WriteStoreFile(path string, users []Credentials) error {
+	return writeStore(path, storeFile{Users: users})
+}
+
+// Returns the global slice, lockouts and versions as a store file.
+// Callers must hold userLock.
+func current() storeFile {
+	return storeFile{Users: UserSlice, Lockouts: lockouts, Versions: versions, LastVersion: lastVersion}
+}
+
+// Writes file to the store file at path in storeFormat. See
+// WriteStoreFile.
+func writeStore(path string, file storeFile) error {
+	file.Version = storeFormat
+	if file.Users == nil {
+		file.Users = []Credentials{}
+	}
+	if file.Lockouts == nil {
+		file.Lockouts = map[string]lockout{}
+	}
+	if file.Versions == nil {
+		file.Versions = map[string]uint64{}
+	}
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Writes the global slice to StorePath if one is set.
+// Callers must hold userLock.
+func persist() error {
+	if StorePath == "" {
+		return nil
+	}
+	if err := writeStore(StorePath, current()); err != nil {
+		return err
+	}
+	diskFormat = storeFormat
+	return nil
+}
+
+// Calls persist within a store.persist span.
+// Callers must hold userLock.
+func tracedPersist(ctx context.Context) error {
+	_, span := tracing.Start(ctx, "store.persist", tracing.KindInternal, tracing.Attr("users", len(UserSlice)))
+	defer span.End()
+	err := persist()
+	span.SetError(err)
+	return err
+}
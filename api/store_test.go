@@ -0,0 +1,152 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Tests that users survive a round trip through a store file.
+func TestStoreFile(t *testing.T) {
+	t.Run("Round Trip", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "users.json")
+		users := []Credentials{{"student1", "dab"}, {"student2", "dabdab"}}
+
+		if err := WriteStoreFile(path, users); err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := ReadStoreFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(loaded, users) {
+			t.Fatalf("Store file has wrong contents. Expected: %v Actual: %v", users, loaded)
+		}
+	})
+
+	// A store that has never been saved should just be empty.
+	t.Run("Missing File", func(t *testing.T) {
+		loaded, err := ReadStoreFile(filepath.Join(t.TempDir(), "missing.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(loaded) != 0 {
+			t.Fatalf("Expected an empty store. Got %v", loaded)
+		}
+	})
+
+	t.Run("Bad File", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "users.json")
+		if err := ioutil.WriteFile(path, []byte("not json"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReadStoreFile(path); err == nil {
+			t.Fatal("Expected an error reading a corrupt store file.")
+		}
+	})
+}
+
+// Tests that every change to the users is written to StorePath.
+func TestPersist(t *testing.T) {
+	clearGlobalSlice()
+	StorePath = filepath.Join(t.TempDir(), "users.json")
+	defer func() { StorePath = "" }()
+
+	// Make a few changes through the store functions.
+	if err := AddUser(context.Background(), Credentials{"student1", "dab"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddUser(context.Background(), Credentials{"student2", "dab"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddUser(context.Background(), Credentials{"student1", "again"}); err != errUserExists {
+		t.Fatalf("Expected %v when adding a duplicate user. Got %v", errUserExists, err)
+	}
+	if err := SetPassword(context.Background(), "student2", "dabdab"); err != nil {
+		t.Fatal(err)
+	}
+	if err := RemoveUser(context.Background(), "student1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := RemoveUser(context.Background(), "student1"); err != errUserNotFound {
+		t.Fatalf("Expected %v when removing a missing user. Got %v", errUserNotFound, err)
+	}
+
+	// The file should now match the global slice.
+	loaded, err := ReadStoreFile(StorePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Credentials{{"student2", "dabdab"}}
+	if !reflect.DeepEqual(loaded, expected) || !reflect.DeepEqual(UserSlice, expected) {
+		t.Fatalf("Store has wrong contents. Expected: %v File: %v Slice: %v", expected, loaded, UserSlice)
+	}
+
+	// A failed write should leave the global slice untouched.
+	StorePath = filepath.Join(t.TempDir(), "missing", "users.json")
+	if err := AddUser(context.Background(), Credentials{"student3", "dab"}); err == nil {
+		t.Fatal("Expected an error writing to a missing directory.")
+	}
+	if !reflect.DeepEqual(UserSlice, expected) {
+		t.Fatalf("Global slice changed after a failed write: %v", UserSlice)
+	}
+}
+
+// Tests the correctness of the listUsers function.
+func TestListUsers(t *testing.T) {
+	clearGlobalSlice()
+	UserSlice = append(UserSlice, Credentials{"student1", "dab"}, Credentials{"student2", "dab"})
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/users", nil)
+	rr := httptest.NewRecorder()
+	listUsers(rr, req)
+
+	if rr.Result().StatusCode != http.StatusOK {
+		t.Fatalf("Incorrect status code returned! Expected: %d Actual: %d", http.StatusOK, rr.Result().StatusCode)
+	}
+	var users []userSummary
+	if err := json.NewDecoder(rr.Body).Decode(&users); err != nil {
+		t.Fatal(err)
+	}
+	expected := []userSummary{{"student1"}, {"student2"}}
+	if !reflect.DeepEqual(users, expected) {
+		t.Fatalf("Incorrect users returned! Expected: %v Actual: %v", expected, users)
+	}
+}
+
+// Tests that a closed store is flushed and refuses further changes.
+func TestCloseStore(t *testing.T) {
+	clearGlobalSlice()
+	UserSlice = append(UserSlice, Credentials{"student1", "dab"})
+	StorePath = filepath.Join(t.TempDir(), "users.json")
+	defer func() { StorePath, storeClosed = "", false }()
+
+	if err := CloseStore(); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := ReadStoreFile(StorePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded, UserSlice) {
+		t.Fatalf("Store was not flushed. Expected: %v Actual: %v", UserSlice, loaded)
+	}
+
+	// Changes after closing must fail without touching the users.
+	if err := AddUser(context.Background(), Credentials{"student2", "dab"}); err != errStoreClosed {
+		t.Fatalf("Expected %v. Got %v", errStoreClosed, err)
+	}
+	req, rr, err := createRequestAndResponseWithJSON(Credentials{"student1", "dabdab"}, http.MethodPut, "/api/updatePW")
+	if err != nil {
+		t.Fatal(err)
+	}
+	updatePassword(rr, req)
+	if rr.Result().StatusCode != http.StatusInternalServerError || UserSlice[0].Password != "dab" {
+		t.Fatalf("Update succeeded on a closed store with status %d", rr.Result().StatusCode)
+	}
+}
@@ -0,0 +1,228 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EventBufferSize is how many of the latest events are kept for
+// clients of /api/v1/events resuming with Last-Event-ID.
+var EventBufferSize = 1000
+
+// EventHeartbeat is how often idle event streams are sent a comment,
+// so proxies and clients don't give up on them.
+var EventHeartbeat = 15 * time.Second
+
+// How many events may wait to be written to a single stream. Streams
+// falling further behind are ended, and their clients resume from the
+// buffer when they reconnect.
+const streamQueueSize = 256
+
+// How long clients are asked to wait before reconnecting.
+const streamRetry = time.Second
+
+var (
+	streamsDroppedTotal = Metrics.NewCounter("events_streams_dropped_total",
+		"Event streams ended because their client fell too far behind.")
+	streamsOpen = Metrics.NewGauge("events_streams_open",
+		"Clients currently streaming /api/v1/events.")
+)
+
+// A single event as sent to streams.
+type streamEvent struct {
+	id        uint64
+	eventType string
+	data      []byte
+}
+
+// The latest events, in a ring buffer, and the streams they are sent
+// to.
+type eventStream struct {
+	mu      sync.Mutex
+	lastID  uint64
+	ring    []streamEvent
+	start   int
+	streams map[chan streamEvent]bool
+}
+
+var stream = &eventStream{streams: map[chan streamEvent]bool{}}
+
+// Sends an event to every stream. It never blocks: streams whose queue
+// is full are ended instead.
+func streamUserEvent(ctx context.Context, event UserEvent) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	stream.publish(event.Type, data)
+}
+
+func (s *eventStream) publish(eventType string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastID++
+	event := streamEvent{s.lastID, eventType, data}
+	if len(s.ring) < EventBufferSize {
+		s.ring = append(s.ring, event)
+	} else if EventBufferSize > 0 {
+		s.ring[s.start] = event
+		s.start = (s.start + 1) % len(s.ring)
+	}
+
+	for queue := range s.streams {
+		select {
+		case queue <- event:
+		default:
+			streamsDroppedTotal.Inc()
+			s.end(queue)
+		}
+	}
+}
+
+// Adds a stream, returning its queue and the buffered events after
+// lastID to send first. gap is set if events after lastID have already
+// left the buffer, or lastID is from before the server started.
+func (s *eventStream) subscribe(lastID uint64, resume bool) (queue chan streamEvent, backlog []streamEvent, gap bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	queue = make(chan streamEvent, streamQueueSize)
+	s.streams[queue] = true
+	streamsOpen.Add(1)
+	if !resume {
+		return queue, nil, false
+	}
+
+	if lastID > s.lastID {
+		lastID, gap = 0, true
+	}
+	for i := range s.ring {
+		event := s.ring[(s.start+i)%len(s.ring)]
+		if event.id > lastID {
+			backlog = append(backlog, event)
+		}
+	}
+	oldest := s.lastID + 1
+	if len(backlog) > 0 {
+		oldest = backlog[0].id
+	}
+	return queue, backlog, gap || oldest > lastID+1
+}
+
+// Removes a stream if it hasn't been ended already.
+func (s *eventStream) unsubscribe(queue chan streamEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.streams[queue] {
+		s.end(queue)
+	}
+}
+
+// Ends every stream, as the server is shutting down.
+func (s *eventStream) endAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for queue := range s.streams {
+		s.end(queue)
+	}
+}
+
+// Closes a stream's queue, which ends its response. Callers must hold
+// s.mu.
+func (s *eventStream) end(queue chan streamEvent) {
+	delete(s.streams, queue)
+	close(queue)
+	streamsOpen.Add(-1)
+}
+
+// Streams changes to users as server-sent events:
+//
+//	id: <n>
+//	event: user.created
+//	data: {"type": "user.created", "username": ..., "time": ..., "actor": ..., "request_id": ...}
+//
+// Clients reconnecting with a Last-Event-ID header are first sent the
+// events they missed, as long as they are still among the latest
+// EventBufferSize. If some are gone, a reset event is sent before the
+// oldest one left. Idle streams get a comment every EventHeartbeat.
+// Clients that can't keep up have their stream ended, and catch up
+// when they reconnect. The server's write timeout is pushed back after
+// every write, so streams stay open however long they last. Once the
+// server starts draining, new streams are refused with 503 Service
+// Unavailable.
+func streamEvents(response http.ResponseWriter, request *http.Request) {
+	flusher, ok := response.(http.Flusher)
+	if !ok {
+		http.Error(response, "", http.StatusInternalServerError)
+		return
+	}
+	var lastID uint64
+	header := strings.TrimSpace(request.Header.Get("Last-Event-ID"))
+	resume := header != ""
+	if resume {
+		var err error
+		if lastID, err = strconv.ParseUint(header, 10, 64); err != nil {
+			// An ID this server didn't send. Send everything buffered.
+			lastID = 0
+		}
+	}
+	queue, backlog, gap := stream.subscribe(lastID, resume)
+	defer stream.unsubscribe(queue)
+	// Checked after subscribing, as StartDraining ends the streams it
+	// finds after setting draining, so no stream outlives both.
+	if atomic.LoadInt32(&draining) != 0 {
+		http.Error(response, "", http.StatusServiceUnavailable)
+		return
+	}
+
+	response.Header().Set("Content-Type", "text/event-stream")
+	response.Header().Set("Cache-Control", "no-store")
+	response.Header().Set("X-Accel-Buffering", "no")
+	extendWriteDeadline(response, 0)
+	response.WriteHeader(http.StatusOK)
+	fmt.Fprintf(response, "retry: %d\n\n", streamRetry.Milliseconds())
+	if gap {
+		fmt.Fprint(response, "event: reset\ndata: {}\n\n")
+	}
+	for _, event := range backlog {
+		writeStreamEvent(response, event)
+	}
+	flusher.Flush()
+	// The next write comes within a heartbeat.
+	extendWriteDeadline(response, EventHeartbeat)
+
+	heartbeat := time.NewTicker(EventHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		var err error
+		select {
+		case event, open := <-queue:
+			if !open {
+				return
+			}
+			err = writeStreamEvent(response, event)
+		case <-heartbeat.C:
+			_, err = fmt.Fprint(response, ": heartbeat\n\n")
+		case <-request.Context().Done():
+			return
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+		extendWriteDeadline(response, EventHeartbeat)
+	}
+}
+
+func writeStreamEvent(response http.ResponseWriter, event streamEvent) error {
+	_, err := fmt.Fprintf(response, "id: %d\nevent: %s\ndata: %s\n\n", event.id, event.eventType, event.data)
+	return err
+}
@@ -0,0 +1,245 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/BearCloud/sp21-assignment-4/config"
+	"github.com/gorilla/mux"
+)
+
+// Reads server-sent events from a stream, one block at a time.
+type sseReader struct {
+	t      *testing.T
+	body   *bufio.Reader
+	cancel context.CancelFunc
+}
+
+// Opens /api/v1/events on server, resuming after lastID if it isn't
+// empty.
+func openStream(t *testing.T, server *httptest.Server, lastID string) *sseReader {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/api/v1/events", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	if lastID != "" {
+		req.Header.Set("Last-Event-ID", lastID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" || resp.Header.Get("Content-Encoding") != "" {
+		t.Fatalf("Expected an uncompressed event stream. Got %d %v", resp.StatusCode, resp.Header)
+	}
+	r := &sseReader{t, bufio.NewReader(resp.Body), cancel}
+	if retry := r.next(); retry != "retry: 1000" {
+		t.Fatalf("Expected a retry time first. Got %q", retry)
+	}
+	return r
+}
+
+// Returns the next block of lines, joined by "|", failing the test if
+// none arrives within a second.
+func (r *sseReader) next() string {
+	lines := make(chan string, 1)
+	go func() {
+		var block []string
+		for {
+			line, err := r.body.ReadString('\n')
+			line = strings.TrimSuffix(line, "\n")
+			if err != nil || (line == "" && len(block) > 0) {
+				lines <- strings.Join(block, "|")
+				return
+			}
+			if line != "" {
+				block = append(block, line)
+			}
+		}
+	}()
+	select {
+	case block := <-lines:
+		return block
+	case <-time.After(time.Second):
+		r.t.Fatal("Timed out waiting for an event.")
+		return ""
+	}
+}
+
+// Returns the type and ID of an event block.
+func eventOf(block string) (string, string) {
+	var eventType, id string
+	for _, line := range strings.Split(block, "|") {
+		if strings.HasPrefix(line, "event: ") {
+			eventType = line[len("event: "):]
+		} else if strings.HasPrefix(line, "id: ") {
+			id = line[len("id: "):]
+		}
+	}
+	return eventType, id
+}
+
+// Starts a server with a fresh event stream, keeping bufferSize events
+// and sending heartbeats every heartbeat. The server's write timeout is
+// WriteTimeout.
+func newStreamServer(t *testing.T, bufferSize int, heartbeat time.Duration) (*httptest.Server, http.Handler) {
+	oldBuffer, oldHeartbeat := EventBufferSize, EventHeartbeat
+	t.Cleanup(func() { EventBufferSize, EventHeartbeat = oldBuffer, oldHeartbeat })
+	EventBufferSize, EventHeartbeat = bufferSize, heartbeat
+	stream = &eventStream{streams: map[chan streamEvent]bool{}}
+	clearGlobalSlice()
+	routes := mux.NewRouter()
+	RegisterRoutes(routes)
+	router := asAdmin(t, routes)
+	server := httptest.NewUnstartedServer(router)
+	server.Config.WriteTimeout = WriteTimeout
+	server.Start()
+	// Cleanups run last first, so streams opened later are closed
+	// before the server.
+	t.Cleanup(server.Close)
+	return server, router
+}
+
+// Tests streaming events and resuming from Last-Event-ID.
+func TestEventStream(t *testing.T) {
+	server, router := newStreamServer(t, 3, time.Hour)
+	send := func(method, endpoint, body string) {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(method, endpoint, strings.NewReader(body)))
+	}
+
+	live := openStream(t, server, "")
+	send(http.MethodPost, "/api/signup", `{"username": "oski", "password": "bear"}`)
+	block := live.next()
+	eventType, id := eventOf(block)
+	if eventType != EventUserCreated || id != "1" || !strings.Contains(block, `"username":"oski"`) {
+		t.Fatalf("Expected oski to be created. Got %q", block)
+	}
+	live.cancel()
+
+	// Events sent while disconnected are caught up on.
+	send(http.MethodPut, "/api/updatePW", `{"username": "oski", "password": "tree"}`)
+	send(http.MethodDelete, "/api/deleteUser", `{"username": "oski"}`)
+	resumed := openStream(t, server, "1")
+	for _, expected := range []string{EventPasswordChanged, EventUserDeleted} {
+		if eventType, _ := eventOf(resumed.next()); eventType != expected {
+			t.Fatalf("Expected %s. Got %s", expected, eventType)
+		}
+	}
+	resumed.cancel()
+
+	// Only the last 3 events are kept, so resuming from the first one
+	// misses one.
+	send(http.MethodPost, "/api/signup", `{"username": "dirks", "password": "tree"}`)
+	send(http.MethodPut, "/api/updatePW", `{"username": "dirks", "password": "bear"}`)
+	gapped := openStream(t, server, "1")
+	if eventType, _ := eventOf(gapped.next()); eventType != "reset" {
+		t.Fatalf("Expected a reset. Got %s", eventType)
+	}
+	if _, id := eventOf(gapped.next()); id != "3" {
+		t.Fatalf("Expected to resume from event 3. Got %s", id)
+	}
+	gapped.cancel()
+
+	// IDs from before a restart start over.
+	restarted := openStream(t, server, "99")
+	if eventType, _ := eventOf(restarted.next()); eventType != "reset" {
+		t.Fatalf("Expected a reset. Got %s", eventType)
+	}
+	restarted.cancel()
+}
+
+// Tests that idle streams are sent heartbeats.
+func TestStreamHeartbeat(t *testing.T) {
+	server, _ := newStreamServer(t, 3, 10*time.Millisecond)
+	idle := openStream(t, server, "")
+	if heartbeat := idle.next(); heartbeat != ": heartbeat" {
+		t.Fatalf("Expected a heartbeat. Got %q", heartbeat)
+	}
+}
+
+// Tests that streams outlive the server's write timeout when heartbeats
+// are further apart than it, as they are with the default timeouts,
+// scaled down here.
+func TestStreamWriteTimeout(t *testing.T) {
+	defaults := config.Default()
+	oldTimeout := WriteTimeout
+	t.Cleanup(func() { WriteTimeout = oldTimeout })
+	WriteTimeout = defaults.WriteTimeout / 50
+	server, _ := newStreamServer(t, 3, defaults.EventHeartbeat/50)
+	idle := openStream(t, server, "")
+	for i := 0; i < 3; i++ {
+		if heartbeat := idle.next(); heartbeat != ": heartbeat" {
+			t.Fatalf("Expected heartbeat %d. Got %q", i+1, heartbeat)
+		}
+	}
+}
+
+// Tests that streams opened after the server starts draining are
+// refused, so reconnecting clients can't hold up the shutdown.
+func TestStreamDraining(t *testing.T) {
+	server, _ := newStreamServer(t, 3, time.Hour)
+	t.Cleanup(func() { atomic.StoreInt32(&draining, 0) })
+	open := openStream(t, server, "")
+	StartDraining()
+	if block := open.next(); block != "" {
+		t.Fatalf("Expected the open stream to end. Got %q", block)
+	}
+
+	resp, err := http.Get(server.URL + "/api/v1/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Expected 503 while draining. Got %d", resp.StatusCode)
+	}
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+	if len(stream.streams) != 0 {
+		t.Fatalf("Expected no open streams. Got %d", len(stream.streams))
+	}
+}
+
+// Tests that streams that fall behind are ended without holding up
+// changes to users.
+func TestStreamBackpressure(t *testing.T) {
+	stream = &eventStream{streams: map[chan streamEvent]bool{}}
+	slow, _, _ := stream.subscribe(0, false)
+	fast, _, _ := stream.subscribe(0, false)
+
+	start := time.Now()
+	for i := 0; i < streamQueueSize+1; i++ {
+		stream.publish(EventUserCreated, []byte(strconv.Itoa(i)))
+		if i < streamQueueSize {
+			<-fast
+		}
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Publishing took %v", elapsed)
+	}
+
+	// The slow stream gets what it had queued, then ends.
+	received := 0
+	for range slow {
+		received++
+	}
+	if received != streamQueueSize {
+		t.Fatalf("Expected %d queued events. Got %d", streamQueueSize, received)
+	}
+	if event, open := <-fast; !open || string(event.data) != strconv.Itoa(streamQueueSize) {
+		t.Fatalf("Expected the fast stream to keep going. Got %v %v", event, open)
+	}
+
+	stream.endAll()
+	if _, open := <-fast; open {
+		t.Fatal("Expected every stream to end.")
+	}
+}
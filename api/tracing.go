@@ -0,0 +1,49 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/BearCloud/sp21-assignment-4/logging"
+	"github.com/BearCloud/sp21-assignment-4/tracing"
+)
+
+// Traces every request as a server span named after its method and
+// route template. A traceparent header from the client makes the span
+// part of the client's trace. Store calls made with the request's
+// context become children of the span, and the trace ID is added to
+// the request's logger.
+func traceRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		ctx := request.Context()
+		if parent, ok := tracing.Extract(request.Header); ok {
+			ctx = tracing.ContextWithRemoteParent(ctx, parent)
+		}
+		route := routeTemplate(request)
+		ctx, span := tracing.Start(ctx, request.Method+" "+route, tracing.KindServer,
+			tracing.Attr("http.method", request.Method),
+			tracing.Attr("http.route", route),
+			tracing.Attr("http.target", request.URL.RequestURI()),
+			tracing.Attr("request_id", RequestIDFromContext(ctx)),
+		)
+		defer span.End()
+
+		logger := logging.FromContext(ctx).With("trace_id", span.SpanContext().TraceID.String())
+		ctx = logging.NewContext(ctx, logger)
+
+		recorder := &statusRecorder{ResponseWriter: response}
+		next.ServeHTTP(recorder, request.WithContext(ctx))
+
+		status := recorder.Status()
+		span.SetAttributes(tracing.Attr("http.status_code", status))
+		if status >= http.StatusInternalServerError {
+			span.SetError(httpError(status))
+		}
+	})
+}
+
+// An HTTP status reported as an error on a span.
+type httpError int
+
+func (e httpError) Error() string {
+	return http.StatusText(int(e))
+}
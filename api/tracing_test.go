@@ -0,0 +1,84 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/BearCloud/sp21-assignment-4/tracing"
+	"github.com/gorilla/mux"
+)
+
+// Collects exported spans in memory.
+type spanRecorder struct {
+	lock  sync.Mutex
+	spans []tracing.SpanData
+}
+
+func (r *spanRecorder) ExportSpans(ctx context.Context, spans []tracing.SpanData) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.spans = append(r.spans, spans...)
+	return nil
+}
+
+func (r *spanRecorder) Shutdown(ctx context.Context) error { return nil }
+
+// Tests that requests continue the caller's trace and that store calls
+// are traced as children of the request.
+func TestTraceRequests(t *testing.T) {
+	recorder := &spanRecorder{}
+	tracer := tracing.NewTracer(recorder)
+	tracing.SetDefault(tracer)
+	defer tracing.SetDefault(nil)
+	clearGlobalSlice()
+
+	router := mux.NewRouter()
+	RegisterRoutes(router)
+
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	req := httptest.NewRequest(http.MethodPost, "/api/signup", strings.NewReader(`{"username": "oski", "password": "bear"}`))
+	req.Header.Set(tracing.TraceparentHeader, traceparent)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Incorrect status code returned! Expected: %d Actual: %d", http.StatusCreated, rr.Code)
+	}
+	if err := tracer.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := map[string]tracing.SpanData{}
+	for _, span := range recorder.spans {
+		spans[span.Name] = span
+	}
+	server, store, persist := spans["POST /api/signup"], spans["store.AddUser"], spans["store.persist"]
+	remote, _ := tracing.ParseTraceparent(traceparent)
+
+	// Every span belongs to the caller's trace.
+	if len(recorder.spans) != 3 {
+		t.Fatalf("Expected 3 spans. Got %+v", recorder.spans)
+	}
+	for _, span := range recorder.spans {
+		if span.Context.TraceID != remote.TraceID {
+			t.Fatalf("Expected span %s in trace %s. Got %s", span.Name, remote.TraceID, span.Context.TraceID)
+		}
+	}
+	if server.Kind != tracing.KindServer || server.Parent != remote.SpanID {
+		t.Fatalf("Expected the server span to be a child of the caller. Got %+v", server)
+	}
+	if store.Parent != server.Context.SpanID || persist.Parent != store.Context.SpanID {
+		t.Fatal("Expected store spans to be children of the request span.")
+	}
+
+	attributes := map[string]interface{}{}
+	for _, attr := range server.Attributes {
+		attributes[attr.Key] = attr.Value
+	}
+	if attributes["http.route"] != "/api/signup" || attributes["http.status_code"] != http.StatusCreated || attributes["request_id"] != rr.Header().Get(requestIDHeader) {
+		t.Fatalf("Unexpected server span attributes %v", attributes)
+	}
+}
@@ -0,0 +1,58 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/BearCloud/sp21-assignment-4/webhook"
+)
+
+// Webhooks, when set, delivers every user created, password changed
+// and user deleted to the endpoints subscribed to them. See the webhook
+// package.
+var Webhooks *webhook.Dispatcher
+
+// The JSON body of every webhook delivery.
+type webhookPayload struct {
+	Type string      `json:"type"`
+	Time time.Time   `json:"time"`
+	Data webhookData `json:"data"`
+}
+
+type webhookData struct {
+	Username string `json:"username"`
+}
+
+// Queues an event for delivery. Publishing never blocks, so a slow
+// endpoint can't hold up changes to users.
+func webhookEvent(ctx context.Context, event UserEvent) {
+	if Webhooks == nil {
+		return
+	}
+	payload, err := json.Marshal(webhookPayload{event.Type, event.Time.UTC(), webhookData{event.Username}})
+	if err != nil {
+		return
+	}
+	Webhooks.Publish(event.Type, payload)
+}
+
+// Writes a JSON array of the webhook deliveries that were given up on,
+// oldest first, or an empty array if there are no webhooks.
+func getDeadLetters(response http.ResponseWriter, request *http.Request) {
+	letters := []webhook.DeadLetter{}
+	if Webhooks != nil {
+		letters = Webhooks.DeadLetters()
+	}
+	response.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(response).Encode(letters)
+}
+
+// Empties the dead-letter list, responding 204 No Content.
+func clearDeadLetters(response http.ResponseWriter, request *http.Request) {
+	if Webhooks != nil {
+		Webhooks.ClearDeadLetters()
+	}
+	response.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,89 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/BearCloud/sp21-assignment-4/webhook"
+	"github.com/gorilla/mux"
+)
+
+// Tests that changes to users are delivered to a local webhook
+// receiver, and that failed deliveries can be listed.
+func TestWebhooks(t *testing.T) {
+	var mu sync.Mutex
+	var received []webhookPayload
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := webhook.Verify("secret", r.Header.Get(webhook.SignatureHeader), body, time.Now(), time.Minute); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		var payload webhookPayload
+		json.Unmarshal(body, &payload)
+		mu.Lock()
+		received = append(received, payload)
+		mu.Unlock()
+	}))
+	defer receiver.Close()
+
+	options := webhook.Options{MaxAttempts: 2, Backoff: time.Millisecond}
+	Webhooks = webhook.New([]webhook.Subscription{
+		{URL: receiver.URL, Secret: "secret"},
+		{URL: receiver.URL, Secret: "wrong", Events: []string{EventUserDeleted}},
+	}, options, nil)
+	defer func() { Webhooks = nil }()
+	clearGlobalSlice()
+	routes := mux.NewRouter()
+	RegisterRoutes(routes)
+	router := asAdmin(t, routes)
+	send := func(method, endpoint, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(method, endpoint, strings.NewReader(body)))
+		return rr
+	}
+
+	send(http.MethodPost, "/api/signup", `{"username": "oski", "password": "bear"}`)
+	send(http.MethodPut, "/api/updatePW", `{"username": "oski", "password": "tree"}`)
+	send(http.MethodPut, "/api/updatePW", `{"username": "dirks", "password": "tree"}`)
+	send(http.MethodDelete, "/api/deleteUser", `{"username": "oski"}`)
+	dispatcher := Webhooks
+	if err := dispatcher.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var types []string
+	for _, payload := range received {
+		types = append(types, payload.Type)
+		if payload.Data.Username != "oski" || payload.Time.IsZero() {
+			t.Errorf("Expected a payload about oski. Got %+v", payload)
+		}
+	}
+	expected := []string{EventUserCreated, EventPasswordChanged, EventUserDeleted}
+	if strings.Join(types, ",") != strings.Join(expected, ",") {
+		t.Fatalf("Expected deliveries %v. Got %v", expected, types)
+	}
+
+	// The subscription with the wrong secret is refused every time.
+	rr := send(http.MethodGet, "/api/v1/webhooks/dead-letters", "")
+	var letters []webhook.DeadLetter
+	if err := json.Unmarshal(rr.Body.Bytes(), &letters); err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 1 || letters[0].Event != EventUserDeleted || letters[0].Attempts != options.MaxAttempts {
+		t.Fatalf("Expected a dead letter for the deletion. Got %+v", letters)
+	}
+	if rr := send(http.MethodDelete, "/api/v1/webhooks/dead-letters", ""); rr.Code != http.StatusNoContent {
+		t.Fatalf("Expected status code %d. Got %d", http.StatusNoContent, rr.Code)
+	}
+	if letters := dispatcher.DeadLetters(); len(letters) != 0 {
+		t.Fatalf("Expected the dead letters to be cleared. Got %+v", letters)
+	}
+}
@@ -0,0 +1,266 @@
+// Package audit keeps an append-only log of changes to users in a
+// local file, one JSON event per line.
+//
+// Every event carries the hash of the event before it, and its own
+// hash covers that, so editing, removing or reordering any event
+// breaks the chain from then on. Verify walks the chain. Removing
+// events from the end can only be noticed by comparing the hash of the
+// last event with one kept elsewhere, which Verify returns for that
+// purpose.
+package audit
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The PrevHash of the first event in a log.
+var GenesisHash = strings.Repeat("0", sha256.Size*2)
+
+// The longest line Verify and Query will read.
+const maxLineBytes = 1 << 20
+
+// An Event records a single change to a user.
+type Event struct {
+	// Numbered from 1 in the order events were appended.
+	Seq  uint64    `json:"seq"`
+	Time time.Time `json:"time"`
+	// What happened, such as "user.created".
+	Action   string `json:"action"`
+	Username string `json:"username"`
+	// Who made the change, such as an admin's certificate name or a
+	// client's IP address, and the ID of the request that made it.
+	Actor     string `json:"actor,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+
+	PrevHash string `json:"prev_hash"`
+	Hash     string `json:"hash"`
+}
+
+// ComputeHash returns what the Hash of e should be: the SHA-256, in
+// hex, of every other field.
+func (e Event) ComputeHash() string {
+	e.Hash = ""
+	data, _ := json.Marshal(e)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// A VerifyError describes the first event found to break the chain.
+type VerifyError struct {
+	Line   int
+	Reason string
+}
+
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("audit log line %d: %s", e.Line, e.Reason)
+}
+
+// Verify checks the chain of events read from r. It returns how many
+// events there are and the hash of the last one, or a *VerifyError if
+// the chain is broken.
+func Verify(r io.Reader) (count int, head string, err error) {
+	head = GenesisHash
+	err = scan(r, func(line int, e Event) error {
+		if e.Seq != uint64(count+1) {
+			return &VerifyError{line, fmt.Sprintf("expected event %d, found %d", count+1, e.Seq)}
+		}
+		if e.PrevHash != head {
+			return &VerifyError{line, "previous hash does not match the event before"}
+		}
+		if e.Hash != e.ComputeHash() {
+			return &VerifyError{line, "hash does not match the event"}
+		}
+		count++
+		head = e.Hash
+		return nil
+	})
+	return count, head, err
+}
+
+// VerifyFile runs Verify on the log at path. A missing file is an
+// empty log.
+func VerifyFile(path string) (count int, head string, err error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, GenesisHash, nil
+	} else if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	return Verify(f)
+}
+
+// Calls f with every event read from r and the line it was on.
+func scan(r io.Reader, f func(line int, e Event) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxLineBytes)
+	for line := 1; scanner.Scan(); line++ {
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return &VerifyError{line, "not an event: " + err.Error()}
+		}
+		if err := f(line, e); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// A Log appends events to a file. It is safe for concurrent use.
+type Log struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+	seq  uint64
+	head string
+	// How many bytes of whole events the file holds.
+	size int64
+}
+
+// Open opens the log at path for appending, creating it if needed. It
+// fails if the events already in the file don't verify, so a tampered
+// log is never extended.
+func Open(path string) (*Log, error) {
+	count, head, err := VerifyFile(path)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &Log{path: path, file: file, seq: uint64(count), head: head, size: info.Size()}, nil
+}
+
+// Append numbers e, chains it to the event before and writes it to the
+// file, which is synced before Append returns. It returns e as written.
+func (l *Log) Append(e Event) (Event, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return e, errors.New("audit log closed")
+	}
+
+	e.Seq = l.seq + 1
+	e.Time = e.Time.UTC()
+	e.PrevHash = l.head
+	e.Hash = e.ComputeHash()
+	data, err := json.Marshal(e)
+	if err != nil {
+		return e, err
+	}
+	if _, err := l.file.Write(append(data, '\n')); err != nil {
+		return e, err
+	}
+	if err := l.file.Sync(); err != nil {
+		return e, err
+	}
+	l.seq, l.head = e.Seq, e.Hash
+	l.size += int64(len(data)) + 1
+	return e, nil
+}
+
+// A Filter picks events out of a log. Empty fields match every event.
+type Filter struct {
+	Username string
+	// Events from Since, inclusive, until Until, exclusive.
+	Since time.Time
+	Until time.Time
+	// Events numbered after After and before Before, both exclusive.
+	// Paging through a log passes the Seq of the last event of one page
+	// as After, or as Before when paging from the newest.
+	After  uint64
+	Before uint64
+}
+
+// Matches reports whether e is picked by f.
+func (f Filter) Matches(e Event) bool {
+	if f.Username != "" && e.Username != f.Username {
+		return false
+	}
+	if e.Seq <= f.After || (f.Before > 0 && e.Seq >= f.Before) {
+		return false
+	}
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !e.Time.Before(f.Until) {
+		return false
+	}
+	return true
+}
+
+// The orders Query can return events in.
+type Order int
+
+const (
+	OldestFirst Order = iota
+	NewestFirst
+)
+
+// Query returns the events in the log picked by f in order, up to limit
+// of them. A limit of 0 returns every one. Only events appended before
+// Query was called are read, and appending doesn't wait for it.
+func (l *Log) Query(f Filter, order Order, limit int) ([]Event, error) {
+	l.mu.Lock()
+	size := l.size
+	l.mu.Unlock()
+
+	file, err := os.Open(l.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	events := []Event{}
+	errFull := errors.New("full")
+	err = scan(io.LimitReader(file, size), func(line int, e Event) error {
+		if f.Matches(e) {
+			events = append(events, e)
+		}
+		if limit > 0 && order == OldestFirst && len(events) == limit {
+			return errFull
+		}
+		if limit > 0 && len(events) > limit {
+			// Keep the newest limit events seen so far.
+			events = events[1:]
+		}
+		return nil
+	})
+	if err != nil && err != errFull {
+		return nil, err
+	}
+	if order == NewestFirst {
+		for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+			events[i], events[j] = events[j], events[i]
+		}
+	}
+	return events, nil
+}
+
+// Close closes the file. Appending fails from then on.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
@@ -0,0 +1,148 @@
+package audit
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Appends an event for each username to a new log, returning its path.
+func writeLog(t *testing.T, start time.Time, usernames ...string) string {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	log, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	for i, username := range usernames {
+		event := Event{Time: start.Add(time.Duration(i) * time.Minute), Action: "user.created", Username: username}
+		if _, err := log.Append(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+// Tests that changing a log in any way breaks its chain.
+func TestVerify(t *testing.T) {
+	path := writeLog(t, time.Now(), "oski", "dirks", "stanfurd")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(strings.TrimSuffix(string(data), "\n"), "\n")
+
+	tests := []struct {
+		Name          string
+		Log           string
+		ExpectedCount int
+		ExpectedLine  int
+	}{
+		{"Untouched", string(data), 3, 0},
+		{"Empty", "", 0, 0},
+		{"Edited", strings.Replace(string(data), "dirks", "d1rks", 1), 0, 2},
+		{"Removed", lines[0] + lines[2], 0, 2},
+		{"Reordered", lines[1] + lines[0] + lines[2], 0, 1},
+		{"Not JSON", lines[0] + "oops\n", 0, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			count, head, err := Verify(strings.NewReader(test.Log))
+			var verifyErr *VerifyError
+			if test.ExpectedLine == 0 {
+				if err != nil || count != test.ExpectedCount || head == "" {
+					t.Fatalf("Expected %d events to verify. Got %d %q %v", test.ExpectedCount, count, head, err)
+				}
+			} else if !errors.As(err, &verifyErr) || verifyErr.Line != test.ExpectedLine {
+				t.Fatalf("Expected a failure on line %d. Got %v", test.ExpectedLine, err)
+			}
+		})
+	}
+
+	// Tampered logs are never extended.
+	if err := os.WriteFile(path, []byte(tests[2].Log), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path); err == nil {
+		t.Fatal("Expected opening a tampered log to fail.")
+	}
+}
+
+// Tests that reopening a log carries its chain on.
+func TestReopen(t *testing.T) {
+	path := writeLog(t, time.Now(), "oski")
+	log, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event, err := log.Append(Event{Time: time.Now(), Action: "user.deleted", Username: "oski"})
+	log.Close()
+	if err != nil || event.Seq != 2 {
+		t.Fatalf("Expected the second event. Got %+v %v", event, err)
+	}
+	count, head, err := VerifyFile(path)
+	if err != nil || count != 2 || head != event.Hash {
+		t.Fatalf("Expected 2 events ending in %s. Got %d %s %v", event.Hash, count, head, err)
+	}
+	if _, err := log.Append(Event{Username: "oski"}); err == nil {
+		t.Fatal("Expected appending to a closed log to fail.")
+	}
+}
+
+// Tests picking events by username, time and number, oldest or
+// newest first.
+func TestQuery(t *testing.T) {
+	start := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	path := writeLog(t, start, "oski", "dirks", "oski", "oski")
+	log, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+
+	tests := []struct {
+		Name     string
+		Filter   Filter
+		Order    Order
+		Limit    int
+		Expected []uint64
+	}{
+		{"Everything", Filter{}, OldestFirst, 0, []uint64{1, 2, 3, 4}},
+		{"Username", Filter{Username: "oski"}, OldestFirst, 0, []uint64{1, 3, 4}},
+		{"Limited", Filter{Username: "oski"}, OldestFirst, 2, []uint64{1, 3}},
+		{"Since", Filter{Since: start.Add(time.Minute)}, OldestFirst, 0, []uint64{2, 3, 4}},
+		{"Until", Filter{Until: start.Add(2 * time.Minute)}, OldestFirst, 0, []uint64{1, 2}},
+		{"Both", Filter{Username: "oski", Since: start.Add(time.Minute), Until: start.Add(3 * time.Minute)}, OldestFirst, 0, []uint64{3}},
+		{"Nobody", Filter{Username: "stanfurd"}, OldestFirst, 0, nil},
+		{"After", Filter{After: 2}, OldestFirst, 1, []uint64{3}},
+		{"Newest First", Filter{}, NewestFirst, 0, []uint64{4, 3, 2, 1}},
+		{"Newest Limited", Filter{Username: "oski"}, NewestFirst, 2, []uint64{4, 3}},
+		{"Before", Filter{Before: 4}, NewestFirst, 2, []uint64{3, 2}},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			events, err := log.Query(test.Filter, test.Order, test.Limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var seqs []uint64
+			for _, e := range events {
+				seqs = append(seqs, e.Seq)
+			}
+			if len(seqs) != len(test.Expected) || (len(seqs) > 0 && !reflect.DeepEqual(seqs, test.Expected)) {
+				t.Errorf("Expected events %v. Got %v", test.Expected, seqs)
+			}
+		})
+	}
+
+	// Events still being appended aren't read.
+	log.file.Write([]byte(`{"seq": 5, "user`))
+	events, err := log.Query(Filter{}, NewestFirst, 1)
+	if err != nil || len(events) != 1 || events[0].Seq != 4 {
+		t.Fatalf("Expected event 4 to be the newest. Got %+v %v", events, err)
+	}
+}
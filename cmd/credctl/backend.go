@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/BearCloud/sp21-assignment-4/api"
+)
+
+// A backend is somewhere credctl can manage users.
+type backend interface {
+	list() ([]string, error)
+	create(creds api.Credentials) error
+	resetPassword(creds api.Credentials) error
+	delete(username string) error
+	importUsers(users []api.Credentials) ([]result, error)
+	exportUsers(w io.Writer) error
+}
+
+// Manages users by editing a store file directly. The server
+// should not be running on the same file at the same time.
+type fileBackend struct {
+	path string
+}
+
+func (b *fileBackend) list() ([]string, error) {
+	if err := api.LoadUsers(b.path); err != nil {
+		return nil, err
+	}
+	return api.Usernames(context.Background()), nil
+}
+
+func (b *fileBackend) create(creds api.Credentials) error {
+	return b.update(func() error { return api.AddUser(context.Background(), creds) })
+}
+
+func (b *fileBackend) resetPassword(creds api.Credentials) error {
+	return b.update(func() error { return api.SetPassword(context.Background(), creds.Username, creds.Password) })
+}
+
+func (b *fileBackend) delete(username string) error {
+	return b.update(func() error { return api.RemoveUser(context.Background(), username) })
+}
+
+// Rows the server would refuse are left out, and the rest are added
+// with a single write to the store, as the server's import does.
+func (b *fileBackend) importUsers(users []api.Credentials) ([]result, error) {
+	results := make([]result, len(users))
+	var valid []api.Credentials
+	var validRows []int
+	for i, creds := range users {
+		if err := validate(creds); err != nil {
+			results[i] = newResult(creds.Username, "created", err)
+			continue
+		}
+		valid = append(valid, creds)
+		validRows = append(validRows, i)
+	}
+
+	var errs []error
+	err := b.update(func() (err error) {
+		errs, err = api.ImportUsers(context.Background(), valid, false)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i, userErr := range errs {
+		results[validRows[i]] = newResult(valid[i].Username, "created", userErr)
+	}
+	return results, nil
+}
+
+func (b *fileBackend) exportUsers(w io.Writer) error {
+	if err := api.LoadUsers(b.path); err != nil {
+		return err
+	}
+	return writeUsers(w, api.Users(context.Background()))
+}
+
+// Loads the store file, applies change and saves the file again.
+func (b *fileBackend) update(change func() error) error {
+	if err := api.LoadUsers(b.path); err != nil {
+		return err
+	}
+	api.StorePath = b.path
+	defer func() { api.StorePath = "" }()
+	return change()
+}
+
+// Checks creds the same way the server does before adding a user.
+func validate(creds api.Credentials) error {
+	if creds.Username == "" {
+		return errors.New("no username")
+	} else if creds.Password == "" {
+		return errors.New("no password")
+	}
+	return nil
+}
+
+// Manages users through the HTTP API of a running server.
+type httpBackend struct {
+	baseURL string
+	token   string
+	client  *http.Client
+}
+
+// token is sent as a bearer token unless it is empty. tlsConfig may be
+// nil to use the defaults.
+func newHTTPBackend(baseURL, token string, tlsConfig *tls.Config) *httpBackend {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &httpBackend{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		token:   token,
+		client:  &http.Client{Timeout: 30 * time.Second, Transport: transport},
+	}
+}
+
+// Builds the TLS configuration for talking to a server from PEM files,
+// any of which may be empty. Returns nil if they all are.
+func clientTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" && caFile == "" {
+		return nil, nil
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+	}
+	return config, nil
+}
+
+func (b *httpBackend) list() ([]string, error) {
+	resp, err := b.do(http.MethodGet, "/api/v1/users", "", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var users []struct {
+		Username string `json:"username"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&users); err != nil {
+		return nil, fmt.Errorf("bad response from server: %s", err)
+	}
+	names := make([]string, len(users))
+	for i, user := range users {
+		names[i] = user.Username
+	}
+	return names, nil
+}
+
+func (b *httpBackend) create(creds api.Credentials) error {
+	return b.send(http.MethodPost, "/api/signup", creds)
+}
+
+func (b *httpBackend) resetPassword(creds api.Credentials) error {
+	return b.send(http.MethodPut, "/api/updatePW", creds)
+}
+
+func (b *httpBackend) delete(username string) error {
+	return b.send(http.MethodDelete, "/api/deleteUser", api.Credentials{Username: username})
+}
+
+func (b *httpBackend) importUsers(users []api.Credentials) ([]result, error) {
+	var body bytes.Buffer
+	if err := writeUsers(&body, users); err != nil {
+		return nil, err
+	}
+	resp, err := b.do(http.MethodPost, "/api/v1/users:import", "application/x-ndjson", body.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var imported struct {
+		Results []struct {
+			Username string `json:"username"`
+			Status   string `json:"status"`
+			Error    string `json:"error"`
+		} `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&imported); err != nil {
+		return nil, fmt.Errorf("bad response from server: %s", err)
+	}
+	results := make([]result, len(imported.Results))
+	for i, row := range imported.Results {
+		results[i] = result{Username: row.Username, Status: row.Status, Error: row.Error}
+		if row.Status != "created" {
+			results[i].Status = "failed"
+		}
+	}
+	return results, nil
+}
+
+// The server only exports password hashes, so the output can't be
+// imported again as is.
+func (b *httpBackend) exportUsers(w io.Writer) error {
+	resp, err := b.do(http.MethodGet, "/api/v1/users:export", "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// Sends creds as JSON and discards the response body.
+func (b *httpBackend) send(method, path string, creds api.Credentials) error {
+	body, err := json.Marshal(creds)
+	if err != nil {
+		return err
+	}
+	resp, err := b.do(method, path, "application/json", body)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Sends a request to the server, turning unsuccessful status codes
+// into errors.
+func (b *httpBackend) do(method, path, contentType string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, b.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if b.token != "" {
+		req.Header.Set("Authorization", "Bearer "+b.token)
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body.Close()
+		return nil, statusError(resp.StatusCode)
+	}
+	return resp, nil
+}
+
+// Describes an unsuccessful status code from the server.
+func statusError(code int) error {
+	switch code {
+	case http.StatusConflict:
+		return errors.New("user already exists")
+	case http.StatusBadRequest:
+		return errors.New("bad request or user not found")
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return errors.New("server requires an admin token or client certificate, see -token or -cert and -key")
+	}
+	return fmt.Errorf("server responded with %d %s", code, http.StatusText(code))
+}
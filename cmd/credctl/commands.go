@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/BearCloud/sp21-assignment-4/api"
+	"github.com/BearCloud/sp21-assignment-4/audit"
+)
+
+// Returned by dispatch when the command line doesn't make sense.
+var errUsage = errors.New("usage")
+
+// The outcome of a command for a single user.
+type result struct {
+	Username string `json:"username"`
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Runs a single command against a backend, printing the results.
+func dispatch(b backend, out *printer, command string, args []string) error {
+	switch command {
+	case "list":
+		if len(args) != 0 {
+			return errUsage
+		}
+		names, err := b.list()
+		if err != nil {
+			return err
+		}
+		return out.users(names)
+
+	case "create", "passwd":
+		if len(args) != 2 {
+			return errUsage
+		}
+		creds := api.Credentials{Username: args[0], Password: args[1]}
+		var err error
+		status := "created"
+		if command == "create" {
+			err = b.create(creds)
+		} else {
+			err = b.resetPassword(creds)
+			status = "updated"
+		}
+		return report(out, []result{newResult(creds.Username, status, err)})
+
+	case "delete":
+		if len(args) != 1 {
+			return errUsage
+		}
+		err := b.delete(args[0])
+		return report(out, []result{newResult(args[0], "deleted", err)})
+
+	case "import":
+		if len(args) != 1 {
+			return errUsage
+		}
+		users, err := readUserFile(args[0])
+		if err != nil {
+			return err
+		}
+		results, err := b.importUsers(users)
+		if err != nil {
+			return err
+		}
+		return report(out, results)
+
+	case "export":
+		if len(args) > 1 {
+			return errUsage
+		}
+		w := out.w
+		if len(args) == 1 {
+			f, err := os.Create(args[0])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+		return b.exportUsers(w)
+
+	case "verify-audit":
+		// Audit logs are local files, whichever backend is used.
+		if len(args) != 1 {
+			return errUsage
+		}
+		count, head, err := audit.VerifyFile(args[0])
+		if err != nil {
+			return err
+		}
+		return out.audit(count, head)
+	}
+	return errUsage
+}
+
+// Prints results, returning an error if any of them failed so
+// credctl exits with a non-zero status.
+func report(out *printer, results []result) error {
+	if err := out.results(results); err != nil {
+		return err
+	}
+	failed := 0
+	for _, r := range results {
+		if r.Status == "failed" {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d users failed", failed, len(results))
+	}
+	return nil
+}
+
+// Builds the result of a single command, turning err into a failure.
+func newResult(username, status string, err error) result {
+	if err != nil {
+		return result{Username: username, Status: "failed", Error: err.Error()}
+	}
+	return result{Username: username, Status: status}
+}
+
+// Reads a user set from either a JSON array or JSON Lines file.
+func readUserFile(path string) ([]api.Credentials, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseUsers(data)
+}
+
+// Parses a user set written as either a JSON array or JSON Lines.
+func parseUsers(data []byte) ([]api.Credentials, error) {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		var users []api.Credentials
+		if err := json.Unmarshal(trimmed, &users); err != nil {
+			return nil, fmt.Errorf("bad user file: %s", err)
+		}
+		return users, nil
+	}
+
+	var users []api.Credentials
+	scanner := bufio.NewScanner(bytes.NewReader(trimmed))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		var creds api.Credentials
+		if err := json.Unmarshal([]byte(text), &creds); err != nil {
+			return nil, fmt.Errorf("bad user file: line %d: %s", line, err)
+		}
+		users = append(users, creds)
+	}
+	return users, scanner.Err()
+}
+
+// Writes users as JSON Lines.
+func writeUsers(w io.Writer, users []api.Credentials) error {
+	enc := json.NewEncoder(w)
+	for _, creds := range users {
+		if err := enc.Encode(creds); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+// Command credctl manages the users of a running server, either through
+// its HTTP API or by editing a store file directly.
+//
+// Usage:
+//
+//	credctl [-server URL | -store FILE] [-o table|json] <command> [arguments]
+//
+// Servers with admin_token set are given it with -token or the
+// CREDCTL_TOKEN environment variable, and servers that require client
+// certificates on their admin routes are given one with -cert and -key.
+//
+// The commands are:
+//
+//	list                          list every user
+//	create <username> <password>  create a user
+//	delete <username>             delete a user
+//	passwd <username> <password>  reset the password of a user
+//	import <file>                 create every user in a JSON or JSON Lines file
+//	export [file]                 write every user to a JSON Lines file (default stdout);
+//	                              servers only export password hashes
+//	verify-audit <file>           check that an audit log hasn't been tampered with
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// The usage message printed by -h and on bad arguments.
+const usage = `usage: credctl [-server URL | -store FILE] [-o table|json] <command> [arguments]
+
+commands:
+  list                          list every user
+  create <username> <password>  create a user
+  delete <username>             delete a user
+  passwd <username> <password>  reset the password of a user
+  import <file>                 create every user in a JSON or JSON Lines file
+  export [file]                 write every user to a JSON Lines file (default stdout);
+                                servers only export password hashes
+  verify-audit <file>           check that an audit log hasn't been tampered with
+
+flags:
+`
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// Runs credctl with the given arguments and returns the exit status.
+func run(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("credctl", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprint(stderr, usage)
+		flags.PrintDefaults()
+	}
+	server := flags.String("server", "http://localhost:80", "base URL of the server to manage")
+	store := flags.String("store", "", "edit this store file directly instead of talking to a server")
+	output := flags.String("o", "table", "output format, either table or json")
+	cert := flags.String("cert", "", "PEM client certificate for servers that require one on admin routes")
+	key := flags.String("key", "", "PEM private key for -cert")
+	caCert := flags.String("cacert", "", "PEM CA certificates to verify the server with instead of the system roots")
+	token := flags.String("token", "", "admin token for servers with admin_token set (default $CREDCTL_TOKEN)")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 || (*output != "table" && *output != "json") {
+		flags.Usage()
+		return 2
+	}
+
+	var b backend
+	if *store != "" {
+		b = &fileBackend{path: *store}
+	} else {
+		tlsConfig, err := clientTLSConfig(*cert, *key, *caCert)
+		if err != nil {
+			fmt.Fprintln(stderr, "credctl:", err)
+			return 1
+		}
+		if *token == "" {
+			*token = os.Getenv("CREDCTL_TOKEN")
+		}
+		b = newHTTPBackend(*server, *token, tlsConfig)
+	}
+
+	out := &printer{w: stdout, json: *output == "json"}
+	if err := dispatch(b, out, flags.Arg(0), flags.Args()[1:]); err != nil {
+		if err == errUsage {
+			flags.Usage()
+			return 2
+		}
+		fmt.Fprintln(stderr, "credctl:", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BearCloud/sp21-assignment-4/api"
+	"github.com/BearCloud/sp21-assignment-4/audit"
+	"github.com/gorilla/mux"
+)
+
+// Runs credctl and returns its exit status and output.
+func runCredctl(args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	code := run(args, &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+// Tests every command against both a live server and a store file.
+func TestCommands(t *testing.T) {
+	api.AdminToken = "correct-horse-battery-staple"
+	defer func() { api.AdminToken = "" }()
+	router := mux.NewRouter()
+	api.RegisterRoutes(router)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	backends := []struct {
+		Name  string
+		Flags []string
+		Reset func()
+	}{
+		{"Server", []string{"-server", server.URL, "-token", api.AdminToken}, func() { api.UserSlice = nil }},
+		{"Store", []string{"-store", filepath.Join(t.TempDir(), "users.json")}, func() {}},
+	}
+
+	for _, b := range backends {
+		t.Run(b.Name, func(t *testing.T) {
+			b.Reset()
+			credctl := func(args ...string) (int, string, string) {
+				return runCredctl(append(append([]string{}, b.Flags...), args...)...)
+			}
+
+			// Create two users, one of them twice.
+			if code, _, stderr := credctl("create", "student1", "dab"); code != 0 {
+				t.Fatalf("create failed with status %d: %s", code, stderr)
+			}
+			if code, _, _ := credctl("create", "student2", "dab"); code != 0 {
+				t.Fatalf("create failed with status %d", code)
+			}
+			if code, stdout, _ := credctl("create", "student1", "dab"); code != 1 || !strings.Contains(stdout, "failed") {
+				t.Fatalf("Expected creating a duplicate user to fail. Got status %d and output %q", code, stdout)
+			}
+
+			// Change a password, delete a user and import some more.
+			if code, _, _ := credctl("passwd", "student2", "dabdab"); code != 0 {
+				t.Fatalf("passwd failed with status %d", code)
+			}
+			if code, _, _ := credctl("delete", "student1"); code != 0 {
+				t.Fatalf("delete failed with status %d", code)
+			}
+			file := filepath.Join(t.TempDir(), "import.jsonl")
+			rows := []string{
+				`{"username":"student3","password":"a"}`,
+				`{"username":"student2","password":"taken"}`,
+				`{"username":"student5"}`,
+				`{"username":"student4","password":"b"}`,
+			}
+			if err := writeFile(file, strings.Join(rows, "\n")); err != nil {
+				t.Fatal(err)
+			}
+			// The existing user and the one without a password are
+			// reported, and the others are still imported.
+			if code, stdout, _ := credctl("-o", "json", "import", file); code != 1 || strings.Count(stdout, `"failed"`) != 2 {
+				t.Fatalf("Expected two failed rows. Got status %d and output %q", code, stdout)
+			}
+
+			// Check the final set of users as JSON.
+			code, stdout, _ := credctl("-o", "json", "list")
+			if code != 0 {
+				t.Fatalf("list failed with status %d", code)
+			}
+			var users []map[string]string
+			if err := json.Unmarshal([]byte(stdout), &users); err != nil {
+				t.Fatal(err)
+			}
+			names := []string{}
+			for _, user := range users {
+				names = append(names, user["username"])
+			}
+			if strings.Join(names, ",") != "student2,student3,student4" {
+				t.Fatalf("Incorrect users listed: %v", names)
+			}
+
+			// Exporting should give back everything that was imported.
+			code, stdout, _ = credctl("export")
+			if code != 0 {
+				t.Fatalf("export failed with status %d", code)
+			}
+			exported, err := parseUsers([]byte(stdout))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(exported) != 3 || exported[0].Username != "student2" {
+				t.Fatalf("Incorrect users exported: %v", exported)
+			}
+
+			// Servers only export hashes, but store files hold the passwords.
+			if b.Name == "Server" && strings.Contains(stdout, "dabdab") {
+				t.Fatalf("Server exported a plaintext password: %s", stdout)
+			} else if b.Name == "Store" && exported[0].Password != "dabdab" {
+				t.Fatalf("Store export is missing the password: %v", exported[0])
+			}
+		})
+	}
+}
+
+// Tests that servers refusing credctl's credentials are explained.
+func TestAdminToken(t *testing.T) {
+	api.AdminToken = "correct-horse-battery-staple"
+	defer func() { api.AdminToken = "" }()
+	router := mux.NewRouter()
+	api.RegisterRoutes(router)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	for _, args := range [][]string{{"-server", server.URL, "list"}, {"-server", server.URL, "-token", "guess", "list"}} {
+		if code, _, stderr := runCredctl(args...); code != 1 || !strings.Contains(stderr, "-token") {
+			t.Errorf("Expected %v to be refused. Got status %d and %q", args, code, stderr)
+		}
+	}
+	t.Setenv("CREDCTL_TOKEN", api.AdminToken)
+	if code, _, stderr := runCredctl("-server", server.URL, "list"); code != 0 {
+		t.Errorf("Expected CREDCTL_TOKEN to be used. Got status %d and %q", code, stderr)
+	}
+}
+
+// Tests that bad command lines print the usage message.
+func TestUsage(t *testing.T) {
+	for _, args := range [][]string{{}, {"frobnicate"}, {"create", "only-a-username"}, {"-o", "yaml", "list"}} {
+		code, _, stderr := runCredctl(args...)
+		if code != 2 || !strings.Contains(stderr, "usage: credctl") {
+			t.Errorf("Expected usage for %v. Got status %d and %q", args, code, stderr)
+		}
+	}
+}
+
+func writeFile(path, contents string) error {
+	return os.WriteFile(path, []byte(contents), 0600)
+}
+
+// Tests verifying audit logs, whichever backend is chosen.
+func TestVerifyAudit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	log, err := audit.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, username := range []string{"student1", "student2"} {
+		if _, err := log.Append(audit.Event{Time: time.Now(), Action: api.EventUserCreated, Username: username}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	log.Close()
+
+	if code, stdout, stderr := runCredctl("-o", "json", "verify-audit", path); code != 0 || !strings.Contains(stdout, `"events": 2`) {
+		t.Fatalf("Expected the log to verify. Got status %d, output %q and %q", code, stdout, stderr)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFile(path, strings.Replace(string(data), "student2", "student3", 1)); err != nil {
+		t.Fatal(err)
+	}
+	if code, _, stderr := runCredctl("verify-audit", path); code != 1 || !strings.Contains(stderr, "line 2") {
+		t.Fatalf("Expected the edited log to fail on line 2. Got status %d and %q", code, stderr)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+)
+
+// Prints command output as either an aligned table or JSON.
+type printer struct {
+	w    io.Writer
+	json bool
+}
+
+// Prints a list of usernames.
+func (p *printer) users(names []string) error {
+	if p.json {
+		users := make([]map[string]string, len(names))
+		for i, name := range names {
+			users[i] = map[string]string{"username": name}
+		}
+		return p.encode(users)
+	}
+
+	tw := tabwriter.NewWriter(p.w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "INDEX\tUSERNAME")
+	for i, name := range names {
+		fmt.Fprintf(tw, "%d\t%s\n", i, name)
+	}
+	return tw.Flush()
+}
+
+// Prints the per user results of a command.
+func (p *printer) results(results []result) error {
+	if p.json {
+		return p.encode(results)
+	}
+
+	tw := tabwriter.NewWriter(p.w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "USERNAME\tSTATUS\tERROR")
+	for _, r := range results {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", r.Username, r.Status, r.Error)
+	}
+	return tw.Flush()
+}
+
+// Prints how many events a verified audit log holds and the hash of
+// the last one, which can be kept to notice events being removed.
+func (p *printer) audit(count int, head string) error {
+	if p.json {
+		return p.encode(map[string]interface{}{"events": count, "head": head})
+	}
+
+	tw := tabwriter.NewWriter(p.w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "EVENTS\tHEAD")
+	fmt.Fprintf(tw, "%d\t%s\n", count, head)
+	return tw.Flush()
+}
+
+func (p *printer) encode(v interface{}) error {
+	enc := json.NewEncoder(p.w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -0,0 +1,789 @@
+// Package config loads the settings the server starts with.
+//
+// Every setting can come from four places. From lowest to highest
+// precedence these are the defaults in Default, a config file, SERVER_*
+// environment variables and command line flags. A setting called
+// read_timeout is written as read_timeout in a config file, as
+// SERVER_READ_TIMEOUT in the environment and as -read-timeout on the
+// command line.
+//
+// The config file is named by the -config flag or the SERVER_CONFIG
+// environment variable. Its format is picked by extension: .json, .yaml,
+// .yml or .toml. Config files hold a single flat table of settings.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BearCloud/sp21-assignment-4/ratelimit"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// The prefix of every environment variable read by Load.
+const envPrefix = "SERVER_"
+
+// Config holds every setting of the server.
+type Config struct {
+	// The address the server listens on, as host:port.
+	Addr string
+
+	// Timeouts applied to every connection. See net/http.Server.
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+
+	// How long to keep serving with readiness checks failing once told
+	// to stop, so load balancers take the server out of rotation first.
+	ShutdownDelay time.Duration
+
+	// How long to wait for in-flight requests to finish on shutdown.
+	// Zero waits forever.
+	ShutdownTimeout time.Duration
+
+	// HTTPS is served when TLSCert and TLSKey name PEM files, or when
+	// TLSSelfSigned generates a development certificate for TLSHosts.
+	// Certificate files are checked for changes every TLSReloadInterval.
+	TLSCert           string
+	TLSKey            string
+	TLSSelfSigned     bool
+	TLSHosts          []string
+	TLSReloadInterval time.Duration
+
+	// When ClientCA names a PEM file of CA certificates, admin routes
+	// require a client certificate signed by one of them. AdminSubjects
+	// limits which certificate subjects, by common name or distinguished
+	// name, are admins. Requests sending AdminToken as a bearer token
+	// are admins too. With neither, admin routes are turned off.
+	ClientCA      string
+	AdminSubjects []string
+	AdminToken    string
+
+	// When set while serving HTTPS, plain HTTP on this address is
+	// redirected to HTTPS.
+	RedirectAddr string
+
+	// How long browsers should only use HTTPS with the server after
+	// reaching it over HTTPS. Zero sends no Strict-Transport-Security.
+	HSTSMaxAge time.Duration
+
+	// The largest request header and request body the server accepts.
+	// BodyLimits gives single routes their own body limit, such as
+	// "/api/v1/users:import=67108864". See ParseBodyLimit.
+	MaxHeaderBytes int
+	MaxBodyBytes   int64
+	BodyLimits     []string
+
+	// StrictJSON rejects JSON bodies with unknown fields and
+	// RequireJSONContentType rejects JSON bodies sent without
+	// Content-Type: application/json.
+	StrictJSON             bool
+	RequireJSONContentType bool
+
+	// Whether responses are compressed for clients that accept gzip or
+	// deflate, once they reach CompressMinBytes.
+	Compression      bool
+	CompressMinBytes int
+
+	// Where users are kept, either "memory" or "file". StorePath is the
+	// store file used by the file backend.
+	Store     string
+	StorePath string
+
+	// The least severe log messages that are written: "debug", "info",
+	// "warn" or "error".
+	LogLevel string
+
+	// Where spans are sent: "none", "stdout" or "otlp". TraceEndpoint
+	// is the collector URL used by "otlp" and TraceService the service
+	// name spans are reported under.
+	TraceExporter string
+	TraceEndpoint string
+	TraceService  string
+
+	// Rate limits such as "ip:/api/signup=20/m". See ratelimit.ParseRule.
+	// RateLimitStore is the URL of a shared store served by another
+	// instance on its RateLimitListen address, or empty to keep limits
+	// in memory. Instances sharing a store must share RateLimitSecret.
+	RateLimits      []string
+	RateLimitStore  string
+	RateLimitListen string
+	RateLimitSecret string
+
+	// After LockoutThreshold failed password checks in a row an account
+	// is locked for LockoutDuration. Checks are refused for LockoutBackoff
+	// after a failure, doubling with each one. A threshold of 0 turns
+	// lockouts off.
+	LockoutThreshold int
+	LockoutDuration  time.Duration
+	LockoutBackoff   time.Duration
+
+	// When set, responses don't reveal which usernames exist. See
+	// api.HardenedMode.
+	Hardened bool
+
+	// Origins browsers may call routes from, such as
+	// "https://*.bearchat.dev" for every route or
+	// "/api/getCookie=https://bearchat.dev" for one. See ParseCORSOrigin.
+	// CORSCredentials lets them send cookies, CORSExposedHeaders lists
+	// the response headers they may read and CORSMaxAge is how long
+	// they may cache preflights.
+	CORSOrigins        []string
+	CORSCredentials    bool
+	CORSExposedHeaders []string
+	CORSMaxAge         time.Duration
+
+	// Whether requests changing state with the access_token cookie must
+	// pass CSRF checks. See api.CSRFProtection.
+	CSRF bool
+
+	// How long responses to requests with an Idempotency-Key are kept
+	// for replaying to retries. Zero turns idempotency keys off.
+	IdempotencyWindow time.Duration
+	// How many of those responses are kept, and how many bytes they may
+	// take altogether, before the oldest are dropped.
+	IdempotencyMaxKeys  int
+	IdempotencyMaxBytes int64
+
+	// The file every user created, password changed and user deleted is
+	// recorded in, or empty to keep no audit log.
+	AuditLog string
+
+	// Endpoints told about changes to users, such as
+	// "user.created|user.deleted=https://hooks.bearchat.dev/users" or a
+	// bare URL for every event. See ParseWebhook. Payloads are signed
+	// with WebhookSecret. Failed deliveries are tried up to
+	// WebhookMaxAttempts times, waiting WebhookBackoff before the first
+	// retry and twice as long before each one after, up to
+	// WebhookMaxBackoff.
+	Webhooks           []string
+	WebhookSecret      string
+	WebhookMaxAttempts int
+	WebhookBackoff     time.Duration
+	WebhookMaxBackoff  time.Duration
+
+	// How many of the latest events /api/v1/events keeps for clients
+	// resuming with Last-Event-ID, and how often idle streams are sent
+	// a heartbeat.
+	EventBuffer    int
+	EventHeartbeat time.Duration
+}
+
+// Default returns the settings used when nothing else is configured.
+func Default() Config {
+	return Config{
+		Addr:              ":80",
+		ReadTimeout:       10 * time.Second,
+		ReadHeaderTimeout: 5 * time.Second,
+		WriteTimeout:      10 * time.Second,
+		IdleTimeout:       60 * time.Second,
+		ShutdownDelay:     5 * time.Second,
+		ShutdownTimeout:   30 * time.Second,
+		TLSHosts:          []string{"localhost", "127.0.0.1"},
+		TLSReloadInterval: 10 * time.Second,
+		HSTSMaxAge:        365 * 24 * time.Hour,
+		MaxHeaderBytes:    1 << 20,
+		MaxBodyBytes:      1 << 20,
+		BodyLimits:        []string{"/api/v1/users:import=67108864"},
+		Compression:       true,
+		CompressMinBytes:  1024,
+		Store:             "memory",
+		StorePath:         "users.json",
+		LogLevel:          "info",
+		TraceExporter:     "none",
+		TraceEndpoint:     "http://localhost:4318/v1/traces",
+		TraceService:      "credentials",
+		RateLimits: []string{
+			"ip:/api/signup=20/m",
+			"ip:/api/getIndex=60/m",
+			"username:/api/getIndex=10/m",
+			"ip:/api/getPW=60/m",
+			"username:/api/getPW=10/m",
+			"ip:/api/updatePW=60/m",
+			"username:/api/updatePW=10/m",
+			"ip:/api/verify=60/m",
+			"username:/api/verify=10/m",
+		},
+		LockoutThreshold:    5,
+		LockoutDuration:     15 * time.Minute,
+		LockoutBackoff:      time.Second,
+		CORSExposedHeaders:  []string{"X-Request-ID", "Retry-After", "X-CSRF-Token", "ETag"},
+		CSRF:                true,
+		CORSMaxAge:          10 * time.Minute,
+		IdempotencyWindow:   24 * time.Hour,
+		IdempotencyMaxKeys:  10000,
+		IdempotencyMaxBytes: 64 << 20,
+		WebhookMaxAttempts:  8,
+		WebhookBackoff:      time.Second,
+		WebhookMaxBackoff:   5 * time.Minute,
+		EventBuffer:         1000,
+		EventHeartbeat:      15 * time.Second,
+	}
+}
+
+// A single setting. Value points at the field of a Config it sets.
+type option struct {
+	name  string
+	usage string
+	value interface{}
+}
+
+// Lists every setting of c. Adding a setting only takes a field in
+// Config, a default and an entry here.
+func (c *Config) options() []option {
+	return []option{
+		{"addr", "address to listen on, as host:port", &c.Addr},
+		{"read_timeout", "maximum duration for reading an entire request", &c.ReadTimeout},
+		{"read_header_timeout", "maximum duration for reading request headers", &c.ReadHeaderTimeout},
+		{"write_timeout", "maximum duration before timing out writes of a response", &c.WriteTimeout},
+		{"idle_timeout", "maximum time to wait for the next request on a keep-alive connection", &c.IdleTimeout},
+		{"shutdown_delay", "how long to keep serving with /readyz failing before draining on shutdown", &c.ShutdownDelay},
+		{"shutdown_timeout", "maximum time to drain in-flight requests on shutdown, 0 for no limit", &c.ShutdownTimeout},
+		{"tls_cert", "PEM certificate file to serve HTTPS with", &c.TLSCert},
+		{"tls_key", "PEM private key file for tls_cert", &c.TLSKey},
+		{"tls_self_signed", "serve HTTPS with a generated self-signed development certificate", &c.TLSSelfSigned},
+		{"tls_hosts", "comma separated hosts the self-signed certificate is for", &c.TLSHosts},
+		{"tls_reload_interval", "how often to check the certificate files for changes", &c.TLSReloadInterval},
+		{"client_ca", "PEM file of CAs whose client certificates may use admin routes", &c.ClientCA},
+		{"admin_subjects", "comma separated client certificate subjects allowed to use admin routes, empty for any", &c.AdminSubjects},
+		{"admin_token", "bearer token that may use admin routes, as well as client certificates", &c.AdminToken},
+		{"redirect_addr", "address to redirect plain HTTP to HTTPS from, as host:port", &c.RedirectAddr},
+		{"hsts_max_age", "how long browsers should only use HTTPS with the server, 0 to not send HSTS", &c.HSTSMaxAge},
+		{"max_header_bytes", "largest request header accepted, in bytes", &c.MaxHeaderBytes},
+		{"max_body_bytes", "largest request body accepted, in bytes", &c.MaxBodyBytes},
+		{"body_limits", "comma separated body limits for single routes, such as /api/v1/users:import=67108864", &c.BodyLimits},
+		{"strict_json", "reject JSON bodies with unknown fields", &c.StrictJSON},
+		{"require_json_content_type", "reject JSON bodies sent without Content-Type: application/json", &c.RequireJSONContentType},
+		{"compression", "compress responses for clients that accept gzip or deflate", &c.Compression},
+		{"compress_min_bytes", "smallest response body that is compressed, in bytes", &c.CompressMinBytes},
+		{"store", "where users are kept: memory or file", &c.Store},
+		{"store_path", "store file used by the file store", &c.StorePath},
+		{"log_level", "least severe messages logged: debug, info, warn or error", &c.LogLevel},
+		{"trace_exporter", "where spans are sent: none, stdout or otlp", &c.TraceExporter},
+		{"trace_endpoint", "OTLP/HTTP collector URL spans are posted to", &c.TraceEndpoint},
+		{"trace_service", "service name spans are reported under", &c.TraceService},
+		{"rate_limits", "comma separated rate limits such as ip:/api/signup=20/m or username:/api/getPW=10/m", &c.RateLimits},
+		{"rate_limit_store", "URL of a rate limit store shared with other instances, empty to keep limits in memory", &c.RateLimitStore},
+		{"rate_limit_listen", "address to share this instance's rate limit store on, as host:port", &c.RateLimitListen},
+		{"rate_limit_secret", "secret instances sharing a rate limit store authenticate with", &c.RateLimitSecret},
+		{"lockout_threshold", "failed password checks in a row that lock an account, 0 to never lock", &c.LockoutThreshold},
+		{"lockout_duration", "how long a locked account stays locked", &c.LockoutDuration},
+		{"lockout_backoff", "how long password checks are refused after a failure, doubling with each failure", &c.LockoutBackoff},
+		{"hardened", "respond the same whether or not a username exists, requiring passwords to look users up", &c.Hardened},
+		{"cors_origins", "comma separated origins browsers may call from, such as https://*.bearchat.dev or /api/getCookie=https://bearchat.dev", &c.CORSOrigins},
+		{"cors_credentials", "let cross-origin requests send cookies", &c.CORSCredentials},
+		{"cors_exposed_headers", "comma separated response headers cross-origin requests may read", &c.CORSExposedHeaders},
+		{"cors_max_age", "how long browsers may cache CORS preflights", &c.CORSMaxAge},
+		{"csrf", "require CSRF tokens on requests changing state with the access_token cookie", &c.CSRF},
+		{"idempotency_window", "how long responses to requests with an Idempotency-Key are replayed to retries, 0 to turn keys off", &c.IdempotencyWindow},
+		{"idempotency_max_keys", "how many responses to requests with an Idempotency-Key are kept before the oldest are dropped", &c.IdempotencyMaxKeys},
+		{"idempotency_max_bytes", "how many bytes of responses to requests with an Idempotency-Key are kept before the oldest are dropped", &c.IdempotencyMaxBytes},
+		{"audit_log", "file to record every change to a user in, empty for no audit log", &c.AuditLog},
+		{"webhooks", "comma separated endpoints told about changes to users, such as user.created|user.deleted=https://hooks.bearchat.dev/users", &c.Webhooks},
+		{"webhook_secret", "secret webhook payloads are signed with", &c.WebhookSecret},
+		{"webhook_max_attempts", "how many times a webhook delivery is tried before it is dead-lettered", &c.WebhookMaxAttempts},
+		{"webhook_backoff", "how long to wait before retrying a webhook delivery, doubling with each retry", &c.WebhookBackoff},
+		{"webhook_max_backoff", "longest wait between retries of a webhook delivery", &c.WebhookMaxBackoff},
+		{"event_buffer", "how many of the latest events are kept for event streams resuming with Last-Event-ID", &c.EventBuffer},
+		{"event_heartbeat", "how often idle event streams are sent a heartbeat", &c.EventHeartbeat},
+	}
+}
+
+// Errors lists every problem found while loading a Config.
+type Errors []string
+
+func (e Errors) Error() string {
+	return "invalid configuration: " + strings.Join(e, "; ")
+}
+
+// Load builds a Config from the defaults, the config file, the
+// environment and args, which should not include the program name.
+// lookupEnv is usually os.LookupEnv. If -h is given Load returns
+// flag.ErrHelp after printing the usage message to output.
+func Load(args []string, lookupEnv func(string) (string, bool), output io.Writer) (*Config, error) {
+	c := Default()
+	opts := c.options()
+
+	// Parse the flags first so -config is known, but apply them last.
+	flags := flag.NewFlagSet("server", flag.ContinueOnError)
+	flags.SetOutput(output)
+	configFile := flags.String("config", "", "config file to read (.json, .yaml, .yml or .toml)")
+	fromFlags := map[string]string{}
+	for i := range opts {
+		flags.Var(&flagValue{&opts[i], fromFlags}, flagName(opts[i].name), opts[i].usage+defaultText(opts[i]))
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if flags.NArg() > 0 {
+		return nil, Errors{fmt.Sprintf("unexpected argument %q", flags.Arg(0))}
+	}
+
+	var errs Errors
+	if *configFile == "" {
+		*configFile, _ = lookupEnv(envPrefix + "CONFIG")
+	}
+	if *configFile != "" {
+		fromFile, err := readFile(*configFile)
+		if errs, ok := err.(Errors); ok {
+			return nil, errs
+		} else if err != nil {
+			return nil, Errors{err.Error()}
+		}
+		errs = append(errs, apply(opts, fromFile, func(name string) string { return *configFile + ": " + name })...)
+	}
+
+	fromEnv := map[string]string{}
+	for _, opt := range opts {
+		if value, ok := lookupEnv(envName(opt.name)); ok {
+			fromEnv[opt.name] = value
+		}
+	}
+	errs = append(errs, apply(opts, fromEnv, envName)...)
+	errs = append(errs, apply(opts, fromFlags, func(name string) string { return "-" + flagName(name) })...)
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// Secrets shorter than this are too easy to guess.
+const minSecretLen = 16
+
+// Validate checks that every setting makes sense, returning Errors
+// describing each one that doesn't.
+func (c *Config) Validate() error {
+	var errs Errors
+	if _, _, err := net.SplitHostPort(c.Addr); err != nil {
+		errs = append(errs, fmt.Sprintf("addr %q is not host:port", c.Addr))
+	}
+	timeouts := []struct {
+		name  string
+		value time.Duration
+	}{
+		{"read_timeout", c.ReadTimeout},
+		{"read_header_timeout", c.ReadHeaderTimeout},
+		{"write_timeout", c.WriteTimeout},
+		{"idle_timeout", c.IdleTimeout},
+		{"shutdown_delay", c.ShutdownDelay},
+		{"shutdown_timeout", c.ShutdownTimeout},
+		{"hsts_max_age", c.HSTSMaxAge},
+		{"idempotency_window", c.IdempotencyWindow},
+	}
+	for _, timeout := range timeouts {
+		if timeout.value < 0 {
+			errs = append(errs, timeout.name+" must not be negative")
+		}
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		errs = append(errs, "tls_cert and tls_key must be given together")
+	}
+	if c.TLSSelfSigned && c.TLSCert != "" {
+		errs = append(errs, "tls_self_signed cannot be used with tls_cert")
+	}
+	if c.TLSSelfSigned && len(c.TLSHosts) == 0 {
+		errs = append(errs, "tls_hosts is required by tls_self_signed")
+	}
+	if c.TLSCert != "" && c.TLSReloadInterval <= 0 {
+		errs = append(errs, "tls_reload_interval must be positive")
+	}
+	if c.ClientCA != "" && !c.TLS() {
+		errs = append(errs, "client_ca needs HTTPS to be configured")
+	}
+	if len(c.AdminSubjects) > 0 && c.ClientCA == "" {
+		errs = append(errs, "admin_subjects needs client_ca")
+	}
+	if c.AdminToken != "" && len(c.AdminToken) < minSecretLen {
+		errs = append(errs, fmt.Sprintf("admin_token must be at least %d characters", minSecretLen))
+	}
+	if c.RedirectAddr != "" {
+		if !c.TLS() {
+			errs = append(errs, "redirect_addr needs HTTPS to be configured")
+		} else if _, _, err := net.SplitHostPort(c.RedirectAddr); err != nil {
+			errs = append(errs, fmt.Sprintf("redirect_addr %q is not host:port", c.RedirectAddr))
+		}
+	}
+	if c.MaxHeaderBytes <= 0 {
+		errs = append(errs, "max_header_bytes must be positive")
+	}
+	if c.MaxBodyBytes <= 0 {
+		errs = append(errs, "max_body_bytes must be positive")
+	}
+	if c.IdempotencyMaxKeys <= 0 || c.IdempotencyMaxBytes <= 0 {
+		errs = append(errs, "idempotency_max_keys and idempotency_max_bytes must be positive")
+	}
+	if c.CompressMinBytes < 0 {
+		errs = append(errs, "compress_min_bytes must not be negative")
+	}
+	for _, spec := range c.BodyLimits {
+		if _, _, err := ParseBodyLimit(spec); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	switch c.Store {
+	case "memory":
+	case "file":
+		if c.StorePath == "" {
+			errs = append(errs, "store_path is required by the file store")
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("store %q must be memory or file", c.Store))
+	}
+	switch c.LogLevel {
+	case "debug", "info", "warn", "error":
+	default:
+		errs = append(errs, fmt.Sprintf("log_level %q must be debug, info, warn or error", c.LogLevel))
+	}
+	switch c.TraceExporter {
+	case "none", "stdout":
+	case "otlp":
+		if u, err := url.Parse(c.TraceEndpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Sprintf("trace_endpoint %q must be an http or https URL", c.TraceEndpoint))
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("trace_exporter %q must be none, stdout or otlp", c.TraceExporter))
+	}
+	for _, spec := range c.RateLimits {
+		if _, err := ratelimit.ParseRule(spec); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if c.RateLimitStore != "" {
+		if u, err := url.Parse(c.RateLimitStore); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Sprintf("rate_limit_store %q must be an http or https URL", c.RateLimitStore))
+		}
+		if c.RateLimitListen != "" {
+			errs = append(errs, "rate_limit_listen cannot be used with rate_limit_store")
+		}
+	}
+	if c.RateLimitListen != "" {
+		if _, _, err := net.SplitHostPort(c.RateLimitListen); err != nil {
+			errs = append(errs, fmt.Sprintf("rate_limit_listen %q must be host:port", c.RateLimitListen))
+		}
+	}
+	if (c.RateLimitStore != "" || c.RateLimitListen != "") && len(c.RateLimitSecret) < minSecretLen {
+		errs = append(errs, fmt.Sprintf("rate_limit_secret of at least %d characters is required by rate_limit_store and rate_limit_listen", minSecretLen))
+	}
+	if c.LockoutThreshold < 0 {
+		errs = append(errs, "lockout_threshold must not be negative")
+	}
+	if c.LockoutDuration <= 0 || c.LockoutBackoff <= 0 {
+		errs = append(errs, "lockout_duration and lockout_backoff must be positive")
+	}
+	for _, spec := range c.CORSOrigins {
+		_, origin, err := ParseCORSOrigin(spec)
+		if err != nil {
+			errs = append(errs, err.Error())
+		} else if origin == "*" && c.CORSCredentials {
+			errs = append(errs, "cors_origins cannot allow every origin with cors_credentials")
+		}
+	}
+	if c.CORSMaxAge < 0 {
+		errs = append(errs, "cors_max_age must not be negative")
+	}
+	for _, spec := range c.Webhooks {
+		if _, _, err := ParseWebhook(spec); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(c.Webhooks) > 0 && c.WebhookSecret == "" {
+		errs = append(errs, "webhook_secret is required by webhooks")
+	}
+	if c.WebhookMaxAttempts <= 0 || c.WebhookBackoff <= 0 || c.WebhookMaxBackoff < c.WebhookBackoff {
+		errs = append(errs, "webhook_max_attempts and webhook_backoff must be positive, and webhook_max_backoff at least webhook_backoff")
+	}
+	if c.EventBuffer < 0 {
+		errs = append(errs, "event_buffer must not be negative")
+	}
+	if c.EventHeartbeat <= 0 {
+		errs = append(errs, "event_heartbeat must be positive")
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// ParseBodyLimit parses an entry of body_limits, such as
+// "/api/v1/users:import=67108864", giving a mux route template and the
+// largest body in bytes that route accepts.
+func ParseBodyLimit(spec string) (route string, limit int64, err error) {
+	equals := strings.LastIndexByte(spec, '=')
+	if equals < 0 || !strings.HasPrefix(spec, "/") {
+		return "", 0, fmt.Errorf("body limit %q must look like /route=1048576", spec)
+	}
+	limit, err = strconv.ParseInt(spec[equals+1:], 10, 64)
+	if err != nil || limit <= 0 {
+		return "", 0, fmt.Errorf("body limit %q must end with a positive number of bytes", spec)
+	}
+	return spec[:equals], limit, nil
+}
+
+// ParseCORSOrigin parses an entry of cors_origins, which is either an
+// origin such as "https://bearchat.dev" allowed on every route, or
+// "<route>=<origin>" allowing it on a single mux route template. The
+// host of an origin may start with "*." to allow every subdomain, and
+// "*" on its own allows every origin.
+func ParseCORSOrigin(spec string) (route, origin string, err error) {
+	origin = spec
+	if i := strings.IndexByte(spec, '='); i >= 0 {
+		route, origin = spec[:i], spec[i+1:]
+		if !strings.HasPrefix(route, "/") {
+			return "", "", fmt.Errorf("cors origin %q must name a route starting with /", spec)
+		}
+	}
+	if origin == "*" {
+		return route, origin, nil
+	}
+	u, err := url.Parse(strings.Replace(origin, "://*.", "://wildcard.", 1))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" ||
+		u.Path != "" || u.RawQuery != "" || u.User != nil || strings.Contains(u.Host, "*") {
+		return "", "", fmt.Errorf("cors origin %q must look like https://host or https://*.host", spec)
+	}
+	return route, origin, nil
+}
+
+// The events webhooks can subscribe to.
+var webhookEvents = map[string]bool{"user.created": true, "user.password_changed": true, "user.deleted": true}
+
+// ParseWebhook parses an entry of webhooks, which is either a URL that
+// is sent every event, or "<event>|<event>...=<url>" sending it only
+// those events. Events are user.created, user.password_changed and
+// user.deleted.
+func ParseWebhook(spec string) (events []string, endpoint string, err error) {
+	endpoint = spec
+	if i := strings.IndexByte(spec, '='); i >= 0 && !strings.Contains(spec[:i], "/") {
+		for _, event := range strings.Split(spec[:i], "|") {
+			if !webhookEvents[event] {
+				return nil, "", fmt.Errorf("webhook %q has unknown event %q", spec, event)
+			}
+			events = append(events, event)
+		}
+		endpoint = spec[i+1:]
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, "", fmt.Errorf("webhook %q must end with an http or https URL", spec)
+	}
+	return events, endpoint, nil
+}
+
+// TLS reports whether the server serves HTTPS.
+func (c *Config) TLS() bool {
+	return c.TLSCert != "" || c.TLSSelfSigned
+}
+
+// Sets every option named in values, describing bad values using the
+// name source gives the option.
+func apply(opts []option, values map[string]string, source func(string) string) Errors {
+	var errs Errors
+	for _, opt := range opts {
+		value, ok := values[opt.name]
+		if !ok {
+			continue
+		}
+		if err := set(opt, value); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", source(opt.name), err))
+		}
+	}
+	return errs
+}
+
+// Parses value into the field opt points at.
+func set(opt option, value string) error {
+	value = strings.TrimSpace(value)
+	switch field := opt.value.(type) {
+	case *string:
+		*field = value
+	case *int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", value)
+		}
+		*field = n
+	case *int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", value)
+		}
+		*field = n
+	case *bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean", value)
+		}
+		*field = b
+	case *time.Duration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a duration such as 10s", value)
+		}
+		*field = d
+	case *[]string:
+		*field = nil
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				*field = append(*field, item)
+			}
+		}
+	default:
+		panic("config: unsupported option type for " + opt.name)
+	}
+	return nil
+}
+
+// Returns the current value of the field opt points at as a string.
+func get(opt option) string {
+	switch field := opt.value.(type) {
+	case *string:
+		return *field
+	case *int:
+		return strconv.Itoa(*field)
+	case *int64:
+		return strconv.FormatInt(*field, 10)
+	case *bool:
+		return strconv.FormatBool(*field)
+	case *time.Duration:
+		return field.String()
+	case *[]string:
+		return strings.Join(*field, ",")
+	}
+	return ""
+}
+
+// Reads a config file into a map of option names to values.
+func readFile(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := map[string]interface{}{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		err = decoder.Decode(&raw)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &raw)
+	case ".toml":
+		err = toml.Unmarshal(data, &raw)
+	default:
+		return nil, fmt.Errorf("%s: unknown config file format, use .json, .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	known := map[string]bool{}
+	for _, opt := range (&Config{}).options() {
+		known[opt.name] = true
+	}
+	values := map[string]string{}
+	var errs Errors
+	for _, key := range sortedKeys(raw) {
+		name := strings.ReplaceAll(strings.ToLower(key), "-", "_")
+		if !known[name] {
+			errs = append(errs, fmt.Sprintf("%s: unknown setting %q", path, key))
+			continue
+		}
+		value, err := flatten(raw[key])
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s: %s", path, key, err))
+			continue
+		}
+		values[name] = value
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return values, nil
+}
+
+// Turns a value decoded from a config file into the string form set
+// understands. Lists become comma separated.
+func flatten(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			s, err := flatten(item)
+			if err != nil {
+				return "", err
+			}
+			items[i] = s
+		}
+		return strings.Join(items, ","), nil
+	case map[string]interface{}:
+		return "", errors.New("nested tables are not supported")
+	case nil:
+		return "", nil
+	}
+	return fmt.Sprint(value), nil
+}
+
+// A flag.Value that records the raw string given for an option.
+type flagValue struct {
+	opt  *option
+	seen map[string]string
+}
+
+func (f *flagValue) String() string {
+	if f == nil || f.opt == nil {
+		return ""
+	}
+	return f.seen[f.opt.name]
+}
+
+func (f *flagValue) Set(value string) error {
+	f.seen[f.opt.name] = value
+	return nil
+}
+
+func (f *flagValue) IsBoolFlag() bool {
+	_, ok := f.opt.value.(*bool)
+	return ok
+}
+
+func defaultText(opt option) string {
+	if value := get(opt); value != "" && value != "false" {
+		return fmt.Sprintf(" (default %s)", value)
+	}
+	return ""
+}
+
+func flagName(name string) string {
+	return strings.ReplaceAll(name, "_", "-")
+}
+
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(name)
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,170 @@
+package config
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Returns a lookupEnv function backed by a map.
+func env(vars map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, ok := vars[name]
+		return value, ok
+	}
+}
+
+// Writes a config file into a temporary directory and returns its path.
+func writeConfig(t *testing.T, name, contents string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Tests that the defaults are valid on their own.
+func TestDefault(t *testing.T) {
+	c, err := Load(nil, env(nil), ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*c, Default()) {
+		t.Fatalf("Expected the defaults. Got %+v", *c)
+	}
+}
+
+// Tests that every file format is understood.
+func TestFileFormats(t *testing.T) {
+	files := []struct {
+		Name     string
+		Contents string
+	}{
+		{"server.json", `{"addr": ":8080", "read_timeout": "3s", "max_body_bytes": 2048, "store": "file"}`},
+		{"server.yaml", "addr: :8080\nread-timeout: 3s\nmax_body_bytes: 2048\nstore: file\n"},
+		{"server.toml", "addr = \":8080\"\nread_timeout = \"3s\"\nmax_body_bytes = 2048\nstore = \"file\"\n"},
+	}
+
+	for _, file := range files {
+		t.Run(file.Name, func(t *testing.T) {
+			path := writeConfig(t, file.Name, file.Contents)
+			c, err := Load([]string{"-config", path}, env(nil), ioutil.Discard)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.Addr != ":8080" || c.ReadTimeout != 3*time.Second || c.MaxBodyBytes != 2048 || c.Store != "file" {
+				t.Fatalf("Settings were not read from the file: %+v", *c)
+			}
+		})
+	}
+}
+
+// Tests that flags beat the environment, which beats the config file.
+func TestPrecedence(t *testing.T) {
+	path := writeConfig(t, "server.yaml", "addr: :1000\nread_timeout: 1s\nwrite_timeout: 1s\n")
+	vars := map[string]string{
+		"SERVER_CONFIG":        path,
+		"SERVER_READ_TIMEOUT":  "2s",
+		"SERVER_WRITE_TIMEOUT": "2s",
+	}
+	c, err := Load([]string{"-write-timeout", "3s"}, env(vars), ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Addr != ":1000" || c.ReadTimeout != 2*time.Second || c.WriteTimeout != 3*time.Second {
+		t.Fatalf("Settings were applied in the wrong order: %+v", *c)
+	}
+}
+
+// Tests that bad settings are all reported together.
+func TestValidation(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Args     []string
+		Vars     map[string]string
+		Expected []string
+	}{
+		{"Bad Values", []string{"-addr", "nope", "-store", "disk", "-log-level", "loud"}, nil,
+			[]string{`addr "nope"`, `store "disk"`, `log_level "loud"`}},
+		{"Unparsable Values", []string{"-read-timeout", "soon"}, map[string]string{"SERVER_MAX_HEADER_BYTES": "lots"},
+			[]string{"-read-timeout", "SERVER_MAX_HEADER_BYTES"}},
+		{"Negative Values", []string{"-idle-timeout", "-1s", "-max-body-bytes", "0"}, nil,
+			[]string{"idle_timeout must not be negative", "max_body_bytes must be positive"}},
+		{"Bad Idempotency Limits", []string{"-idempotency-max-keys", "0"}, nil,
+			[]string{"idempotency_max_keys and idempotency_max_bytes must be positive"}},
+		{"Bad Body Limits", []string{"-body-limits", "/api/signup=1024,api/getPW=10,/api/verify=lots"}, nil,
+			[]string{`body limit "api/getPW=10"`, `body limit "/api/verify=lots"`}},
+		{"Bad Webhooks", []string{"-webhooks", "user.created|user.signed_in=https://hooks.bearchat.dev,ftp://hooks.bearchat.dev", "-webhook-backoff", "0s"}, nil,
+			[]string{`unknown event "user.signed_in"`, `webhook "ftp://hooks.bearchat.dev"`, "webhook_secret is required", "webhook_backoff must be positive"}},
+		{"Bad Lockouts", []string{"-lockout-threshold", "-1", "-lockout-backoff", "0s"}, nil,
+			[]string{"lockout_threshold must not be negative", "lockout_backoff must be positive"}},
+		{"Bad TLS", []string{"-tls-cert", "cert.pem", "-redirect-addr", ":80"}, nil,
+			[]string{"tls_cert and tls_key must be given together"}},
+		{"Short Admin Token", []string{"-admin-token", "hunter2"}, nil,
+			[]string{"admin_token must be at least 16 characters"}},
+		{"Redirect Without TLS", []string{"-redirect-addr", ":80"}, nil,
+			[]string{"redirect_addr needs HTTPS"}},
+		{"Self Signed And Files", []string{"-tls-self-signed", "-tls-cert", "a", "-tls-key", "b"}, nil,
+			[]string{"tls_self_signed cannot be used with tls_cert"}},
+		{"Missing Store Path", []string{"-store", "file", "-store-path", ""}, nil,
+			[]string{"store_path is required"}},
+		{"Bad Tracing", []string{"-trace-exporter", "jaeger"}, map[string]string{"SERVER_TRACE_ENDPOINT": "localhost:4318"},
+			[]string{`trace_exporter "jaeger"`}},
+		{"Bad Trace Endpoint", []string{"-trace-exporter", "otlp", "-trace-endpoint", "localhost:4318"}, nil,
+			[]string{`trace_endpoint "localhost:4318"`}},
+		{"Bad Rate Limits", []string{"-rate-limits", "ip:/api/signup=20/m,cookie:/api/getPW=1/s", "-rate-limit-store", "limits:9000", "-rate-limit-listen", ":9000"}, nil,
+			[]string{`rate limit "cookie:/api/getPW=1/s"`, `rate_limit_store "limits:9000"`, "rate_limit_listen cannot be used with rate_limit_store",
+				"rate_limit_secret of at least 16 characters is required"}},
+		{"Bad CORS", []string{"-cors-origins", "https://*.bearchat.dev,api/getCookie=https://bearchat.dev,https://bearchat.dev/app,*", "-cors-credentials"}, nil,
+			[]string{`cors origin "api/getCookie=https://bearchat.dev"`, `cors origin "https://bearchat.dev/app"`, "cannot allow every origin with cors_credentials"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			_, err := Load(test.Args, env(test.Vars), ioutil.Discard)
+			if _, ok := err.(Errors); !ok {
+				t.Fatalf("Expected Errors. Got %v", err)
+			}
+			for _, expected := range test.Expected {
+				if !strings.Contains(err.Error(), expected) {
+					t.Errorf("Expected %q in %q", expected, err)
+				}
+			}
+		})
+	}
+
+	// Problems with the config file itself.
+	files := []struct {
+		Name     string
+		Contents string
+		Expected string
+	}{
+		{"server.json", `{"adr": ":80"}`, `unknown setting "adr"`},
+		{"server.yaml", "addr: [1, 2\n", "server.yaml"},
+		{"server.toml", "[store]\npath = \"x\"\n", "nested tables are not supported"},
+		{"server.ini", "addr=:80", "unknown config file format"},
+	}
+	for _, file := range files {
+		path := writeConfig(t, file.Name, file.Contents)
+		_, err := Load([]string{"-config", path}, env(nil), ioutil.Discard)
+		if err == nil || !strings.Contains(err.Error(), file.Expected) {
+			t.Errorf("Expected an error containing %q for %s. Got %v", file.Expected, file.Name, err)
+		}
+	}
+}
+
+// Tests that -h prints the usage message.
+func TestHelp(t *testing.T) {
+	var output strings.Builder
+	_, err := Load([]string{"-h"}, env(nil), &output)
+	if err != flag.ErrHelp {
+		t.Fatalf("Expected flag.ErrHelp. Got %v", err)
+	}
+	if !strings.Contains(output.String(), "-read-timeout") || !strings.Contains(output.String(), "(default 10s)") {
+		t.Fatalf("Usage message is missing settings: %s", output.String())
+	}
+}
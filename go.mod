@@ -1,5 +1,13 @@
 module github.com/BearCloud/sp21-assignment-4
 
-go 1.16
+go 1.20
 
-require github.com/gorilla/mux v1.8.0
+require (
+	github.com/BurntSushi/toml v1.2.1
+	github.com/gorilla/mux v1.8.0
+	github.com/vmihailenco/msgpack/v5 v5.4.1
+	golang.org/x/crypto v0.24.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
@@ -0,0 +1,213 @@
+// Package logging writes structured logs as one JSON object per line.
+//
+// Each line holds the time, level and message followed by key value
+// pairs in the order they were given:
+//
+//	{"time":"2021-04-01T12:00:00Z","level":"info","msg":"user signed up","request_id":"4f1c...","username":"oski"}
+//
+// Secrets are kept out of logs in two ways. Any key containing
+// "password", "secret" or "token" has its value replaced, and values
+// implementing Redacter are logged as whatever Redacted returns.
+package logging
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Level is the severity of a log line.
+type Level int
+
+// The levels in increasing order of severity.
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel returns the level called name, such as "warn".
+func ParseLevel(name string) (Level, error) {
+	for i, levelName := range levelNames {
+		if name == levelName {
+			return Level(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", name)
+}
+
+// A Redacter is a value that may hold secrets. Only the result of
+// Redacted is logged.
+type Redacter interface {
+	Redacted() interface{}
+}
+
+// Written in place of secret values.
+const redacted = "[REDACTED]"
+
+// Keys whose values are never logged.
+var secretKeys = []string{"password", "secret", "token"}
+
+// A Logger writes lines at or above its level. Loggers are safe for
+// concurrent use.
+type Logger struct {
+	out    *output
+	level  Level
+	fields []interface{}
+}
+
+// Shared by a Logger and everything made from it by With so lines
+// are never interleaved.
+type output struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+// New returns a Logger writing lines at or above level to w.
+func New(w io.Writer, level Level) *Logger {
+	return &Logger{out: &output{w: w}, level: level}
+}
+
+var (
+	defaultLock   sync.Mutex
+	defaultLogger = New(os.Stderr, LevelInfo)
+)
+
+// Default returns the logger used when no other is given. It writes
+// info and above to standard error until SetDefault is called.
+func Default() *Logger {
+	defaultLock.Lock()
+	defer defaultLock.Unlock()
+	return defaultLogger
+}
+
+// SetDefault replaces the logger returned by Default.
+func SetDefault(l *Logger) {
+	defaultLock.Lock()
+	defer defaultLock.Unlock()
+	defaultLogger = l
+}
+
+// With returns a Logger that adds the given key value pairs to every line.
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(keyvals))
+	fields = append(fields, l.fields...)
+	fields = append(fields, keyvals...)
+	return &Logger{out: l.out, level: l.level, fields: fields}
+}
+
+// Enabled reports whether lines at level are written.
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.level
+}
+
+// Debug logs msg with the given key value pairs at LevelDebug.
+func (l *Logger) Debug(msg string, keyvals ...interface{}) { l.Log(LevelDebug, msg, keyvals...) }
+
+// Info logs msg with the given key value pairs at LevelInfo.
+func (l *Logger) Info(msg string, keyvals ...interface{}) { l.Log(LevelInfo, msg, keyvals...) }
+
+// Warn logs msg with the given key value pairs at LevelWarn.
+func (l *Logger) Warn(msg string, keyvals ...interface{}) { l.Log(LevelWarn, msg, keyvals...) }
+
+// Error logs msg with the given key value pairs at LevelError.
+func (l *Logger) Error(msg string, keyvals ...interface{}) { l.Log(LevelError, msg, keyvals...) }
+
+// Log writes a line at level if it is enabled. Keys should be strings;
+// a key without a value is logged with the value null.
+func (l *Logger) Log(level Level, msg string, keyvals ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	var line strings.Builder
+	line.WriteString(`{"time":`)
+	writeJSON(&line, time.Now().UTC().Format(time.RFC3339Nano))
+	line.WriteString(`,"level":`)
+	writeJSON(&line, level.String())
+	line.WriteString(`,"msg":`)
+	writeJSON(&line, msg)
+	writeFields(&line, l.fields)
+	writeFields(&line, keyvals)
+	line.WriteString("}\n")
+
+	l.out.lock.Lock()
+	defer l.out.lock.Unlock()
+	io.WriteString(l.out.w, line.String())
+}
+
+func writeFields(line *strings.Builder, keyvals []interface{}) {
+	for i := 0; i < len(keyvals); i += 2 {
+		key := fmt.Sprint(keyvals[i])
+		var value interface{}
+		if i+1 < len(keyvals) {
+			value = keyvals[i+1]
+		}
+		line.WriteByte(',')
+		writeJSON(line, key)
+		line.WriteByte(':')
+		writeJSON(line, safeValue(key, value))
+	}
+}
+
+// Returns what should be logged for value under key.
+func safeValue(key string, value interface{}) interface{} {
+	lower := strings.ToLower(key)
+	for _, secret := range secretKeys {
+		if strings.Contains(lower, secret) {
+			return redacted
+		}
+	}
+	switch v := value.(type) {
+	case Redacter:
+		return v.Redacted()
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return value
+}
+
+// Writes v as JSON, falling back to its fmt representation for values
+// encoding/json can't handle.
+func writeJSON(line *strings.Builder, v interface{}) {
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		encoded, _ = json.Marshal(fmt.Sprintf("%+v", v))
+	}
+	line.Write(encoded)
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying l.
+func NewContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, l)
+}
+
+// FromContext returns the logger carried by ctx, or Default if there
+// isn't one.
+func FromContext(ctx context.Context) *Logger {
+	if l, ok := ctx.Value(contextKey{}).(*Logger); ok {
+		return l
+	}
+	return Default()
+}
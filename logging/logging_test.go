@@ -0,0 +1,97 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// A value holding a secret, like api.Credentials.
+type login struct {
+	User, Pass string
+}
+
+func (l login) Redacted() interface{} { return map[string]string{"user": l.User} }
+
+// Decodes every line written to buf.
+func readLines(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	var lines []map[string]interface{}
+	for _, raw := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if raw == "" {
+			continue
+		}
+		var line map[string]interface{}
+		if err := json.Unmarshal([]byte(raw), &line); err != nil {
+			t.Fatalf("Line %q is not JSON: %s", raw, err)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// Tests levels, fields and loggers made by With.
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, LevelInfo).With("request_id", "abc")
+
+	logger.Debug("hidden")
+	logger.Info("hello", "status", 201, "err", errors.New("boom"), "dangling")
+	logger.Error("bad")
+
+	lines := readLines(t, &buf)
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines. Got %d: %s", len(lines), buf.String())
+	}
+	first := lines[0]
+	if first["level"] != "info" || first["msg"] != "hello" || first["request_id"] != "abc" || first["status"] != float64(201) || first["err"] != "boom" || first["dangling"] != nil {
+		t.Fatalf("Unexpected line %v", first)
+	}
+	if _, ok := first["time"]; !ok {
+		t.Fatal("Expected a time on every line.")
+	}
+	if lines[1]["level"] != "error" {
+		t.Fatalf("Unexpected line %v", lines[1])
+	}
+}
+
+// Tests that secrets never reach the output.
+func TestRedaction(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, LevelDebug)
+
+	logger.Info("login", "credentials", login{"oski", "hunter2"}, "password", "hunter2", "New_Password", "hunter2", "api_token", "hunter2")
+	if strings.Contains(buf.String(), "hunter2") {
+		t.Fatalf("Secret logged: %s", buf.String())
+	}
+	line := readLines(t, &buf)[0]
+	if line["password"] != redacted || line["credentials"].(map[string]interface{})["user"] != "oski" {
+		t.Fatalf("Unexpected line %v", line)
+	}
+}
+
+// Tests that loggers travel in contexts.
+func TestContext(t *testing.T) {
+	if FromContext(context.Background()) != Default() {
+		t.Fatal("Expected the default logger without one in the context.")
+	}
+	logger := New(&bytes.Buffer{}, LevelWarn)
+	if FromContext(NewContext(context.Background(), logger)) != logger {
+		t.Fatal("Expected the logger from the context.")
+	}
+}
+
+// Tests parsing level names.
+func TestParseLevel(t *testing.T) {
+	for _, name := range []string{"debug", "info", "warn", "error"} {
+		level, err := ParseLevel(name)
+		if err != nil || level.String() != name {
+			t.Fatalf("ParseLevel(%q) = %v, %v", name, level, err)
+		}
+	}
+	if _, err := ParseLevel("loud"); err == nil {
+		t.Fatal("Expected an unknown level to fail.")
+	}
+}
@@ -1,15 +1,136 @@
 package main
 
 import (
-	"log"
+	"context"
+	"crypto/tls"
+	"flag"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/BearCloud/sp21-assignment-4/api"
+	"github.com/BearCloud/sp21-assignment-4/audit"
+	"github.com/BearCloud/sp21-assignment-4/config"
+	"github.com/BearCloud/sp21-assignment-4/logging"
+	"github.com/BearCloud/sp21-assignment-4/ratelimit"
+	"github.com/BearCloud/sp21-assignment-4/server"
+	"github.com/BearCloud/sp21-assignment-4/tracing"
+	"github.com/BearCloud/sp21-assignment-4/webhook"
 	"github.com/gorilla/mux"
 )
 
 // Starts the server and has it listen for requests.
 func main() {
+	os.Exit(run())
+}
+
+// Runs the server until it is stopped and returns the exit status.
+// See the Exit constants in server/server.go.
+func run() int {
+	// Settings come from flags, SERVER_* environment variables and an
+	// optional config file. See config/config.go.
+	cfg, err := config.Load(os.Args[1:], os.LookupEnv, os.Stderr)
+	if err == flag.ErrHelp {
+		return server.ExitOK
+	} else if err != nil {
+		logging.Default().Error("loading configuration", "error", err)
+		return server.ExitConfig
+	}
+
+	// Everything, including each request, is logged as JSON lines.
+	// See logging/logging.go and api/logging.go.
+	level, _ := logging.ParseLevel(cfg.LogLevel)
+	log := logging.New(os.Stderr, level)
+	logging.SetDefault(log)
+
+	// Requests and user store calls are traced when an exporter is
+	// configured. See tracing/tracing.go.
+	if tracer := newTracer(cfg); tracer != nil {
+		tracing.SetDefault(tracer)
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), tracerShutdownTimeout)
+			defer cancel()
+			if err := tracer.Shutdown(ctx); err != nil {
+				log.Warn("exporting remaining spans", "error", err)
+			}
+		}()
+	}
+
+	// Users are only kept in memory unless the file store is used.
+	if cfg.Store == "file" {
+		if err := api.OpenStore(cfg.StorePath); err != nil {
+			log.Error("opening user store", "path", cfg.StorePath, "error", err)
+			return server.ExitError
+		}
+	}
+
+	// Changes to users are recorded in a hash chained audit log. See
+	// audit/audit.go.
+	if cfg.AuditLog != "" {
+		auditLog, err := audit.Open(cfg.AuditLog)
+		if err != nil {
+			log.Error("opening audit log", "path", cfg.AuditLog, "error", err)
+			return server.ExitError
+		}
+		defer auditLog.Close()
+		api.AuditLog = auditLog
+	}
+
+	// Endpoints subscribed with webhooks are told about changes to
+	// users. See webhook/webhook.go.
+	if len(cfg.Webhooks) > 0 {
+		api.Webhooks = webhook.New(webhookSubscriptions(cfg), webhook.Options{
+			MaxAttempts: cfg.WebhookMaxAttempts,
+			Backoff:     cfg.WebhookBackoff,
+			MaxBackoff:  cfg.WebhookMaxBackoff,
+		}, nil)
+	}
+	api.MaxBodyBytes = cfg.MaxBodyBytes
+	api.WriteTimeout = cfg.WriteTimeout
+	for _, spec := range cfg.BodyLimits {
+		route, limit, _ := config.ParseBodyLimit(spec)
+		api.BodyLimits[route] = limit
+	}
+	api.StrictJSON = cfg.StrictJSON
+	api.RequireJSONContentType = cfg.RequireJSONContentType
+	api.Compression = cfg.Compression
+	api.CompressMinBytes = cfg.CompressMinBytes
+	api.HSTSMaxAge = cfg.HSTSMaxAge
+	api.RequireAdminCert = cfg.ClientCA != ""
+	api.AdminSubjects = cfg.AdminSubjects
+	api.AdminToken = cfg.AdminToken
+	api.LockoutThreshold = cfg.LockoutThreshold
+	api.LockoutDuration = cfg.LockoutDuration
+	api.LockoutBackoff = cfg.LockoutBackoff
+	api.HardenedMode = cfg.Hardened
+	api.CSRFProtection = cfg.CSRF
+	api.IdempotencyWindow = cfg.IdempotencyWindow
+	api.IdempotencyMaxKeys, api.IdempotencyMaxBytes = cfg.IdempotencyMaxKeys, cfg.IdempotencyMaxBytes
+	api.EventBufferSize = cfg.EventBuffer
+	api.EventHeartbeat = cfg.EventHeartbeat
+
+	// Rate limits are kept in memory unless another instance shares
+	// its store with us. See api/ratelimit.go.
+	for _, spec := range cfg.RateLimits {
+		rule, _ := ratelimit.ParseRule(spec)
+		api.RateLimits = append(api.RateLimits, rule)
+	}
+	if cfg.RateLimitStore != "" {
+		api.RateLimitStore = ratelimit.NewRemoteStore(cfg.RateLimitStore, cfg.RateLimitSecret, nil)
+	}
+
+	// Origins allowed on every route share one policy and each route
+	// named in cors_origins gets its own. See api/cors.go.
+	for _, spec := range cfg.CORSOrigins {
+		route, origin, _ := config.ParseCORSOrigin(spec)
+		policy := corsPolicyFor(cfg, route)
+		policy.Origins = append(policy.Origins, origin)
+	}
+
 	// Create a new mux for routing api calls
 	router := mux.NewRouter()
 
@@ -17,11 +138,206 @@ func main() {
 	//See api/api.go
 	api.RegisterRoutes(router)
 
-	//Print log to output, very similar to fmt.Println
-	//What are the differences?
-	log.Println("starting go server")
+	srv := &http.Server{
+		Handler:           router,
+		ReadTimeout:       cfg.ReadTimeout,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+	}
+	// Stop on SIGINT or SIGTERM. A second signal while draining kills
+	// the process straight away.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+		log.Info("shutting down, failing readiness checks", "delay", cfg.ShutdownDelay)
+	}()
+	// Keep serving for shutdown_delay with readiness checks failing, so
+	// no new traffic is sent, before draining requests.
+	serveCtx := server.PreStop(ctx, cfg.ShutdownDelay, api.StartDraining)
+	go func() {
+		<-serveCtx.Done()
+		log.Info("draining requests", "timeout", cfg.ShutdownTimeout)
+	}()
+
+	listener, err := net.Listen("tcp", cfg.Addr)
+	if err != nil {
+		log.Error("listening", "addr", cfg.Addr, "error", err)
+		return server.ExitError
+	}
+	if cfg.TLS() {
+		getCertificate, err := certificates(ctx, cfg)
+		if err != nil {
+			log.Error("loading certificates", "error", err)
+			return server.ExitError
+		}
+		srv.TLSConfig = server.TLSConfig(getCertificate)
+		if cfg.ClientCA != "" {
+			if err := server.RequireClientCerts(srv.TLSConfig, cfg.ClientCA); err != nil {
+				log.Error("loading client CA", "path", cfg.ClientCA, "error", err)
+				return server.ExitError
+			}
+		}
+		listener = tls.NewListener(listener, srv.TLSConfig)
+	}
+
+	// Plain HTTP is only redirected to HTTPS, never served.
+	redirected := make(chan error, 1)
+	if cfg.RedirectAddr != "" {
+		redirectListener, err := net.Listen("tcp", cfg.RedirectAddr)
+		if err != nil {
+			log.Error("listening", "addr", cfg.RedirectAddr, "error", err)
+			return server.ExitError
+		}
+		_, httpsPort, _ := net.SplitHostPort(listener.Addr().String())
+		redirectServer := &http.Server{
+			Handler:           server.RedirectHandler(httpsPort),
+			ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+			IdleTimeout:       cfg.IdleTimeout,
+		}
+		go func() { redirected <- server.Run(serveCtx, redirectServer, redirectListener, cfg.ShutdownTimeout) }()
+		log.Info("redirecting http to https", "addr", redirectListener.Addr())
+	} else {
+		redirected <- nil
+	}
+
+	// Other instances can share our rate limits. The store should only
+	// be reachable from them.
+	shared := make(chan error, 1)
+	if cfg.RateLimitListen != "" {
+		sharedListener, err := net.Listen("tcp", cfg.RateLimitListen)
+		if err != nil {
+			log.Error("listening", "addr", cfg.RateLimitListen, "error", err)
+			return server.ExitError
+		}
+		sharedServer := &http.Server{
+			Handler:           ratelimit.Handler(api.RateLimitStore, cfg.RateLimitSecret),
+			ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+			IdleTimeout:       cfg.IdleTimeout,
+		}
+		go func() { shared <- server.Run(serveCtx, sharedServer, sharedListener, cfg.ShutdownTimeout) }()
+		log.Info("sharing rate limits", "addr", sharedListener.Addr())
+	} else {
+		shared <- nil
+	}
+
+	scheme := "http"
+	if cfg.TLS() {
+		scheme = "https"
+	}
+	log.Info("starting go server", "url", scheme+"://"+listener.Addr().String())
+	if cfg.ClientCA == "" && cfg.AdminToken == "" {
+		log.Warn("admin routes are turned off, set client_ca or admin_token to use them")
+	} else if cfg.AdminToken != "" && !cfg.TLS() {
+		log.Warn("admin_token is sent in the clear without HTTPS")
+	}
+
+	// Has the server listen on the configured address using the
+	// routes registered earlier until we are told to stop.
+	err = server.Run(serveCtx, srv, listener, cfg.ShutdownTimeout)
+	if err != nil && err != server.ErrDrainTimeout {
+		// Serving failed, so take the other listeners down too.
+		stop()
+	}
+	if redirectErr := <-redirected; err == nil {
+		err = redirectErr
+	}
+	if sharedErr := <-shared; err == nil {
+		err = sharedErr
+	}
+	code := server.ExitCode(err)
+	if err != nil {
+		log.Error("serving", "error", err)
+	}
+
+	// Only flush the store once no more requests can change it.
+	if err := api.CloseStore(); err != nil {
+		log.Error("flushing user store", "error", err)
+		if code == server.ExitOK {
+			code = server.ExitStoreError
+		}
+	}
+	// Give queued webhook deliveries as long as requests had to drain.
+	if api.Webhooks != nil {
+		ctx, cancel := shutdownContext(cfg.ShutdownTimeout)
+		if err := api.Webhooks.Close(ctx); err != nil {
+			log.Warn("delivering remaining webhooks", "error", err)
+		}
+		cancel()
+	}
+	log.Info("server stopped", "exit_code", code)
+	return code
+}
+
+// Returns the function serving certificates for HTTPS. Certificate
+// files are watched for changes until ctx is done.
+func certificates(ctx context.Context, cfg *config.Config) (func(*tls.ClientHelloInfo) (*tls.Certificate, error), error) {
+	if cfg.TLSSelfSigned {
+		cert, err := server.SelfSignedCertificate(cfg.TLSHosts)
+		if err != nil {
+			return nil, err
+		}
+		logging.Default().Warn("serving a self-signed certificate, do not use it in production", "hosts", strings.Join(cfg.TLSHosts, ","))
+		return func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return &cert, nil }, nil
+	}
+
+	reloader, err := server.NewCertReloader(cfg.TLSCert, cfg.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+	go reloader.Watch(cfg.TLSReloadInterval, ctx.Done())
+	return reloader.GetCertificate, nil
+}
+
+// How long to wait for the last spans to be exported on exit.
+const tracerShutdownTimeout = 5 * time.Second
+
+// Returns a tracer for the configured exporter, or nil if tracing is off.
+func newTracer(cfg *config.Config) *tracing.Tracer {
+	switch cfg.TraceExporter {
+	case "stdout":
+		return tracing.NewTracer(tracing.NewWriterExporter(os.Stdout))
+	case "otlp":
+		client := &http.Client{Timeout: 10 * time.Second}
+		return tracing.NewTracer(tracing.NewOTLPExporter(cfg.TraceEndpoint, cfg.TraceService, client))
+	}
+	return nil
+}
+
+// Returns the CORS policy for route, adding one built from cfg if
+// there isn't one yet.
+func corsPolicyFor(cfg *config.Config, route string) *api.CORSPolicy {
+	for i := range api.CORSPolicies {
+		if api.CORSPolicies[i].Route == route {
+			return &api.CORSPolicies[i]
+		}
+	}
+	api.CORSPolicies = append(api.CORSPolicies, api.CORSPolicy{
+		Route:            route,
+		AllowCredentials: cfg.CORSCredentials,
+		ExposedHeaders:   cfg.CORSExposedHeaders,
+		MaxAge:           cfg.CORSMaxAge,
+	})
+	return &api.CORSPolicies[len(api.CORSPolicies)-1]
+}
+
+// Builds the webhook subscriptions listed in cfg.
+func webhookSubscriptions(cfg *config.Config) []webhook.Subscription {
+	var subs []webhook.Subscription
+	for _, spec := range cfg.Webhooks {
+		events, endpoint, _ := config.ParseWebhook(spec)
+		subs = append(subs, webhook.Subscription{URL: endpoint, Secret: cfg.WebhookSecret, Events: events})
+	}
+	return subs
+}
 
-	// Has the server listen on port 80 using the routes
-	// registered earlier.
-	http.ListenAndServe(":80", router)
+// Returns a context ending after timeout, or never if timeout is 0.
+func shutdownContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), timeout)
 }
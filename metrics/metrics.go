@@ -0,0 +1,336 @@
+// Package metrics keeps counters, gauges and histograms and writes them
+// in the Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefBuckets are histogram buckets suited to request latencies in seconds.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// A Registry holds metrics and writes them out for scraping.
+type Registry struct {
+	lock    sync.Mutex
+	metrics []metric
+	names   map[string]bool
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{names: map[string]bool{}}
+}
+
+// Anything a Registry can write out.
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+// Adds m to the registry, panicking if name is already taken since
+// that is always a programming mistake.
+func (r *Registry) register(name string, m metric) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.names[name] {
+		panic("metrics: duplicate metric " + name)
+	}
+	r.names[name] = true
+	r.metrics = append(r.metrics, m)
+}
+
+// WriteTo writes every metric in the Prometheus text format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.lock.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.lock.Unlock()
+
+	counter := &countingWriter{w: w}
+	buffered := bufio.NewWriter(counter)
+	for _, m := range metrics {
+		m.write(buffered)
+	}
+	err := buffered.Flush()
+	return counter.n, err
+}
+
+// Handler serves the metrics in the registry.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteTo(w)
+	})
+}
+
+// The parts shared by every kind of metric that has labels.
+type family struct {
+	name, help, kind string
+	labels           []string
+
+	lock   sync.Mutex
+	series map[string]*series
+}
+
+// A single combination of label values.
+type series struct {
+	labels []string
+	value  float64
+	// Only used by histograms.
+	buckets []uint64
+	count   uint64
+}
+
+func newFamily(name, help, kind string, labels []string) *family {
+	return &family{name: name, help: help, kind: kind, labels: labels, series: map[string]*series{}}
+}
+
+// Returns the series for values, creating it if needed. Callers must
+// hold f.lock.
+func (f *family) get(values []string) *series {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", f.name, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labels: append([]string(nil), values...)}
+		f.series[key] = s
+	}
+	return s
+}
+
+// Returns every series sorted by label values so output is stable.
+// Callers must hold f.lock.
+func (f *family) sorted() []*series {
+	all := make([]*series, 0, len(f.series))
+	for _, s := range f.series {
+		all = append(all, s)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return strings.Join(all[i].labels, "\xff") < strings.Join(all[j].labels, "\xff")
+	})
+	return all
+}
+
+func (f *family) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+}
+
+// A Counter is a value that only goes up.
+type Counter struct {
+	*family
+}
+
+// NewCounter adds a counter with the given label names to r.
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{newFamily(name, help, "counter", labels)}
+	r.register(name, c)
+	return c
+}
+
+// Inc adds one to the series with the given label values.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds delta, which must not be negative, to the series with the
+// given label values.
+func (c *Counter) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		panic("metrics: counters cannot decrease")
+	}
+	c.lock.Lock()
+	c.get(labelValues).value += delta
+	c.lock.Unlock()
+}
+
+// Value returns the current value of the series with the given label values.
+func (c *Counter) Value(labelValues ...string) float64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.get(labelValues).value
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.writeHeader(w)
+	for _, s := range c.sorted() {
+		writeSample(w, c.name, c.labels, s.labels, "", "", s.value)
+	}
+}
+
+// A Gauge is a value that can go up and down.
+type Gauge struct {
+	*family
+}
+
+// NewGauge adds a gauge with the given label names to r.
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{newFamily(name, help, "gauge", labels)}
+	r.register(name, g)
+	return g
+}
+
+// Set sets the series with the given label values.
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	g.lock.Lock()
+	g.get(labelValues).value = value
+	g.lock.Unlock()
+}
+
+// Add adds delta to the series with the given label values.
+func (g *Gauge) Add(delta float64, labelValues ...string) {
+	g.lock.Lock()
+	g.get(labelValues).value += delta
+	g.lock.Unlock()
+}
+
+func (g *Gauge) write(w *bufio.Writer) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.writeHeader(w)
+	for _, s := range g.sorted() {
+		writeSample(w, g.name, g.labels, s.labels, "", "", s.value)
+	}
+}
+
+// A gauge without labels whose value is read when it is scraped.
+type gaugeFunc struct {
+	name, help string
+	value      func() float64
+}
+
+// NewGaugeFunc adds a gauge to r whose value is the result of calling
+// value at scrape time.
+func (r *Registry) NewGaugeFunc(name, help string, value func() float64) {
+	r.register(name, &gaugeFunc{name, help, value})
+}
+
+func (g *gaugeFunc) write(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", g.name, escapeHelp(g.help))
+	fmt.Fprintf(w, "# TYPE %s gauge\n", g.name)
+	writeSample(w, g.name, nil, nil, "", "", g.value())
+}
+
+// A Histogram counts observations into buckets.
+type Histogram struct {
+	*family
+	buckets []float64
+}
+
+// NewHistogram adds a histogram with the given upper bucket bounds,
+// which must be sorted, and label names to r.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{newFamily(name, help, "histogram", labels), buckets}
+	r.register(name, h)
+	return h
+}
+
+// Observe records value in the series with the given label values.
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	s := h.get(labelValues)
+	if s.buckets == nil {
+		s.buckets = make([]uint64, len(h.buckets))
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			s.buckets[i]++
+		}
+	}
+	s.count++
+	s.value += value
+}
+
+// Count returns how many values the series with the given label
+// values has observed.
+func (h *Histogram) Count(labelValues ...string) uint64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.get(labelValues).count
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.writeHeader(w)
+	for _, s := range h.sorted() {
+		for i, bound := range h.buckets {
+			var n uint64
+			if s.buckets != nil {
+				n = s.buckets[i]
+			}
+			writeSample(w, h.name+"_bucket", h.labels, s.labels, "le", formatFloat(bound), float64(n))
+		}
+		writeSample(w, h.name+"_bucket", h.labels, s.labels, "le", "+Inf", float64(s.count))
+		writeSample(w, h.name+"_sum", h.labels, s.labels, "", "", s.value)
+		writeSample(w, h.name+"_count", h.labels, s.labels, "", "", float64(s.count))
+	}
+}
+
+// Writes a single sample line. extraName and extraValue add one more
+// label, such as a histogram's le.
+func writeSample(w *bufio.Writer, name string, labels, values []string, extraName, extraValue string, value float64) {
+	w.WriteString(name)
+	if len(labels) > 0 || extraName != "" {
+		w.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", label, escapeLabel(values[i]))
+		}
+		if extraName != "" {
+			if len(labels) > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", extraName, extraValue)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(value))
+	w.WriteByte('\n')
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+
+// Counts the bytes written through it for WriteTo.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,86 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Tests the text format written for every kind of metric.
+func TestWriteTo(t *testing.T) {
+	r := NewRegistry()
+	requests := r.NewCounter("requests_total", "Requests served.", "route", "code")
+	inFlight := r.NewGauge("in_flight", "Requests in flight.")
+	latency := r.NewHistogram("latency_seconds", "Request latency.", []float64{0.1, 1}, "route")
+	r.NewGaugeFunc("users", "Users signed up.", func() float64 { return 3 })
+
+	requests.Inc("/b", "2xx")
+	requests.Add(2, "/a", "4xx")
+	requests.Inc("/quote\"d\n", "2xx")
+	inFlight.Add(2)
+	inFlight.Add(-1)
+	latency.Observe(0.05, "/a")
+	latency.Observe(0.5, "/a")
+	latency.Observe(5, "/a")
+
+	var out strings.Builder
+	if _, err := r.WriteTo(&out); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP requests_total Requests served.
+# TYPE requests_total counter
+requests_total{route="/a",code="4xx"} 2
+requests_total{route="/b",code="2xx"} 1
+requests_total{route="/quote\"d\n",code="2xx"} 1
+# HELP in_flight Requests in flight.
+# TYPE in_flight gauge
+in_flight 1
+# HELP latency_seconds Request latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{route="/a",le="0.1"} 1
+latency_seconds_bucket{route="/a",le="1"} 2
+latency_seconds_bucket{route="/a",le="+Inf"} 3
+latency_seconds_sum{route="/a"} 5.55
+latency_seconds_count{route="/a"} 3
+# HELP users Users signed up.
+# TYPE users gauge
+users 3
+`
+	if out.String() != expected {
+		t.Fatalf("Incorrect output!\nExpected:\n%s\nActual:\n%s", expected, out.String())
+	}
+	if requests.Value("/a", "4xx") != 2 || latency.Count("/a") != 3 {
+		t.Fatal("Incorrect values read back from metrics.")
+	}
+}
+
+// Tests that mistakes in using metrics are caught.
+func TestMisuse(t *testing.T) {
+	expectPanic := func(name string, f func()) {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("%s did not panic", name)
+			}
+		}()
+		f()
+	}
+
+	r := NewRegistry()
+	c := r.NewCounter("count", "", "label")
+	expectPanic("Duplicate name", func() { r.NewGauge("count", "") })
+	expectPanic("Wrong label count", func() { c.Inc() })
+	expectPanic("Negative counter", func() { c.Add(-1, "x") })
+}
+
+// Tests that the handler serves the text format.
+func TestHandler(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("hits_total", "Hits.").Inc()
+
+	rr := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.HasPrefix(rr.Header().Get("Content-Type"), "text/plain; version=0.0.4") || !strings.Contains(rr.Body.String(), "hits_total 1\n") {
+		t.Fatalf("Unexpected response %q %q", rr.Header().Get("Content-Type"), rr.Body.String())
+	}
+}
@@ -0,0 +1,178 @@
+// Package ratelimit limits how often something may happen using token
+// buckets.
+//
+// Each key, such as a client's IP address, has a bucket holding up to
+// Burst tokens that refills at Rate tokens per second. Every request
+// takes a token and is refused when the bucket is empty. Buckets live
+// in a Store, which is either kept in memory or shared by several
+// servers over HTTP. See Handler and RemoteStore.
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Limit allows Burst requests at once, refilling at Rate per second.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// The periods a limit can be given per.
+var periods = map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour}
+
+// ParseLimit parses limits such as "10/m", meaning bursts of up to 10
+// requests refilling at 10 per minute. The period is s, m or h.
+func ParseLimit(s string) (Limit, error) {
+	count, period := s, "s"
+	if i := strings.IndexByte(s, '/'); i >= 0 {
+		count, period = s[:i], s[i+1:]
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n <= 0 {
+		return Limit{}, fmt.Errorf("limit %q must start with a positive count", s)
+	}
+	d, ok := periods[period]
+	if !ok {
+		return Limit{}, fmt.Errorf("limit %q must be per s, m or h", s)
+	}
+	return Limit{Rate: float64(n) / d.Seconds(), Burst: n}, nil
+}
+
+// A Rule limits requests to a route by client IP address or by the
+// username they name.
+type Rule struct {
+	// Key is "ip" or "username".
+	Key   string
+	Route string
+	Limit Limit
+	// The limit as it was given, for error messages and logs.
+	spec string
+}
+
+// ParseRule parses rules such as "ip:/api/signup=20/m", meaning each
+// client IP may sign up 20 times a minute. The key is ip or username
+// and the route is a mux route template.
+func ParseRule(s string) (Rule, error) {
+	colon, equals := strings.IndexByte(s, ':'), strings.LastIndexByte(s, '=')
+	if colon < 0 || equals < colon {
+		return Rule{}, fmt.Errorf("rate limit %q must look like ip:/route=10/m", s)
+	}
+	rule := Rule{Key: s[:colon], Route: s[colon+1 : equals], spec: s}
+	if rule.Key != "ip" && rule.Key != "username" {
+		return Rule{}, fmt.Errorf("rate limit %q must be keyed by ip or username", s)
+	}
+	if !strings.HasPrefix(rule.Route, "/") {
+		return Rule{}, fmt.Errorf("rate limit %q must name a route starting with /", s)
+	}
+	limit, err := ParseLimit(s[equals+1:])
+	if err != nil {
+		return Rule{}, fmt.Errorf("rate limit %q: %w", s, err)
+	}
+	rule.Limit = limit
+	return rule, nil
+}
+
+func (r Rule) String() string {
+	return r.spec
+}
+
+// A Result says whether a request may go ahead and, if not, how long
+// until it could.
+type Result struct {
+	Allowed    bool
+	RetryAfter time.Duration
+}
+
+// A Store keeps buckets and takes tokens from them.
+type Store interface {
+	// Take takes a token from the bucket for key, creating a full one
+	// if there isn't one yet.
+	Take(ctx context.Context, key string, limit Limit) (Result, error)
+}
+
+// How many calls to Take between sweeps of idle buckets.
+const sweepEvery = 1024
+
+// MemoryStore keeps buckets in memory. It is safe for concurrent use.
+type MemoryStore struct {
+	lock    sync.Mutex
+	buckets map[string]*bucket
+	takes   int
+	now     func() time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	limit  Limit
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: map[string]*bucket{}, now: time.Now}
+}
+
+var errBadLimit = errors.New("limit must have a positive rate and burst")
+
+// Take implements Store.
+func (s *MemoryStore) Take(ctx context.Context, key string, limit Limit) (Result, error) {
+	if limit.Rate <= 0 || limit.Burst <= 0 {
+		return Result{}, errBadLimit
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := s.now()
+	s.takes++
+	if s.takes%sweepEvery == 0 {
+		s.sweep(now)
+	}
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), last: now}
+		s.buckets[key] = b
+	}
+	b.limit = limit
+	b.refill(now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return Result{Allowed: true}, nil
+	}
+	wait := (1 - b.tokens) / limit.Rate
+	return Result{RetryAfter: time.Duration(math.Ceil(wait * float64(time.Second)))}, nil
+}
+
+// Adds the tokens earned since the bucket was last used.
+func (b *bucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(float64(b.limit.Burst), b.tokens+elapsed*b.limit.Rate)
+	}
+	b.last = now
+}
+
+// Forgets buckets that have filled up again, since a new bucket would
+// be just the same. Callers must hold s.lock.
+func (s *MemoryStore) sweep(now time.Time) {
+	for key, b := range s.buckets {
+		b.refill(now)
+		if b.tokens >= float64(b.limit.Burst) {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+// Len returns how many buckets are being kept.
+func (s *MemoryStore) Len() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.buckets)
+}
@@ -0,0 +1,95 @@
+package ratelimit
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Tests parsing limits and rules.
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		Spec     string
+		Expected Rule
+		Error    string
+	}{
+		{"ip:/api/signup=20/m", Rule{Key: "ip", Route: "/api/signup", Limit: Limit{20.0 / 60, 20}}, ""},
+		{"username:/api/getPW=5/s", Rule{Key: "username", Route: "/api/getPW", Limit: Limit{5, 5}}, ""},
+		{"ip:/api/v1/users:import=3600/h", Rule{Key: "ip", Route: "/api/v1/users:import", Limit: Limit{1, 3600}}, ""},
+		{"ip:/api/signup=7", Rule{Key: "ip", Route: "/api/signup", Limit: Limit{7, 7}}, ""},
+		{"/api/signup=20/m", Rule{}, "must look like"},
+		{"cookie:/api/signup=20/m", Rule{}, "keyed by ip or username"},
+		{"ip:api/signup=20/m", Rule{}, "starting with /"},
+		{"ip:/api/signup=0/m", Rule{}, "positive count"},
+		{"ip:/api/signup=20/d", Rule{}, "per s, m or h"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Spec, func(t *testing.T) {
+			rule, err := ParseRule(test.Spec)
+			if test.Error != "" {
+				if err == nil || !strings.Contains(err.Error(), test.Error) {
+					t.Fatalf("Expected an error containing %q. Got %v", test.Error, err)
+				}
+				return
+			}
+			test.Expected.spec = test.Spec
+			if err != nil || rule != test.Expected {
+				t.Fatalf("ParseRule(%q) = %+v, %v", test.Spec, rule, err)
+			}
+		})
+	}
+}
+
+// Tests that buckets empty, refill and are forgotten once full.
+func TestMemoryStore(t *testing.T) {
+	store := NewMemoryStore()
+	now := time.Unix(0, 0)
+	store.now = func() time.Time { return now }
+	limit := Limit{Rate: 1, Burst: 2}
+	ctx := context.Background()
+
+	take := func(key string) Result {
+		result, err := store.Take(ctx, key, limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	// The burst is allowed straight away.
+	if !take("a").Allowed || !take("a").Allowed {
+		t.Fatal("Expected the burst to be allowed.")
+	}
+	// Then requests wait for the bucket to refill.
+	if result := take("a"); result.Allowed || result.RetryAfter != time.Second {
+		t.Fatalf("Expected to wait a second. Got %+v", result)
+	}
+	// Other keys have their own buckets.
+	if !take("b").Allowed {
+		t.Fatal("Expected another key to be allowed.")
+	}
+	now = now.Add(500 * time.Millisecond)
+	if result := take("a"); result.Allowed || result.RetryAfter != 500*time.Millisecond {
+		t.Fatalf("Expected to wait half a second. Got %+v", result)
+	}
+	now = now.Add(500 * time.Millisecond)
+	if !take("a").Allowed {
+		t.Fatal("Expected a token after refilling.")
+	}
+
+	// Full buckets are swept away.
+	now = now.Add(time.Hour)
+	for store.takes%sweepEvery != sweepEvery-1 {
+		store.takes++
+	}
+	take("c")
+	if store.Len() != 1 {
+		t.Fatalf("Expected only the new bucket to remain. Got %d", store.Len())
+	}
+
+	if _, err := store.Take(ctx, "d", Limit{}); err == nil {
+		t.Fatal("Expected an empty limit to be rejected.")
+	}
+}
@@ -0,0 +1,106 @@
+package ratelimit
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The body of a request to Handler.
+type takeRequest struct {
+	Key   string  `json:"key"`
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+// The body of a response from Handler.
+type takeResponse struct {
+	Allowed      bool  `json:"allowed"`
+	RetryAfterMS int64 `json:"retry_after_ms"`
+}
+
+// Handler serves store to RemoteStores so that several servers can
+// share one set of buckets. It answers POST requests only, from
+// RemoteStores sending the same secret, and should only be reachable
+// from the servers sharing it. Other requests get 401 Unauthorized.
+func Handler(store Store, secret string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "", http.StatusMethodNotAllowed)
+			return
+		}
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if secret == "" || subtle.ConstantTimeCompare([]byte(given), []byte(secret)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "", http.StatusUnauthorized)
+			return
+		}
+		var take takeRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&take); err != nil || take.Key == "" {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+		result, err := store.Take(r.Context(), take.Key, Limit{take.Rate, take.Burst})
+		if err == errBadLimit {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		} else if err != nil {
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(takeResponse{result.Allowed, result.RetryAfter.Milliseconds()})
+	})
+}
+
+// RemoteStore takes tokens from a Store served by Handler on another
+// server.
+type RemoteStore struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+// NewRemoteStore returns a Store using the Handler at url, which was
+// given the same secret. A nil client means one with a one second
+// timeout, since every rate limited request waits on the remote store.
+func NewRemoteStore(url, secret string, client *http.Client) *RemoteStore {
+	if client == nil {
+		client = &http.Client{Timeout: time.Second}
+	}
+	return &RemoteStore{url: strings.TrimSuffix(url, "/"), secret: secret, client: client}
+}
+
+// Take implements Store.
+func (s *RemoteStore) Take(ctx context.Context, key string, limit Limit) (Result, error) {
+	body, err := json.Marshal(takeRequest{key, limit.Rate, limit.Burst})
+	if err != nil {
+		return Result{}, err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return Result{}, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Authorization", "Bearer "+s.secret)
+	response, err := s.client.Do(request)
+	if err != nil {
+		return Result{}, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return Result{}, fmt.Errorf("rate limit store responded %s", response.Status)
+	}
+
+	var take takeResponse
+	if err := json.NewDecoder(response.Body).Decode(&take); err != nil {
+		return Result{}, err
+	}
+	return Result{take.Allowed, time.Duration(take.RetryAfterMS) * time.Millisecond}, nil
+}
@@ -0,0 +1,70 @@
+package ratelimit
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Tests that two remote stores share the buckets of one server.
+func TestRemoteStore(t *testing.T) {
+	shared := NewMemoryStore()
+	server := httptest.NewServer(Handler(shared, "secret"))
+	defer server.Close()
+
+	first := NewRemoteStore(server.URL, "secret", server.Client())
+	second := NewRemoteStore(server.URL+"/", "secret", nil)
+	limit := Limit{Rate: 0.5, Burst: 1}
+	ctx := context.Background()
+
+	if result, err := first.Take(ctx, "ip:10.0.0.1", limit); err != nil || !result.Allowed {
+		t.Fatalf("Expected the first request to be allowed. Got %+v %v", result, err)
+	}
+	result, err := second.Take(ctx, "ip:10.0.0.1", limit)
+	if err != nil || result.Allowed || result.RetryAfter <= time.Second || result.RetryAfter > 2*time.Second {
+		t.Fatalf("Expected the second server to see the same bucket. Got %+v %v", result, err)
+	}
+
+	// Stores without the secret can't touch the buckets.
+	if _, err := NewRemoteStore(server.URL, "guess", nil).Take(ctx, "ip:10.0.0.1", Limit{Rate: 1000, Burst: 1000}); err == nil {
+		t.Fatal("Expected a store with the wrong secret to be refused.")
+	}
+
+	// Bad requests are rejected.
+	tests := []struct {
+		Name         string
+		Method       string
+		Secret       string
+		Body         string
+		ExpectedCode int
+	}{
+		{"Wrong Method", http.MethodGet, "secret", "", http.StatusMethodNotAllowed},
+		{"No Secret", http.MethodPost, "", `{"key": "a", "rate": 1, "burst": 1}`, http.StatusUnauthorized},
+		{"Wrong Secret", http.MethodPost, "guess", `{"key": "a", "rate": 1, "burst": 1}`, http.StatusUnauthorized},
+		{"Bad JSON", http.MethodPost, "secret", "{", http.StatusBadRequest},
+		{"No Key", http.MethodPost, "secret", `{"rate": 1, "burst": 1}`, http.StatusBadRequest},
+		{"Bad Limit", http.MethodPost, "secret", `{"key": "a", "rate": 0, "burst": 1}`, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			req := httptest.NewRequest(test.Method, "/", bytes.NewBufferString(test.Body))
+			if test.Secret != "" {
+				req.Header.Set("Authorization", "Bearer "+test.Secret)
+			}
+			rr := httptest.NewRecorder()
+			Handler(shared, "secret").ServeHTTP(rr, req)
+			if rr.Code != test.ExpectedCode {
+				t.Fatalf("Incorrect status code returned! Expected: %d Actual: %d", test.ExpectedCode, rr.Code)
+			}
+		})
+	}
+
+	// Errors from the shared store are reported.
+	server.Close()
+	if _, err := first.Take(ctx, "ip:10.0.0.1", limit); err == nil {
+		t.Fatal("Expected an error once the shared store is gone.")
+	}
+}
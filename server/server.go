@@ -0,0 +1,93 @@
+// Package server runs an http.Server until it is told to stop and then
+// shuts it down without cutting off requests that are in flight.
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+// The statuses main exits with.
+const (
+	// The server stopped cleanly after draining every request.
+	ExitOK = 0
+	// The server could not start or failed while serving.
+	ExitError = 1
+	// The configuration was invalid.
+	ExitConfig = 2
+	// Requests were still in flight when the drain deadline passed.
+	ExitDrainTimeout = 3
+	// The user store could not be flushed on the way out.
+	ExitStoreError = 4
+)
+
+// ErrDrainTimeout is returned by Run when requests were still in
+// flight once the drain deadline passed. Their connections are closed.
+var ErrDrainTimeout = errors.New("server: requests still in flight after drain deadline")
+
+// Run serves srv on listener until ctx is done. It then stops accepting
+// new connections and waits up to drainTimeout for in-flight requests
+// to finish before returning. A drainTimeout of zero waits forever.
+//
+// Run returns nil after a clean shutdown, ErrDrainTimeout if requests
+// had to be cut off, or the error that stopped srv from serving.
+func Run(ctx context.Context, srv *http.Server, listener net.Listener, drainTimeout time.Duration) error {
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(listener)
+	}()
+
+	select {
+	case err := <-served:
+		// The server stopped on its own, which only happens on errors.
+		return err
+	case <-ctx.Done():
+	}
+
+	drainCtx := context.Background()
+	if drainTimeout > 0 {
+		var cancel context.CancelFunc
+		drainCtx, cancel = context.WithTimeout(drainCtx, drainTimeout)
+		defer cancel()
+	}
+
+	err := srv.Shutdown(drainCtx)
+	if err == context.DeadlineExceeded {
+		srv.Close()
+		err = ErrDrainTimeout
+	}
+	if serveErr := <-served; serveErr != http.ErrServerClosed && err == nil {
+		err = serveErr
+	}
+	return err
+}
+
+// PreStop returns a context that is done delay after ctx is. As soon as
+// ctx is done it calls onStop, which should make readiness checks fail.
+// Servers run with the returned context keep serving for delay, so load
+// balancers polling them see them draining and stop sending them new
+// requests before their listeners close.
+func PreStop(ctx context.Context, delay time.Duration, onStop func()) context.Context {
+	stopped, stop := context.WithCancel(context.Background())
+	go func() {
+		<-ctx.Done()
+		onStop()
+		time.Sleep(delay)
+		stop()
+	}()
+	return stopped
+}
+
+// ExitCode maps the error returned by Run to the status main exits with.
+func ExitCode(err error) int {
+	switch err {
+	case nil:
+		return ExitOK
+	case ErrDrainTimeout:
+		return ExitDrainTimeout
+	}
+	return ExitError
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/BearCloud/sp21-assignment-4/api"
+	"github.com/gorilla/mux"
+)
+
+// Starts Run on a random port with a handler that blocks until release
+// is closed. Returns the server's URL and a channel with Run's result.
+func startBlocking(t *testing.T, ctx context.Context, drainTimeout time.Duration, started chan<- struct{}, release <-chan struct{}) (string, <-chan error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		w.Write([]byte("done"))
+	})}
+
+	result := make(chan error, 1)
+	go func() { result <- Run(ctx, srv, listener, drainTimeout) }()
+	return "http://" + listener.Addr().String(), result
+}
+
+// Tests that a request in flight when the server is stopped still
+// gets its response and that no new connections are accepted.
+func TestDrain(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	url, result := startBlocking(t, ctx, 5*time.Second, started, release)
+
+	// Start a request and stop the server while it is being handled.
+	body := make(chan string, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(resp.Body)
+		body <- string(data)
+	}()
+	<-started
+	cancel()
+
+	// Wait for the listener to close before checking new connections fail.
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", url[len("http://"):])
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("Server still accepts connections after being stopped.")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Run should not return until the request finishes.
+	select {
+	case err := <-result:
+		t.Fatalf("Run returned with a request in flight: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if got := <-body; got != "done" {
+		t.Fatalf("In-flight request did not complete. Got %q", got)
+	}
+	if err := <-result; err != nil || ExitCode(err) != ExitOK {
+		t.Fatalf("Expected a clean shutdown. Got %v", err)
+	}
+}
+
+// Tests that requests still running at the deadline are cut off.
+func TestDrainTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	defer close(release)
+	url, result := startBlocking(t, ctx, 50*time.Millisecond, started, release)
+
+	go http.Get(url)
+	<-started
+	cancel()
+
+	select {
+	case err := <-result:
+		if err != ErrDrainTimeout || ExitCode(err) != ExitDrainTimeout {
+			t.Fatalf("Expected ErrDrainTimeout. Got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Run did not give up after the drain deadline.")
+	}
+}
+
+// Tests that /readyz reports draining over the live listener once the
+// server is told to stop, until the pre-stop delay is over.
+func TestPreStop(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := mux.NewRouter()
+	api.RegisterRoutes(router)
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- Run(PreStop(ctx, 200*time.Millisecond, api.StartDraining), &http.Server{Handler: router}, listener, time.Second)
+	}()
+	url := "http://" + listener.Addr().String() + "/readyz"
+
+	if resp, err := http.Get(url); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected to be ready before stopping. Got %v %v", resp, err)
+	}
+	cancel()
+	time.Sleep(20 * time.Millisecond)
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("Expected /readyz to still be served. Got %v", err)
+	}
+	var body struct {
+		Checks map[string]string `json:"checks"`
+	}
+	json.NewDecoder(resp.Body).Decode(&body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || body.Checks["draining"] != "Draining" {
+		t.Fatalf("Expected /readyz to report draining. Got %d %v", resp.StatusCode, body.Checks)
+	}
+
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatalf("Expected a clean shutdown. Got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Run did not stop after the pre-stop delay.")
+	}
+}
+
+// Tests that errors from serving are returned straight away.
+func TestServeError(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+
+	err = Run(context.Background(), &http.Server{}, listener, time.Second)
+	if err == nil || ExitCode(err) != ExitError {
+		t.Fatalf("Expected a serve error. Got %v", err)
+	}
+}
@@ -0,0 +1,256 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Writes cert to PEM files in dir and returns their paths.
+func writePEM(t *testing.T, dir string, cert tls.Certificate) (string, string) {
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// Tests that self-signed certificates cover the requested hosts and
+// that clients are held to TLS 1.2 or newer.
+func TestSelfSignedCertificate(t *testing.T) {
+	cert, err := SelfSignedCertificate([]string{"localhost", "127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cert.Leaf.VerifyHostname("localhost"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cert.Leaf.VerifyHostname("127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SelfSignedCertificate(nil); err == nil {
+		t.Fatal("Expected an error without any hosts.")
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = TLSConfig(func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return &cert, nil })
+	// Otherwise httptest fills in its own certificate.
+	server.TLS.Certificates = []tls.Certificate{cert}
+	server.StartTLS()
+	defer server.Close()
+
+	// A client that trusts the certificate can connect.
+	pool := x509.NewCertPool()
+	pool.AddCert(cert.Leaf)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// TLS 1.1 is refused.
+	old := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, MaxVersion: tls.VersionTLS11}}}
+	if _, err := old.Get(server.URL); err == nil {
+		t.Fatal("TLS 1.1 client was able to connect.")
+	}
+}
+
+// Tests that certificates are reloaded when their files change.
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	first, err := SelfSignedCertificate([]string{"first.test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := writePEM(t, dir, first)
+
+	reloader, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := func() string {
+		cert, _ := reloader.GetCertificate(nil)
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.Subject.CommonName
+	}
+	if served() != "first.test" {
+		t.Fatalf("Expected first.test. Got %s", served())
+	}
+	if reloaded, err := reloader.Reload(); reloaded || err != nil {
+		t.Fatalf("Reloaded unchanged files: %v", err)
+	}
+
+	// A half written key should leave the old certificate in place.
+	if err := ioutil.WriteFile(keyFile, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(keyFile, later, later)
+	if _, err := reloader.Reload(); err == nil || served() != "first.test" {
+		t.Fatal("Broken key replaced the certificate.")
+	}
+
+	// Replace both files and let Watch pick them up.
+	second, err := SelfSignedCertificate([]string{"second.test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, dir, second)
+	later = later.Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go reloader.Watch(10*time.Millisecond, stop)
+	deadline := time.Now().Add(2 * time.Second)
+	for served() != "second.test" {
+		if time.Now().After(deadline) {
+			t.Fatal("Certificate was not reloaded.")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Tests that plain HTTP requests are redirected to HTTPS.
+func TestRedirectHandler(t *testing.T) {
+	tests := []struct {
+		Port     string
+		Host     string
+		Expected string
+	}{
+		{"443", "example.com:80", "https://example.com/api/getQuery?userID=40"},
+		{"8443", "example.com", "https://example.com:8443/api/getQuery?userID=40"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/api/getQuery?userID=40", nil)
+		req.Host = test.Host
+		rr := httptest.NewRecorder()
+		RedirectHandler(test.Port).ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusPermanentRedirect || rr.Header().Get("Location") != test.Expected {
+			t.Errorf("Expected a redirect to %s. Got %d to %s", test.Expected, rr.Code, rr.Header().Get("Location"))
+		}
+	}
+}
+
+// Tests that client certificates are verified against the CA file but
+// not required to connect.
+func TestRequireClientCerts(t *testing.T) {
+	serverCert, err := SelfSignedCertificate([]string{"127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := newCA(t)
+	caFile, _ := writePEM(t, t.TempDir(), ca)
+	client := issueClientCert(t, ca, "oski")
+	stranger := issueClientCert(t, newCA(t), "stanfurd")
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.VerifiedChains) > 0 {
+			w.Write([]byte(r.TLS.VerifiedChains[0][0].Subject.CommonName))
+		}
+	}))
+	server.TLS = TLSConfig(nil)
+	server.TLS.Certificates = []tls.Certificate{serverCert}
+	if err := RequireClientCerts(server.TLS, caFile); err != nil {
+		t.Fatal(err)
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	get := func(certs ...tls.Certificate) (string, error) {
+		pool := x509.NewCertPool()
+		pool.AddCert(serverCert.Leaf)
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, Certificates: certs}}}
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	if name, err := get(client); err != nil || name != "oski" {
+		t.Fatalf("Expected a verified client certificate for oski. Got %q, %v", name, err)
+	}
+	if name, err := get(); err != nil || name != "" {
+		t.Fatalf("Expected clients without a certificate to connect. Got %q, %v", name, err)
+	}
+	if _, err := get(stranger); err == nil {
+		t.Fatal("Client certificate from an unknown CA was accepted.")
+	}
+	if err := RequireClientCerts(&tls.Config{}, filepath.Join(t.TempDir(), "missing.pem")); err == nil {
+		t.Fatal("Expected an error for a missing CA file.")
+	}
+}
+
+// Creates a CA that can issue client certificates.
+func newCA(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// Issues a client certificate for commonName signed by ca.
+func issueClientCert(t *testing.T, ca tls.Certificate, commonName string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Leaf, &key.PublicKey, ca.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
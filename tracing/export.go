@@ -0,0 +1,213 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// WriterExporter writes each span to an io.Writer as a line of JSON.
+// It is meant for development, usually with os.Stdout.
+type WriterExporter struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+// NewWriterExporter returns an exporter writing spans to w.
+func NewWriterExporter(w io.Writer) *WriterExporter {
+	return &WriterExporter{w: w}
+}
+
+// A span as written by WriterExporter.
+type writtenSpan struct {
+	Name       string                 `json:"name"`
+	TraceID    string                 `json:"trace_id"`
+	SpanID     string                 `json:"span_id"`
+	ParentID   string                 `json:"parent_id,omitempty"`
+	Kind       int                    `json:"kind"`
+	Start      string                 `json:"start"`
+	DurationMS float64                `json:"duration_ms"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+	Error      string                 `json:"error,omitempty"`
+}
+
+// ExportSpans writes spans to the exporter's writer.
+func (e *WriterExporter) ExportSpans(ctx context.Context, spans []SpanData) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	encoder := json.NewEncoder(e.w)
+	for _, span := range spans {
+		out := writtenSpan{
+			Name:       span.Name,
+			TraceID:    span.Context.TraceID.String(),
+			SpanID:     span.Context.SpanID.String(),
+			Kind:       span.Kind,
+			Start:      span.Start.UTC().Format("2006-01-02T15:04:05.000000Z07:00"),
+			DurationMS: float64(span.End.Sub(span.Start).Microseconds()) / 1000,
+			Error:      span.Err,
+		}
+		if span.Parent.IsValid() {
+			out.ParentID = span.Parent.String()
+		}
+		if len(span.Attributes) > 0 {
+			out.Attributes = map[string]interface{}{}
+			for _, attr := range span.Attributes {
+				out.Attributes[attr.Key] = attr.Value
+			}
+		}
+		if err := encoder.Encode(out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Shutdown does nothing.
+func (e *WriterExporter) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+// OTLPExporter sends spans to an OpenTelemetry collector using OTLP
+// over HTTP with JSON bodies.
+type OTLPExporter struct {
+	endpoint string
+	service  string
+	client   *http.Client
+}
+
+// DefaultOTLPEndpoint is where a local collector accepts traces.
+const DefaultOTLPEndpoint = "http://localhost:4318/v1/traces"
+
+// NewOTLPExporter returns an exporter posting spans to endpoint, which
+// is usually DefaultOTLPEndpoint, labelled with the service name.
+// A nil client means http.DefaultClient.
+func NewOTLPExporter(endpoint, service string, client *http.Client) *OTLPExporter {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &OTLPExporter{endpoint: endpoint, service: service, client: client}
+}
+
+// The OTLP JSON encoding of an ExportTraceServiceRequest. IDs are hex
+// and 64 bit integers are strings, as the OTLP spec requires.
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	// 0 is unset and 2 is error.
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+// Wraps an attribute value in the OTLP AnyValue encoding.
+func otlpValue(v interface{}) map[string]interface{} {
+	switch v := v.(type) {
+	case string:
+		return map[string]interface{}{"stringValue": v}
+	case bool:
+		return map[string]interface{}{"boolValue": v}
+	case int:
+		return map[string]interface{}{"intValue": strconv.Itoa(v)}
+	case int64:
+		return map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+	case float64:
+		return map[string]interface{}{"doubleValue": v}
+	}
+	return map[string]interface{}{"stringValue": fmt.Sprint(v)}
+}
+
+// ExportSpans posts spans to the collector.
+func (e *OTLPExporter) ExportSpans(ctx context.Context, spans []SpanData) error {
+	scope := otlpScopeSpans{Scope: otlpScope{Name: "github.com/BearCloud/sp21-assignment-4/tracing"}}
+	for _, span := range spans {
+		out := otlpSpan{
+			TraceID:           span.Context.TraceID.String(),
+			SpanID:            span.Context.SpanID.String(),
+			Name:              span.Name,
+			Kind:              span.Kind,
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+		}
+		if span.Parent.IsValid() {
+			out.ParentSpanID = span.Parent.String()
+		}
+		for _, attr := range span.Attributes {
+			out.Attributes = append(out.Attributes, otlpAttribute{attr.Key, otlpValue(attr.Value)})
+		}
+		if span.Err != "" {
+			out.Status = otlpStatus{Code: 2, Message: span.Err}
+		}
+		scope.Spans = append(scope.Spans, out)
+	}
+	body, err := json.Marshal(otlpRequest{[]otlpResourceSpans{{
+		Resource:   otlpResource{[]otlpAttribute{{"service.name", otlpValue(e.service)}}},
+		ScopeSpans: []otlpScopeSpans{scope},
+	}}})
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := e.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, response.Body)
+	if response.StatusCode/100 != 2 {
+		return fmt.Errorf("collector responded %s", response.Status)
+	}
+	return nil
+}
+
+// Shutdown closes idle connections to the collector.
+func (e *OTLPExporter) Shutdown(ctx context.Context) error {
+	e.client.CloseIdleConnections()
+	return nil
+}
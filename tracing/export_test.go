@@ -0,0 +1,103 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Returns a finished span with a parent, an attribute and an error.
+func sampleSpan() SpanData {
+	start := time.Unix(1617278400, 0)
+	span := SpanData{
+		Name:       "store.AddUser",
+		Kind:       KindInternal,
+		Start:      start,
+		End:        start.Add(1500 * time.Microsecond),
+		Attributes: []Attribute{Attr("user.count", 3)},
+		Err:        "User Already Exists",
+	}
+	span.Context, _ = ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	span.Parent = SpanID{1, 2, 3, 4, 5, 6, 7, 8}
+	return span
+}
+
+// Tests that spans are written as JSON lines.
+func TestWriterExporter(t *testing.T) {
+	var out bytes.Buffer
+	if err := NewWriterExporter(&out).ExportSpans(context.Background(), []SpanData{sampleSpan(), sampleSpan()}); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	var span writtenSpan
+	if err := json.Unmarshal([]byte(lines[0]), &span); err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 2 || span.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || span.ParentID != "0102030405060708" ||
+		span.DurationMS != 1.5 || span.Attributes["user.count"] != float64(3) || span.Error != "User Already Exists" {
+		t.Fatalf("Unexpected output %s", out.String())
+	}
+}
+
+// Tests posting spans to a stand-in for an OpenTelemetry collector.
+func TestOTLPExporter(t *testing.T) {
+	var received otlpRequest
+	status := http.StatusOK
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("Unexpected request %s %s %s", r.Method, r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			t.Error(err)
+		}
+		w.WriteHeader(status)
+	}))
+	defer collector.Close()
+
+	exporter := NewOTLPExporter(collector.URL+"/v1/traces", "credentials", collector.Client())
+	if err := exporter.ExportSpans(context.Background(), []SpanData{sampleSpan()}); err != nil {
+		t.Fatal(err)
+	}
+
+	resource := received.ResourceSpans[0]
+	if resource.Resource.Attributes[0].Key != "service.name" || resource.Resource.Attributes[0].Value["stringValue"] != "credentials" {
+		t.Fatalf("Unexpected resource %+v", resource.Resource)
+	}
+	span := resource.ScopeSpans[0].Spans[0]
+	expected := otlpSpan{
+		TraceID:           "4bf92f3577b34da6a3ce929d0e0e4736",
+		SpanID:            "00f067aa0ba902b7",
+		ParentSpanID:      "0102030405060708",
+		Name:              "store.AddUser",
+		Kind:              KindInternal,
+		StartTimeUnixNano: "1617278400000000000",
+		EndTimeUnixNano:   "1617278400001500000",
+		Status:            otlpStatus{2, "User Already Exists"},
+	}
+	attributes := span.Attributes
+	span.Attributes = nil
+	if !reflect.DeepEqual(span, expected) || len(attributes) != 1 || attributes[0].Value["intValue"] != "3" {
+		t.Fatalf("Unexpected span %+v %+v", span, attributes)
+	}
+
+	// Collector errors are reported.
+	status = http.StatusServiceUnavailable
+	if err := exporter.ExportSpans(context.Background(), []SpanData{sampleSpan()}); err == nil {
+		t.Fatal("Expected an error from a failing collector.")
+	}
+
+	// And so are unreachable collectors.
+	collector.Close()
+	err := exporter.ExportSpans(context.Background(), []SpanData{sampleSpan()})
+	if err == nil || errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected a connection error. Got %v", err)
+	}
+}
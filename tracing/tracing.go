@@ -0,0 +1,392 @@
+// Package tracing records spans of work and sends them to an Exporter.
+//
+// Spans follow the OpenTelemetry data model closely enough to be sent
+// to an OpenTelemetry collector with the OTLP exporter, and traces are
+// carried across services in the W3C traceparent header:
+//
+//	traceparent: 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+//
+// Start a span with Start and end it with End. Spans started from a
+// context holding another span become its children.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/BearCloud/sp21-assignment-4/logging"
+)
+
+// A TraceID identifies every span in a trace.
+type TraceID [16]byte
+
+// A SpanID identifies a single span within a trace.
+type SpanID [8]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+func (s SpanID) String() string  { return hex.EncodeToString(s[:]) }
+
+// IsValid reports whether t is not all zeros.
+func (t TraceID) IsValid() bool { return t != TraceID{} }
+
+// IsValid reports whether s is not all zeros.
+func (s SpanID) IsValid() bool { return s != SpanID{} }
+
+// A SpanContext is the part of a span passed between services.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+// IsValid reports whether both IDs are set.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// TraceparentHeader is the W3C header carrying a SpanContext.
+const TraceparentHeader = "traceparent"
+
+// Traceparent formats sc as a traceparent header value.
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-" + flags
+}
+
+// ParseTraceparent parses a traceparent header value. It reports false
+// for values it doesn't understand, which should be ignored.
+func ParseTraceparent(value string) (SpanContext, bool) {
+	var sc SpanContext
+	// version-traceid-spanid-flags, with later versions allowed to
+	// append more fields.
+	if len(value) < 55 || value[2] != '-' || value[35] != '-' || value[52] != '-' {
+		return sc, false
+	}
+	version, err := hex.DecodeString(value[:2])
+	if err != nil || version[0] == 0xff || (version[0] == 0 && len(value) != 55) {
+		return sc, false
+	}
+	if len(value) > 55 && value[55] != '-' {
+		return sc, false
+	}
+	flags, err := hex.DecodeString(value[53:55])
+	if err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(value[3:35])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(value[36:52])); err != nil {
+		return sc, false
+	}
+	if !sc.IsValid() {
+		return SpanContext{}, false
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, true
+}
+
+// Extract returns the SpanContext in the traceparent header of h.
+func Extract(h http.Header) (SpanContext, bool) {
+	return ParseTraceparent(h.Get(TraceparentHeader))
+}
+
+// Inject sets the traceparent header of h to the span in ctx, if any.
+func Inject(ctx context.Context, h http.Header) {
+	if sc := SpanFromContext(ctx).SpanContext(); sc.IsValid() {
+		h.Set(TraceparentHeader, sc.Traceparent())
+	}
+}
+
+// The kinds of span, numbered as in OTLP.
+const (
+	KindInternal = 1
+	KindServer   = 2
+	KindClient   = 3
+)
+
+// An Attribute is a key value pair describing a span.
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// Attr returns an Attribute. Values should be strings, bools, ints,
+// int64s or float64s.
+func Attr(key string, value interface{}) Attribute {
+	return Attribute{key, value}
+}
+
+// SpanData is a finished span as handed to an Exporter.
+type SpanData struct {
+	Name       string
+	Kind       int
+	Context    SpanContext
+	Parent     SpanID
+	Start, End time.Time
+	Attributes []Attribute
+	// Err is set when the span's work failed.
+	Err string
+}
+
+// An Exporter sends finished spans somewhere.
+type Exporter interface {
+	// ExportSpans sends a batch of spans.
+	ExportSpans(ctx context.Context, spans []SpanData) error
+	// Shutdown releases anything the exporter holds.
+	Shutdown(ctx context.Context) error
+}
+
+// A Span is work being traced. A nil *Span is valid and does nothing,
+// so callers never have to check whether tracing is turned on.
+type Span struct {
+	tracer *Tracer
+	lock   sync.Mutex
+	data   SpanData
+	ended  bool
+}
+
+// SpanContext returns the IDs of s.
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.data.Context
+}
+
+// SetAttributes adds attributes to s.
+func (s *Span) SetAttributes(attrs ...Attribute) {
+	if s == nil || s.tracer == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.data.Attributes = append(s.data.Attributes, attrs...)
+}
+
+// SetError marks s as failed if err isn't nil.
+func (s *Span) SetError(err error) {
+	if s == nil || s.tracer == nil || err == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.data.Err = err.Error()
+}
+
+// End finishes s and queues it for export. Only the first call counts.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	if s.ended {
+		s.lock.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	data := s.data
+	s.lock.Unlock()
+
+	if s.tracer != nil {
+		s.tracer.queue(data)
+	}
+}
+
+type spanKey struct{}
+
+// ContextWithSpan returns a copy of ctx carrying s.
+func ContextWithSpan(ctx context.Context, s *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, s)
+}
+
+// SpanFromContext returns the span carried by ctx, or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// ContextWithRemoteParent returns a copy of ctx whose next span will
+// be a child of sc, which usually comes from Extract.
+func ContextWithRemoteParent(ctx context.Context, sc SpanContext) context.Context {
+	return ContextWithSpan(ctx, &Span{data: SpanData{Context: sc}, ended: true})
+}
+
+// Tracer options.
+const (
+	// How many spans are queued before new ones are dropped.
+	queueSize = 2048
+	// How many spans are sent to the exporter at once.
+	batchSize = 512
+	// How long spans wait in the queue at most.
+	flushInterval = 5 * time.Second
+)
+
+// A Tracer starts spans and exports them in batches in the background.
+type Tracer struct {
+	exporter Exporter
+	spans    chan SpanData
+	flush    chan chan struct{}
+	done     chan struct{}
+	stopped  chan struct{}
+	closing  sync.Once
+}
+
+// NewTracer returns a Tracer sending spans to exporter. Call Shutdown
+// to send any spans still queued.
+func NewTracer(exporter Exporter) *Tracer {
+	t := &Tracer{
+		exporter: exporter,
+		spans:    make(chan SpanData, queueSize),
+		flush:    make(chan chan struct{}),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+var (
+	defaultLock   sync.Mutex
+	defaultTracer *Tracer
+)
+
+// SetDefault sets the tracer used by Start. A nil tracer turns
+// recording off, though trace IDs are still propagated.
+func SetDefault(t *Tracer) {
+	defaultLock.Lock()
+	defer defaultLock.Unlock()
+	defaultTracer = t
+}
+
+// Default returns the tracer used by Start, which may be nil.
+func Default() *Tracer {
+	defaultLock.Lock()
+	defer defaultLock.Unlock()
+	return defaultTracer
+}
+
+// Start starts a span with the default tracer. See Tracer.Start.
+func Start(ctx context.Context, name string, kind int, attrs ...Attribute) (context.Context, *Span) {
+	return Default().Start(ctx, name, kind, attrs...)
+}
+
+// Start starts a span that is a child of the span in ctx, if any, and
+// returns a copy of ctx carrying it. Unsampled traces and nil tracers
+// give spans that keep the trace's IDs but record nothing.
+func (t *Tracer) Start(ctx context.Context, name string, kind int, attrs ...Attribute) (context.Context, *Span) {
+	parent := SpanFromContext(ctx).SpanContext()
+
+	span := &Span{data: SpanData{Name: name, Kind: kind, Start: time.Now()}}
+	if parent.IsValid() {
+		span.data.Context.TraceID = parent.TraceID
+		span.data.Context.Sampled = parent.Sampled
+		span.data.Parent = parent.SpanID
+	} else {
+		rand.Read(span.data.Context.TraceID[:])
+		span.data.Context.Sampled = t != nil
+	}
+	rand.Read(span.data.Context.SpanID[:])
+	if t != nil && span.data.Context.Sampled {
+		span.tracer = t
+		span.data.Attributes = attrs
+	}
+	return ContextWithSpan(ctx, span), span
+}
+
+// Queues a finished span, dropping it if the queue is full or the
+// tracer has shut down.
+func (t *Tracer) queue(data SpanData) {
+	select {
+	case <-t.done:
+	case t.spans <- data:
+	default:
+	}
+}
+
+// Exports queued spans until Shutdown is called.
+func (t *Tracer) run() {
+	defer close(t.stopped)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	var batch []SpanData
+	export := func() {
+		if len(batch) > 0 {
+			if err := t.exporter.ExportSpans(context.Background(), batch); err != nil {
+				logging.Default().Warn("exporting spans", "spans", len(batch), "error", err)
+			}
+			batch = nil
+		}
+	}
+	drain := func() {
+		for {
+			select {
+			case data := <-t.spans:
+				batch = append(batch, data)
+				if len(batch) >= batchSize {
+					export()
+				}
+			default:
+				export()
+				return
+			}
+		}
+	}
+
+	for {
+		select {
+		case data := <-t.spans:
+			batch = append(batch, data)
+			if len(batch) >= batchSize {
+				export()
+			}
+		case <-ticker.C:
+			export()
+		case flushed := <-t.flush:
+			drain()
+			close(flushed)
+		case <-t.done:
+			drain()
+			return
+		}
+	}
+}
+
+// Flush exports every span queued so far, waiting until ctx is done at most.
+func (t *Tracer) Flush(ctx context.Context) error {
+	flushed := make(chan struct{})
+	select {
+	case t.flush <- flushed:
+	case <-t.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-flushed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Shutdown exports every queued span and shuts the exporter down.
+// Spans ended afterwards are dropped.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	t.closing.Do(func() { close(t.done) })
+	select {
+	case <-t.stopped:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return t.exporter.Shutdown(ctx)
+}
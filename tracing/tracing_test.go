@@ -0,0 +1,149 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Collects exported spans in memory.
+type memoryExporter struct {
+	lock     sync.Mutex
+	spans    []SpanData
+	shutdown bool
+}
+
+func (m *memoryExporter) ExportSpans(ctx context.Context, spans []SpanData) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.spans = append(m.spans, spans...)
+	return nil
+}
+
+func (m *memoryExporter) Shutdown(ctx context.Context) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.shutdown = true
+	return nil
+}
+
+// Tests parsing and formatting traceparent headers.
+func TestTraceparent(t *testing.T) {
+	tests := []struct {
+		Name    string
+		Value   string
+		Valid   bool
+		Sampled bool
+	}{
+		{"Sampled", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, true},
+		{"Not Sampled", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true, false},
+		{"Future Version", "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", true, true},
+		{"Extra Fields In Version 0", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false, false},
+		{"Invalid Version", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"Zero Trace ID", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, false},
+		{"Not Hex", "00-4bf92f3577b34da6a3ce929d0e0e47zz-00f067aa0ba902b7-01", false, false},
+		{"Too Short", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7", false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			sc, ok := ParseTraceparent(test.Value)
+			if ok != test.Valid || sc.Sampled != test.Sampled {
+				t.Fatalf("ParseTraceparent(%q) = %+v, %v", test.Value, sc, ok)
+			}
+			if ok && sc.Traceparent() != test.Value[:55] && test.Value[:2] == "00" {
+				t.Fatalf("Traceparent() = %q", sc.Traceparent())
+			}
+		})
+	}
+}
+
+// Tests that spans form a trace, continue remote parents and are
+// exported on shutdown.
+func TestTracer(t *testing.T) {
+	exporter := &memoryExporter{}
+	tracer := NewTracer(exporter)
+
+	// Continue a trace from an incoming request.
+	header := http.Header{}
+	header.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	remote, _ := Extract(header)
+	ctx := ContextWithRemoteParent(context.Background(), remote)
+
+	ctx, server := tracer.Start(ctx, "POST /api/signup", KindServer, Attr("http.method", "POST"))
+	_, store := tracer.Start(ctx, "store.AddUser", KindInternal)
+	store.SetError(errors.New("User Already Exists"))
+	store.End()
+	server.SetAttributes(Attr("http.status_code", 409))
+	server.End()
+	server.End()
+
+	// Outgoing requests carry the current span.
+	outgoing := http.Header{}
+	Inject(ctx, outgoing)
+	if outgoing.Get(TraceparentHeader) != server.SpanContext().Traceparent() {
+		t.Fatalf("Expected the server span to be injected. Got %q", outgoing.Get(TraceparentHeader))
+	}
+
+	if err := tracer.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(exporter.spans) != 2 || !exporter.shutdown {
+		t.Fatalf("Expected 2 spans and a shut down exporter. Got %d %v", len(exporter.spans), exporter.shutdown)
+	}
+	child, parent := exporter.spans[0], exporter.spans[1]
+	if parent.Context.TraceID != remote.TraceID || parent.Parent != remote.SpanID {
+		t.Fatalf("Expected the server span to continue the remote trace. Got %+v", parent)
+	}
+	if child.Context.TraceID != remote.TraceID || child.Parent != parent.Context.SpanID || child.Err != "User Already Exists" {
+		t.Fatalf("Expected the store span to be a child of the server span. Got %+v", child)
+	}
+	if len(parent.Attributes) != 2 || parent.End.Before(parent.Start) {
+		t.Fatalf("Unexpected server span %+v", parent)
+	}
+
+	// Spans ended after shutdown are dropped.
+	_, late := tracer.Start(context.Background(), "late", KindInternal)
+	late.End()
+	time.Sleep(10 * time.Millisecond)
+	if len(exporter.spans) != 2 {
+		t.Fatal("Expected spans ended after shutdown to be dropped.")
+	}
+}
+
+// Tests that spans are recorded only when they should be.
+func TestSampling(t *testing.T) {
+	exporter := &memoryExporter{}
+	tracer := NewTracer(exporter)
+
+	// Without a tracer, IDs still propagate but nothing is recorded.
+	var none *Tracer
+	ctx, span := none.Start(context.Background(), "untraced", KindServer)
+	_, child := none.Start(ctx, "child", KindInternal)
+	if !span.SpanContext().IsValid() || child.SpanContext().TraceID != span.SpanContext().TraceID || span.SpanContext().Sampled {
+		t.Fatalf("Expected unsampled spans sharing a trace. Got %+v %+v", span.SpanContext(), child.SpanContext())
+	}
+	span.End()
+
+	// Callers that didn't sample the trace aren't overridden.
+	remote, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	_, unsampled := tracer.Start(ContextWithRemoteParent(context.Background(), remote), "unsampled", KindServer)
+	unsampled.End()
+
+	// A nil span is safe to use.
+	var nilSpan *Span
+	nilSpan.SetAttributes(Attr("a", 1))
+	nilSpan.SetError(errors.New("ignored"))
+	nilSpan.End()
+
+	if err := tracer.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(exporter.spans) != 0 {
+		t.Fatalf("Expected no spans to be exported. Got %+v", exporter.spans)
+	}
+	tracer.Shutdown(context.Background())
+}
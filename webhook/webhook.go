@@ -0,0 +1,351 @@
+// Package webhook delivers events to HTTP endpoints that subscribe to
+// them.
+//
+// Every delivery is a POST of the event's JSON payload, signed with an
+// HMAC-SHA256 of the subscription's secret in the Webhook-Signature
+// header. See Sign and Verify. Deliveries that fail are retried with
+// exponential backoff, and once they have been tried MaxAttempts times
+// they are put on a dead-letter list instead. Each subscription gets
+// its events in order from its own queue, so a slow or failing
+// endpoint only holds up its own deliveries.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BearCloud/sp21-assignment-4/logging"
+)
+
+// The headers sent with every delivery.
+const (
+	SignatureHeader = "Webhook-Signature"
+	EventHeader     = "Webhook-Event"
+	IDHeader        = "Webhook-ID"
+)
+
+// A Subscription is an endpoint that wants to be told about events.
+type Subscription struct {
+	URL    string
+	Secret string
+	// The event types delivered to URL. Empty means every type.
+	Events []string
+}
+
+// Wants reports whether events of eventType are delivered to s.
+func (s Subscription) Wants(eventType string) bool {
+	if len(s.Events) == 0 {
+		return true
+	}
+	for _, e := range s.Events {
+		if e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Options tune how events are delivered. Zero fields take the values
+// in DefaultOptions.
+type Options struct {
+	// How many times a delivery is tried before it is dead-lettered.
+	MaxAttempts int
+	// How long to wait before the first retry. Each retry after that
+	// waits twice as long as the one before, up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// How long a single attempt may take.
+	Timeout time.Duration
+	// How many deliveries may wait for each subscription. Events
+	// arriving when the queue is full are dead-lettered straight away.
+	QueueSize int
+	// The most dead letters kept. The oldest are dropped first.
+	MaxDeadLetters int
+}
+
+// DefaultOptions are used for any zero field of Options.
+var DefaultOptions = Options{
+	MaxAttempts:    8,
+	Backoff:        time.Second,
+	MaxBackoff:     5 * time.Minute,
+	Timeout:        10 * time.Second,
+	QueueSize:      1000,
+	MaxDeadLetters: 1000,
+}
+
+// A DeadLetter is a delivery that was given up on.
+type DeadLetter struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Event     string    `json:"event"`
+	Payload   string    `json:"payload"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"last_error"`
+	Time      time.Time `json:"time"`
+}
+
+// A single event on its way to a single subscription.
+type delivery struct {
+	id      string
+	event   string
+	payload []byte
+}
+
+// A Dispatcher delivers events to its subscriptions. It is safe for
+// concurrent use.
+type Dispatcher struct {
+	opts   Options
+	client *http.Client
+	subs   []*subscriber
+
+	mu     sync.RWMutex
+	closed bool
+	dead   []DeadLetter
+
+	wg    sync.WaitGroup
+	abort chan struct{}
+}
+
+// The queue of deliveries for a single subscription.
+type subscriber struct {
+	Subscription
+	queue chan delivery
+}
+
+// New starts delivering events to subs. client may be nil to use a
+// client with opts.Timeout.
+func New(subs []Subscription, opts Options, client *http.Client) *Dispatcher {
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = DefaultOptions.MaxAttempts
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = DefaultOptions.Backoff
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = DefaultOptions.MaxBackoff
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultOptions.Timeout
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = DefaultOptions.QueueSize
+	}
+	if opts.MaxDeadLetters <= 0 {
+		opts.MaxDeadLetters = DefaultOptions.MaxDeadLetters
+	}
+	if client == nil {
+		client = &http.Client{Timeout: opts.Timeout}
+	}
+
+	d := &Dispatcher{opts: opts, client: client, abort: make(chan struct{})}
+	for _, sub := range subs {
+		s := &subscriber{Subscription: sub, queue: make(chan delivery, opts.QueueSize)}
+		d.subs = append(d.subs, s)
+		d.wg.Add(1)
+		go d.run(s)
+	}
+	return d
+}
+
+// Publish queues payload, an event of type eventType, for every
+// subscription that wants it. It never blocks.
+func (d *Dispatcher) Publish(eventType string, payload []byte) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return
+	}
+	for _, s := range d.subs {
+		if !s.Wants(eventType) {
+			continue
+		}
+		del := delivery{id: newID(), event: eventType, payload: payload}
+		select {
+		case s.queue <- del:
+		default:
+			go d.deadLetter(s, del, 0, errors.New("queue full"))
+		}
+	}
+}
+
+// DeadLetters returns the deliveries that were given up on, oldest
+// first.
+func (d *Dispatcher) DeadLetters() []DeadLetter {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return append([]DeadLetter{}, d.dead...)
+}
+
+// ClearDeadLetters empties the dead-letter list.
+func (d *Dispatcher) ClearDeadLetters() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dead = nil
+}
+
+// Close stops accepting events and waits for those already queued to
+// be delivered. If ctx ends first, retries stop and every delivery
+// left is dead-lettered.
+func (d *Dispatcher) Close(ctx context.Context) error {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return nil
+	}
+	d.closed = true
+	for _, s := range d.subs {
+		close(s.queue)
+	}
+	d.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		close(d.abort)
+		<-done
+		return ctx.Err()
+	}
+}
+
+// Delivers everything queued for s in order.
+func (d *Dispatcher) run(s *subscriber) {
+	defer d.wg.Done()
+	for del := range s.queue {
+		d.deliver(s, del)
+	}
+}
+
+// Tries a delivery until it succeeds or has been tried MaxAttempts
+// times, backing off between attempts.
+func (d *Dispatcher) deliver(s *subscriber, del delivery) {
+	backoff := d.opts.Backoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = d.attempt(s, del); err == nil {
+			return
+		}
+		if attempt == d.opts.MaxAttempts {
+			d.deadLetter(s, del, attempt, err)
+			return
+		}
+		select {
+		case <-time.After(backoff):
+		case <-d.abort:
+			d.deadLetter(s, del, attempt, fmt.Errorf("shut down after: %s", err))
+			return
+		}
+		if backoff *= 2; backoff > d.opts.MaxBackoff {
+			backoff = d.opts.MaxBackoff
+		}
+	}
+}
+
+// Sends a delivery once. Any response but a 2xx is a failure.
+func (d *Dispatcher) attempt(s *subscriber, del delivery) error {
+	ctx, cancel := context.WithTimeout(context.Background(), d.opts.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(del.payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, del.event)
+	req.Header.Set(IDHeader, del.id)
+	req.Header.Set(SignatureHeader, Sign(s.Secret, time.Now(), del.payload))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("endpoint responded %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Gives up on a delivery.
+func (d *Dispatcher) deadLetter(s *subscriber, del delivery, attempts int, err error) {
+	logging.Default().Warn("webhook delivery failed", "id", del.id, "url", s.URL, "event", del.event, "attempts", attempts, "error", err)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dead = append(d.dead, DeadLetter{
+		ID:        del.id,
+		URL:       s.URL,
+		Event:     del.event,
+		Payload:   string(del.payload),
+		Attempts:  attempts,
+		LastError: err.Error(),
+		Time:      time.Now(),
+	})
+	if over := len(d.dead) - d.opts.MaxDeadLetters; over > 0 {
+		d.dead = append([]DeadLetter{}, d.dead[over:]...)
+	}
+}
+
+// Sign returns the Webhook-Signature header for payload sent at t:
+// "t=<unix seconds>,v1=<hex HMAC-SHA256 of secret over "<t>.<payload>">".
+// Signing the time lets receivers reject old deliveries being replayed.
+func Sign(secret string, t time.Time, payload []byte) string {
+	timestamp := strconv.FormatInt(t.Unix(), 10)
+	return "t=" + timestamp + ",v1=" + mac(secret, timestamp, payload)
+}
+
+// Verify checks a Webhook-Signature header against payload, failing if
+// it wasn't made with secret or was made more than tolerance before now.
+func Verify(secret, header string, payload []byte, now time.Time, tolerance time.Duration) error {
+	var timestamp, signature string
+	for _, part := range strings.Split(header, ",") {
+		if strings.HasPrefix(part, "t=") {
+			timestamp = part[2:]
+		} else if strings.HasPrefix(part, "v1=") {
+			signature = part[3:]
+		}
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || signature == "" {
+		return errors.New("malformed signature")
+	}
+	if !hmac.Equal([]byte(signature), []byte(mac(secret, timestamp, payload))) {
+		return errors.New("signature does not match")
+	}
+	if age := now.Sub(time.Unix(unix, 0)); age > tolerance || age < -tolerance {
+		return errors.New("signature too old")
+	}
+	return nil
+}
+
+func mac(secret, timestamp string, payload []byte) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(timestamp + "."))
+	h.Write(payload)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Returns 16 random bytes in hex.
+func newID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
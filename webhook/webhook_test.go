@@ -0,0 +1,161 @@
+package webhook
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Options that retry quickly enough for tests.
+var testOptions = Options{MaxAttempts: 3, Backoff: time.Millisecond, MaxBackoff: 4 * time.Millisecond}
+
+// A local endpoint recording the deliveries it gets. It fails the
+// first failures requests with 503 Service Unavailable.
+type receiver struct {
+	*httptest.Server
+	mu        sync.Mutex
+	failures  int
+	requests  int
+	delivered []string
+	times     []time.Time
+	errs      []error
+}
+
+func newReceiver(secret string, failures int) *receiver {
+	r := &receiver{failures: failures}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.requests++
+		r.times = append(r.times, time.Now())
+		if err := Verify(secret, req.Header.Get(SignatureHeader), body, time.Now(), time.Minute); err != nil {
+			r.errs = append(r.errs, err)
+		}
+		if r.requests <= r.failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		r.delivered = append(r.delivered, req.Header.Get(EventHeader)+" "+string(body))
+	}))
+	return r
+}
+
+// Tests that deliveries are signed, filtered, retried and delivered in
+// order.
+func TestDelivery(t *testing.T) {
+	everything := newReceiver("secret", 2)
+	defer everything.Close()
+	deletions := newReceiver("other secret", 0)
+	defer deletions.Close()
+
+	d := New([]Subscription{
+		{URL: everything.URL, Secret: "secret"},
+		{URL: deletions.URL, Secret: "other secret", Events: []string{"user.deleted"}},
+	}, testOptions, nil)
+	d.Publish("user.created", []byte(`{"n":1}`))
+	d.Publish("user.deleted", []byte(`{"n":2}`))
+	if err := d.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `user.created {"n":1},user.deleted {"n":2}`
+	if got := strings.Join(everything.delivered, ","); got != expected {
+		t.Errorf("Expected %s. Got %s", expected, got)
+	}
+	if got := strings.Join(deletions.delivered, ","); got != `user.deleted {"n":2}` {
+		t.Errorf("Expected only the deletion. Got %s", got)
+	}
+	if everything.requests != 4 {
+		t.Errorf("Expected 2 failed attempts and 2 deliveries. Got %d requests", everything.requests)
+	}
+	// Each retry waits longer than the one before.
+	if first, second := everything.times[1].Sub(everything.times[0]), everything.times[2].Sub(everything.times[1]); first < time.Millisecond || second < 2*time.Millisecond {
+		t.Errorf("Expected backoffs of at least 1ms and 2ms. Got %v and %v", first, second)
+	}
+	for _, r := range []*receiver{everything, deletions} {
+		if len(r.errs) > 0 {
+			t.Errorf("Expected every signature to verify. Got %v", r.errs)
+		}
+	}
+	if letters := d.DeadLetters(); len(letters) != 0 {
+		t.Errorf("Expected no dead letters. Got %+v", letters)
+	}
+}
+
+// Tests that deliveries failing every attempt are dead-lettered.
+func TestDeadLetters(t *testing.T) {
+	failing := newReceiver("secret", 100)
+	defer failing.Close()
+
+	d := New([]Subscription{{URL: failing.URL, Secret: "secret"}}, testOptions, nil)
+	d.Publish("user.created", []byte(`{"n":1}`))
+	d.Close(context.Background())
+
+	letters := d.DeadLetters()
+	if len(letters) != 1 || letters[0].Attempts != testOptions.MaxAttempts || letters[0].Payload != `{"n":1}` ||
+		letters[0].Event != "user.created" || !strings.Contains(letters[0].LastError, "503") {
+		t.Fatalf("Expected a dead letter after %d attempts. Got %+v", testOptions.MaxAttempts, letters)
+	}
+	d.ClearDeadLetters()
+	if letters := d.DeadLetters(); len(letters) != 0 {
+		t.Fatalf("Expected the dead letters to be cleared. Got %+v", letters)
+	}
+
+	// Events published once closed are dropped.
+	d.Publish("user.created", []byte(`{"n":2}`))
+	if failing.requests != testOptions.MaxAttempts {
+		t.Fatalf("Expected %d requests. Got %d", testOptions.MaxAttempts, failing.requests)
+	}
+}
+
+// Tests that closing gives up on retries once its context ends.
+func TestCloseTimeout(t *testing.T) {
+	failing := newReceiver("secret", 100)
+	defer failing.Close()
+
+	d := New([]Subscription{{URL: failing.URL, Secret: "secret"}}, Options{MaxAttempts: 5, Backoff: time.Hour}, nil)
+	d.Publish("user.created", []byte(`{}`))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := d.Close(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Expected %v. Got %v", context.DeadlineExceeded, err)
+	}
+	if letters := d.DeadLetters(); len(letters) != 1 || letters[0].Attempts != 1 {
+		t.Fatalf("Expected a dead letter after 1 attempt. Got %+v", letters)
+	}
+}
+
+// Tests checking signatures.
+func TestVerify(t *testing.T) {
+	now := time.Now()
+	payload := []byte(`{"type":"user.created"}`)
+	signature := Sign("secret", now, payload)
+
+	tests := []struct {
+		Name      string
+		Secret    string
+		Header    string
+		Payload   []byte
+		ExpectErr bool
+	}{
+		{"Valid", "secret", signature, payload, false},
+		{"Wrong Secret", "guess", signature, payload, true},
+		{"Changed Payload", "secret", signature, []byte(`{"type":"user.deleted"}`), true},
+		{"Too Old", "secret", Sign("secret", now.Add(-time.Hour), payload), payload, true},
+		{"Malformed", "secret", "v1=abc", payload, true},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			err := Verify(test.Secret, test.Header, test.Payload, now, 5*time.Minute)
+			if (err != nil) != test.ExpectErr {
+				t.Errorf("Expected an error: %v. Got %v", test.ExpectErr, err)
+			}
+		})
+	}
+}